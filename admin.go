@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Endpoints for node operators to inspect peer rankings and manage bans. They are only mounted when
+// the node is started with --admin-token, and every request must send it as a bearer token.
+func mountAdminRoutes(r chi.Router, peerSet *PeerSet, token string) {
+	r.Use(requireAdminToken(token))
+
+	r.Get("/peers", func(w http.ResponseWriter, r *http.Request) {
+		var peers = []map[string]interface{}{}
+		for _, peer := range peerSet.ListOthers() {
+			rank, _ := peerSet.Ranking(peer.Id)
+			handshake, _ := peerSet.Handshake(peer.Id)
+			direction, _ := peerSet.Direction(peer.Id)
+			peers = append(peers, map[string]interface{}{
+				"peer":      peer,
+				"ranking":   rank,
+				"handshake": handshake,
+				"direction": direction,
+			})
+		}
+		render.JSON(w, r, map[string]interface{}{"peers": peers})
+	})
+
+	r.Get("/bans", func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, map[string]interface{}{"bans": peerSet.Bans()})
+	})
+
+	// Manually ban a peer. The duration is a go duration string (ie, "1h30m"), and if left out the ban
+	// never expires.
+	r.Post("/bans", func(w http.ResponseWriter, r *http.Request) {
+		byt, ok := readBody(w, r, API_MAX_ADMIN_BODY_SIZE)
+		if !ok {
+			return
+		}
+		var request struct {
+			Id       string `json:"id"`
+			Duration string `json:"duration"`
+			Reason   string `json:"reason"`
+		}
+		if err := json.Unmarshal(byt, &request); err != nil {
+			respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing body!"))
+			return
+		}
+
+		rawPeerId, err := uuid.Parse(request.Id)
+		if err != nil {
+			respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing peer id!"))
+			return
+		}
+
+		duration := time.Duration(0)
+		if len(request.Duration) > 0 {
+			duration, err = time.ParseDuration(request.Duration)
+			if err != nil || duration < 0 {
+				respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing duration!"))
+				return
+			}
+		}
+
+		reason := request.Reason
+		if len(reason) == 0 {
+			reason = "Banned by admin"
+		}
+		peerSet.Ban(PeerId(rawPeerId), duration, reason)
+		render.JSON(w, r, map[string]interface{}{"status": "ok"})
+	})
+
+	r.Delete("/bans/{id}", func(w http.ResponseWriter, r *http.Request) {
+		rawPeerId, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing peer id!"))
+			return
+		}
+		if ok := peerSet.Unban(PeerId(rawPeerId)); !ok {
+			respondError(w, r, NewAPIError(ERROR_CODE_NOT_FOUND, "Peer is not banned!"))
+			return
+		}
+		render.JSON(w, r, map[string]interface{}{"status": "ok"})
+	})
+}
+
+// The bearer token sent with a request
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Whether a request was sent with the token, which is never true for an empty one
+func hasBearerToken(r *http.Request, token string) bool {
+	return len(token) > 0 && subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(token)) == 1
+}
+
+func requireAdminToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasBearerToken(r, token) {
+				respondError(w, r, NewAPIError(ERROR_CODE_UNAUTHORIZED, "Invalid admin token!"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
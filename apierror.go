@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/render"
+	"net/http"
+)
+
+// Errors from the api are sent with a status code that says what kind of error it was, and a body
+// like {"code": "invalid_signature", "message": "..."}. The code is stable, so clients (including
+// other nodes) can act on it, while the message is only meant for people.
+type ErrorCode string
+
+const ERROR_CODE_BAD_REQUEST = ErrorCode("bad_request")
+const ERROR_CODE_UNAUTHORIZED = ErrorCode("unauthorized")
+const ERROR_CODE_FORBIDDEN = ErrorCode("forbidden")
+const ERROR_CODE_NOT_FOUND = ErrorCode("not_found")
+const ERROR_CODE_DUPLICATE = ErrorCode("duplicate")
+const ERROR_CODE_INVALID_SIGNATURE = ErrorCode("invalid_signature")
+const ERROR_CODE_INVALID_PROOF_OF_WORK = ErrorCode("invalid_proof_of_work")
+const ERROR_CODE_INVALID_BLOCK = ErrorCode("invalid_block")
+const ERROR_CODE_EXPIRED = ErrorCode("expired")
+const ERROR_CODE_INVALID_NONCE = ErrorCode("invalid_nonce")
+const ERROR_CODE_TOO_LARGE = ErrorCode("too_large")
+const ERROR_CODE_RATE_LIMITED = ErrorCode("rate_limited")
+const ERROR_CODE_CURSOR_EXPIRED = ErrorCode("cursor_expired")
+const ERROR_CODE_INTERNAL = ErrorCode("internal")
+
+func (c ErrorCode) StatusCode() int {
+	switch c {
+	case ERROR_CODE_BAD_REQUEST:
+		return http.StatusBadRequest
+	case ERROR_CODE_UNAUTHORIZED:
+		return http.StatusUnauthorized
+	case ERROR_CODE_FORBIDDEN:
+		return http.StatusForbidden
+	case ERROR_CODE_NOT_FOUND:
+		return http.StatusNotFound
+	case ERROR_CODE_DUPLICATE:
+		return http.StatusConflict
+	case ERROR_CODE_INVALID_SIGNATURE, ERROR_CODE_INVALID_PROOF_OF_WORK, ERROR_CODE_INVALID_BLOCK, ERROR_CODE_EXPIRED, ERROR_CODE_INVALID_NONCE:
+		return http.StatusUnprocessableEntity
+	case ERROR_CODE_TOO_LARGE:
+		return http.StatusRequestEntityTooLarge
+	case ERROR_CODE_RATE_LIMITED:
+		return http.StatusTooManyRequests
+	case ERROR_CODE_CURSOR_EXPIRED:
+		return http.StatusGone
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type APIError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func NewAPIError(code ErrorCode, message string) APIError {
+	return APIError{Code: code, Message: message}
+}
+
+func (e APIError) Error() string {
+	return e.Message
+}
+
+// Send an error response. Errors that aren't an APIError are sent as internal errors.
+func respondError(w http.ResponseWriter, r *http.Request, err error) {
+	var apiError APIError
+	if !errors.As(err, &apiError) {
+		apiError = NewAPIError(ERROR_CODE_INTERNAL, err.Error())
+	}
+	render.Status(r, apiError.Code.StatusCode())
+	render.JSON(w, r, apiError)
+}
+
+// The error in a response body, if it has one
+func parseAPIError(body []byte) (APIError, bool) {
+	var apiError APIError
+	if err := json.Unmarshal(body, &apiError); err != nil || len(apiError.Code) == 0 {
+		return apiError, false
+	}
+	return apiError, true
+}
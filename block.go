@@ -3,8 +3,8 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -17,9 +17,13 @@ type BlockHash [32]byte
 const HASH_ZERO_PREFIX_LENGTH = 4
 
 func TestHash(hash BlockHash) bool {
-	hashHex := fmt.Sprintf("%x", hash)
+	// Each byte is two hex digits, high one first
 	for i := 0; i < HASH_ZERO_PREFIX_LENGTH; i += 1 {
-		if hashHex[i] != '0' {
+		digit := hash[i/2] >> 4
+		if i%2 == 1 {
+			digit = hash[i/2] & 0x0f
+		}
+		if digit != 0 {
 			return false
 		}
 	}
@@ -31,11 +35,12 @@ func HexToBlockHash(hexHash string) (*BlockHash, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(rawHash) != len(BlockHash{}) {
+		return nil, errors.New(fmt.Sprintf("Block hash is %d bytes long, not %d!", len(rawHash), len(BlockHash{})))
+	}
 
 	var rawHashCopy BlockHash
-	for index, byt := range rawHash {
-		rawHashCopy[index] = byt
-	}
+	copy(rawHashCopy[:], rawHash)
 	return &rawHashCopy, nil
 }
 
@@ -45,11 +50,15 @@ type Block struct {
 	Data      []*Transaction `json:"data"`
 	Number    uint           `json:"number"`
 	Hash      *BlockHash     `json:"hash"`
+
+	// Set when the block is added to the chain, which its previous block has to be in already
+	height      uint64
+	heightKnown bool
 }
 
-func NewBlock(previous *LazyBlock, data []*Transaction) *Block {
+func NewBlock(previous *LazyBlock, data []*Transaction, createdAt time.Time) *Block {
 	return &Block{
-		CreatedAt: time.Now().UTC(),
+		CreatedAt: createdAt,
 		Previous:  previous,
 		Data:      data,
 		Number:    0,
@@ -61,51 +70,146 @@ func NewBlockFromBytes(chain *Blockchain, bytes []byte) (*Block, error) {
 	if len(sections) != 2 {
 		return nil, errors.New("Malformed hash wrapper on block!")
 	}
-	payloadBytes, err0 := base64.StdEncoding.DecodeString(sections[0])
+	payload, err0 := base64.StdEncoding.DecodeString(sections[0])
 	if err0 != nil {
 		return nil, err0
 	}
-	payload := []byte(payloadBytes)
 	hash, err1 := HexToBlockHash(sections[1])
 	if err1 != nil {
 		return nil, err1
 	}
 
-	type BlockRawData struct {
-		CreatedAt       time.Time `json:"created_at"`
-		PreviousHashHex string    `json:"previous_hash"`
-		TransactionsRaw [][]byte  `json:"transactions"`
-		Number          uint      `json:"number"`
-	}
-	var blockRawData BlockRawData
-	err2 := json.Unmarshal(payload, &blockRawData)
+	decoder := NewDecoder(payload)
+	block, err2 := decodeBlockPayload(chain, decoder)
 	if err2 != nil {
 		return nil, err2
 	}
+	if err := decoder.Finish(); err != nil {
+		return nil, err
+	}
+	block.Hash = hash
+
+	return block, nil
+}
 
-	previousHash, err3 := HexToBlockHash(blockRawData.PreviousHashHex)
-	if err3 != nil {
-		return nil, err3
+// Decode a block in the canonical binary encoding, as produced by Encode
+func DecodeBlock(chain *Blockchain, data []byte) (*Block, error) {
+	decoder := NewDecoder(data)
+	block, err := decodeBlockPayload(chain, decoder)
+	if err != nil {
+		return nil, err
+	}
+	rawHash, err := decoder.ReadFixedBytes(len(BlockHash{}))
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Finish(); err != nil {
+		return nil, err
 	}
 
+	var hash BlockHash
+	copy(hash[:], rawHash)
+	block.Hash = &hash
+	return block, nil
+}
+func decodeBlockPayload(chain *Blockchain, decoder *Decoder) (*Block, error) {
+	if err := decoder.ReadVersion(); err != nil {
+		return nil, err
+	}
+
+	createdAt, err := decoder.ReadInt64()
+	if err != nil {
+		return nil, err
+	}
+
+	var previousHash *BlockHash
+	hasPrevious, err := decoder.ReadBool()
+	if err != nil {
+		return nil, err
+	}
+	if hasPrevious {
+		rawPreviousHash, err := decoder.ReadFixedBytes(len(BlockHash{}))
+		if err != nil {
+			return nil, err
+		}
+		previousHash = &BlockHash{}
+		copy(previousHash[:], rawPreviousHash)
+	}
+
+	number, err := decoder.ReadUint64()
+	if err != nil {
+		return nil, err
+	}
+
+	transactionCount, err := decoder.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
 	var transactions []*Transaction
-	for _, byt := range blockRawData.TransactionsRaw {
-		transaction, err := NewTransactionFromBytes(byt)
+	for i := uint32(0); i < transactionCount; i += 1 {
+		transaction, err := decodeTransaction(decoder)
 		if err != nil {
 			return nil, err
 		}
 		transactions = append(transactions, transaction)
 	}
 
-	block := Block{
-		CreatedAt: blockRawData.CreatedAt,
-		Number:    blockRawData.Number,
+	return &Block{
+		CreatedAt: time.Unix(0, createdAt).UTC(),
+		Number:    uint(number),
 		Previous:  NewLazyBlockFromHash(chain, previousHash),
 		Data:      transactions,
-		Hash:      hash,
+		Hash:      nil,
+	}, nil
+}
+
+// Encode everything that the block hash covers in the canonical binary encoding
+func (b *Block) EncodePayload() ([]byte, error) {
+	payload, _, err := b.encodePayload()
+	return payload, err
+}
+
+// The payload, along with where the number is in it so Mine can try each number without encoding
+// the whole block again
+func (b *Block) encodePayload() ([]byte, int, error) {
+	encoder := NewEncoder()
+	encoder.WriteUint8(ENCODING_VERSION)
+	encoder.WriteInt64(b.CreatedAt.UnixNano())
+
+	if b.Previous != nil && b.Previous.Hash != nil {
+		encoder.WriteBool(true)
+		encoder.WriteFixedBytes(b.Previous.Hash[:])
+	} else {
+		encoder.WriteBool(false)
 	}
 
-	return &block, nil
+	numberAt := len(encoder.Bytes())
+	encoder.WriteUint64(uint64(b.Number))
+
+	encoder.WriteUint32(uint32(len(b.Data)))
+	for _, t := range b.Data {
+		if t.Signature == nil {
+			if err := t.Sign(); err != nil {
+				return nil, 0, err
+			}
+		}
+		if err := t.encodeInto(encoder); err != nil {
+			return nil, 0, err
+		}
+	}
+	return encoder.Bytes(), numberAt, nil
+}
+
+// Encode the block and its hash in the canonical binary encoding
+func (b *Block) Encode() ([]byte, error) {
+	if b.Hash == nil {
+		return nil, errors.New("Cannot encode an unmined block!")
+	}
+	payload, err := b.EncodePayload()
+	if err != nil {
+		return nil, err
+	}
+	return append(payload, b.Hash[:]...), nil
 }
 func (b *Block) Serialize() ([]byte, error) {
 	if b.Hash == nil {
@@ -118,52 +222,39 @@ func (b *Block) Serialize() ([]byte, error) {
 	return []byte(fmt.Sprintf("%s.%x", payload, *b.Hash)), nil
 }
 func (b *Block) SerializePayload() ([]byte, error) {
-	var serializedTransactions []string = []string{}
-	for _, t := range b.Data {
-		serializedBytes, err := t.Serialize()
-		if err != nil {
-			return nil, err
-		}
-		serializedTransactions = append(serializedTransactions, string(serializedBytes))
-	}
-
-	previousHash := ""
-	if b.Previous != nil {
-		unwrapped := b.Previous.Unwrap()
-		if unwrapped != nil {
-			previousHash = fmt.Sprintf("%x", *unwrapped.Hash)
-		}
-	}
-
-	result, err := json.Marshal(map[string]interface{}{
-		"created_at":    b.CreatedAt,
-		"previous_hash": previousHash,
-		"transactions":  serializedTransactions,
-		"number":        b.Number,
-	})
+	payload, err := b.EncodePayload()
 	if err != nil {
 		return nil, err
 	}
-	return []byte(base64.StdEncoding.EncodeToString(result)), nil
+	return []byte(base64.StdEncoding.EncodeToString(payload)), nil
 }
-func (b *Block) VerifyData() (bool, error) {
-	for _, t := range b.Data {
-		verified, err := t.Verify()
-		if err != nil {
-			return false, err
-		}
-		if !verified {
-			return false, nil
-		}
+
+// The number of blocks that come before this one. It's recorded when the block is added to the
+// chain, and before then it's worked out from the previous block, so it's only right once
+// ParentKnown is true.
+func (b *Block) Height() uint64 {
+	if b.heightKnown {
+		return b.height
 	}
-	return true, nil
+	if b.Previous == nil || b.Previous.Hash == nil {
+		return 0
+	}
+	if previousBlock := b.Previous.Unwrap(); previousBlock != nil {
+		return previousBlock.Height() + 1
+	}
+	return 0
+}
+
+// Whether the block before this one is in the chain, or there isn't one
+func (b *Block) ParentKnown() bool {
+	return b.Previous == nil || b.Previous.Hash == nil || b.Previous.Unwrap() != nil
 }
 func (b *Block) VerifyHash() (*BlockHash, error) {
-	serialized, err := b.SerializePayload()
+	payload, err := b.EncodePayload()
 	if err != nil {
 		return nil, err
 	}
-	hash := sha256.Sum256(serialized)
+	hash := sha256.Sum256(payload)
 	if TestHash(hash) {
 		a := BlockHash(hash)
 		return &a, nil
@@ -171,38 +262,45 @@ func (b *Block) VerifyHash() (*BlockHash, error) {
 		return nil, nil
 	}
 }
-func (b *Block) Verify() (bool, error) {
-	// Make sure transactions signatures are valid
-	ok, err := b.VerifyData()
-	if err != nil {
-		return false, err
-	}
-	if !ok {
-		return false, nil
+
+// Check a block's signatures and proof of work, saying why it's invalid with an APIError. Checks
+// that depend on the blocks before it are in Blockchain.ValidatePlacement.
+func (b *Block) Validate() error {
+	for _, t := range b.Data {
+		if ok, err := t.Verify(); err != nil || !ok {
+			return NewAPIError(ERROR_CODE_INVALID_SIGNATURE, fmt.Sprintf("Transaction %s has an invalid signature!", t.Id))
+		}
 	}
 
-	// Make sure block hash is valid
-	hash, err2 := b.VerifyHash()
-	if err2 != nil {
-		return false, err2
+	hash, err := b.VerifyHash()
+	if err != nil {
+		return NewAPIError(ERROR_CODE_INVALID_BLOCK, fmt.Sprintf("Failed to hash block! %s", err))
 	}
 	if hash == nil {
-		return false, nil
+		return NewAPIError(ERROR_CODE_INVALID_PROOF_OF_WORK, "Block hash doesn't meet the difficulty!")
 	}
-
-	return true, nil
+	if b.Hash == nil || *hash != *b.Hash {
+		return NewAPIError(ERROR_CODE_INVALID_PROOF_OF_WORK, "Block hash doesn't match its contents!")
+	}
+	return nil
 }
 func (b *Block) InvalidateHash() {
 	b.Hash = nil
 }
 func (b *Block) Mine() error {
+	payload, numberAt, err := b.encodePayload()
+	if err != nil {
+		return err
+	}
 	for n := uint(0); n < MaxUint; n += 1 {
 		if n%1000 == 0 {
 			fmt.Printf("Mine Status: %d\n", n)
 		}
-		b.Number = n
-		if hash, err := b.VerifyHash(); err == nil && hash != nil {
-			b.Hash = hash
+		binary.BigEndian.PutUint64(payload[numberAt:], uint64(n))
+		if hash := sha256.Sum256(payload); TestHash(hash) {
+			blockHash := BlockHash(hash)
+			b.Number = n
+			b.Hash = &blockHash
 			break
 		}
 	}
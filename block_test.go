@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func newTestBlock(t *testing.T, count int) *Block {
+	privateKey, err := NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var transactions []*Transaction
+	for index := 0; index < count; index += 1 {
+		transaction := NewTransaction(privateKey, 0, []byte("block test"), SystemEntropy)
+		transaction.Nonce = uint64(index)
+		if err := transaction.Sign(); err != nil {
+			t.Fatal(err)
+		}
+		transactions = append(transactions, transaction)
+	}
+	return NewBlock(nil, transactions, time.Unix(1700000000, 0))
+}
+
+// Mine patches each number into one encoding of the block, which has to hash the same as encoding
+// the block again with that number
+func TestMinePatchesNumberInPlace(t *testing.T) {
+	block := newTestBlock(t, 3)
+	payload, numberAt, err := block.encodePayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, number := range []uint{0, 1, 255, 256, 1 << 20, MaxUint} {
+		binary.BigEndian.PutUint64(payload[numberAt:], uint64(number))
+		block.Number = number
+		encoded, err := block.EncodePayload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sha256.Sum256(payload) != sha256.Sum256(encoded) {
+			t.Fatalf("Expected the patched payload for number %d to hash the same as encoding the block again!", number)
+		}
+	}
+}
+
+func TestMine(t *testing.T) {
+	block := newTestBlock(t, 2)
+	if err := block.Mine(); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := block.VerifyHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == nil || block.Hash == nil || *hash != *block.Hash {
+		t.Fatalf("Expected the mined hash to match encoding the block again, got %x and %x!", block.Hash, hash)
+	}
+	if err := block.Validate(); err != nil {
+		t.Fatalf("Expected the mined block to be valid! %s", err)
+	}
+}
+
+func TestTestHash(t *testing.T) {
+	for _, test := range []struct {
+		prefix []byte
+		valid  bool
+	}{
+		{[]byte{0x00, 0x00, 0x12}, true},
+		{[]byte{0x00, 0x00, 0xff}, true},
+		{[]byte{0x00, 0x01}, false},
+		{[]byte{0x00, 0x10}, false},
+		{[]byte{0x01, 0x00}, false},
+		{[]byte{0x10, 0x00}, false},
+	} {
+		var hash BlockHash
+		copy(hash[:], test.prefix)
+		if TestHash(hash) != test.valid {
+			t.Errorf("Expected TestHash of %x to be %t!", hash, test.valid)
+		}
+	}
+}
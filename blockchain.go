@@ -3,6 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/google/uuid"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -32,27 +35,67 @@ func (ba BlockchainAppendage) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// Visit each block in the appendage, starting at the head and moving back towards the genesis.
+// Return false from fn to stop early.
+func (ba *BlockchainAppendage) Walk(fn func(block *Block) bool) {
+	currentBlock := ba.Head
+	for currentBlock != nil {
+		if !fn(currentBlock) {
+			return
+		}
+		if currentBlock == ba.Genesis || currentBlock.Previous == nil {
+			return
+		}
+		currentBlock = currentBlock.Previous.Unwrap()
+	}
+}
+
 const BLOCKCHAIN_BTREE_DEGREE = 2
 
+// A chain is shared between the http handlers, the miner and gossip, so its appendages and its index
+// each have their own lock. They're separate since resolving a lazy block reads the index while the
+// appendages are being changed.
 type Blockchain struct {
 	Appendages []*BlockchainAppendage `json:"appendages"`
 	index      map[BlockHash]*Block
+	clock      Clock
+	// The blocks in the index with transactions from each address, in the order they were added
+	senders map[Address][]*Block
+	// The blocks in the index that include each transaction
+	transactions map[uuid.UUID][]*Block
+	// The blocks in the primary appendage by height, kept up to date as appendages change
+	primaryHeights []*Block
+
+	mu      sync.RWMutex
+	indexMu sync.RWMutex
 }
 
-func NewBlockchain() *Blockchain {
+func NewBlockchain(clock Clock) *Blockchain {
 	return &Blockchain{
-		Appendages: []*BlockchainAppendage{},
-		index:      map[BlockHash]*Block{},
+		Appendages:   []*BlockchainAppendage{},
+		index:        map[BlockHash]*Block{},
+		senders:      map[Address][]*Block{},
+		transactions: map[uuid.UUID][]*Block{},
+		clock:        clock,
 		// btree.New(func(a interface{}, b interface{}) bool {
 		//   return fmt.Sprintf("%x", a.(Block).Hash) < fmt.Sprintf("%x", b.(Block).Hash)
 		// }),
 	}
 }
+func (c *Blockchain) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"appendages": c.ListAppendages(),
+	})
+}
 func (c *Blockchain) InsertBlockAndPlaceIntoAppendage(block *Block) bool {
 	if ok := c.InsertBlock(block); !ok {
 		return false
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.updatePrimaryHeightsLocked()
+
 	// After adding the block to the index, now we need to figure out how it fits into the broader
 	// chain.
 
@@ -71,7 +114,7 @@ func (c *Blockchain) InsertBlockAndPlaceIntoAppendage(block *Block) bool {
 					fmt.Printf("Existing appendage will fit block %x\n", block.Hash)
 					appendage.Head = block
 					appendage.Length += 1
-					appendage.UpdatedAt = time.Now().UTC()
+					appendage.UpdatedAt = c.clock.Now()
 					return true
 				}
 			}
@@ -96,7 +139,7 @@ func (c *Blockchain) InsertBlockAndPlaceIntoAppendage(block *Block) bool {
 							Genesis:   appendage.Genesis,
 							Head:      block,
 							Length:    appendage.Length - depth,
-							UpdatedAt: time.Now().UTC(),
+							UpdatedAt: c.clock.Now(),
 						})
 						return true
 					}
@@ -116,21 +159,158 @@ func (c *Blockchain) InsertBlockAndPlaceIntoAppendage(block *Block) bool {
 		Genesis:   block,
 		Head:      block,
 		Length:    1,
-		UpdatedAt: time.Now().UTC(),
+		UpdatedAt: c.clock.Now(),
 	})
 	return true
 }
+
+// Add a block to the index, returning false if it's already there or its previous block isn't
 func (c *Blockchain) InsertBlock(block *Block) bool {
 	if block.Hash == nil {
 		return false
 	}
+	c.indexMu.Lock()
+	defer c.indexMu.Unlock()
 	if _, ok := c.index[*block.Hash]; ok {
 		return false
 	}
+
+	height := uint64(0)
+	if block.Previous != nil && block.Previous.Hash != nil {
+		previousBlock, ok := c.index[*block.Previous.Hash]
+		if !ok {
+			return false
+		}
+		height = previousBlock.height + 1
+	}
+	block.height = height
+	block.heightKnown = true
 	c.index[*block.Hash] = block
+
+	indexed := map[Address]bool{}
+	for _, t := range block.Data {
+		c.transactions[t.Id] = append(c.transactions[t.Id], block)
+		if t.SenderPublicKey == nil {
+			continue
+		}
+		address := t.SenderPublicKey.Address()
+		if !indexed[address] {
+			c.senders[address] = append(c.senders[address], block)
+			indexed[address] = true
+		}
+	}
 	return true
 }
+
+// Time locks are checked against the time a block says it was created, which the miner picks, so it
+// has to be after the median time of the blocks before it, and can't be far ahead of this node's clock
+const BLOCK_MEDIAN_TIME_SPAN = 11
+const BLOCK_MAX_FUTURE_DRIFT = 2 * time.Minute
+
+// The median of when parent and the blocks before it were created, which a block on top of parent
+// has to be created after
+func (c *Blockchain) MedianTimeAfter(parent *Block) time.Time {
+	var times []time.Time
+	for currentBlock := parent; currentBlock != nil && len(times) < BLOCK_MEDIAN_TIME_SPAN; {
+		times = append(times, currentBlock.CreatedAt)
+		if currentBlock.Previous == nil {
+			break
+		}
+		currentBlock = currentBlock.Previous.Unwrap()
+	}
+	if len(times) == 0 {
+		return time.Time{}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times[len(times)/2]
+}
+
+// Check the parts of a block that depend on the blocks before it, which have to be in the chain
+func (c *Blockchain) ValidatePlacement(block *Block) error {
+	if !block.ParentKnown() {
+		return NewAPIError(ERROR_CODE_INVALID_BLOCK, "Block's previous block isn't known!")
+	}
+	var parent *Block
+	if block.Previous != nil {
+		parent = block.Previous.Unwrap()
+	}
+
+	if parent != nil && !block.CreatedAt.After(c.MedianTimeAfter(parent)) {
+		return NewAPIError(ERROR_CODE_INVALID_BLOCK, "Block was created before the median time of the blocks before it!")
+	}
+	if block.CreatedAt.After(c.clock.Now().Add(BLOCK_MAX_FUTURE_DRIFT)) {
+		return NewAPIError(ERROR_CODE_INVALID_BLOCK, "Block was created too far in the future!")
+	}
+
+	height := block.Height()
+	nonces := map[Address]uint64{}
+	for _, t := range block.Data {
+		if t.LockStatus(height, block.CreatedAt) != TRANSACTION_LOCK_VALID {
+			return NewAPIError(ERROR_CODE_INVALID_BLOCK, fmt.Sprintf("Transaction %s can't be included in a block at height %d!", t.Id, height))
+		}
+
+		// Each address's transactions have to be numbered one after another
+		address := t.SenderPublicKey.Address()
+		expected, ok := nonces[address]
+		if !ok {
+			expected = c.NonceAfter(parent, address)
+		}
+		if t.Nonce != expected {
+			return NewAPIError(ERROR_CODE_INVALID_BLOCK, fmt.Sprintf("Transaction %s has nonce %d, but should have %d!", t.Id, t.Nonce, expected))
+		}
+		nonces[address] = expected + 1
+	}
+	return nil
+}
+
+// How many transactions an address sent in parent and the blocks before it, which is the nonce its
+// next transaction on top of parent has to have
+func (c *Blockchain) NonceAfter(parent *Block, address Address) uint64 {
+	if parent == nil {
+		return 0
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	// Collect the blocks from parent back to where its branch meets the primary appendage
+	branch := map[*Block]bool{}
+	fork := parent
+	for fork != nil {
+		height := fork.Height()
+		if height < uint64(len(c.primaryHeights)) && c.primaryHeights[height] == fork {
+			break
+		}
+		branch[fork] = true
+		if fork.Previous == nil {
+			fork = nil
+			break
+		}
+		fork = fork.Previous.Unwrap()
+	}
+
+	c.indexMu.RLock()
+	blocks := c.senders[address]
+	c.indexMu.RUnlock()
+
+	nonce := uint64(0)
+	for _, block := range blocks {
+		if !branch[block] {
+			height := block.Height()
+			if fork == nil || height > fork.Height() || c.primaryHeights[height] != block {
+				continue
+			}
+		}
+		for _, t := range block.Data {
+			if t.SenderPublicKey != nil && t.SenderPublicKey.Address() == address {
+				nonce += 1
+			}
+		}
+	}
+	return nonce
+}
 func (c *Blockchain) GetBlockWithHash(hash BlockHash) *Block {
+	c.indexMu.RLock()
+	defer c.indexMu.RUnlock()
 	block, ok := c.index[hash]
 	if ok {
 		return block
@@ -138,7 +318,60 @@ func (c *Blockchain) GetBlockWithHash(hash BlockHash) *Block {
 		return nil
 	}
 }
-func (c *Blockchain) longestAppendageLength() uint {
+
+// Add an appendage whose blocks have already been inserted, ie when syncing from a peer
+func (c *Blockchain) AddAppendage(appendage *BlockchainAppendage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Appendages = append(c.Appendages, appendage)
+	c.updatePrimaryHeightsLocked()
+}
+
+// Bring the height index in line with the primary appendage. Only the blocks above where the new
+// primary appendage meets the old one are visited.
+func (c *Blockchain) updatePrimaryHeightsLocked() {
+	primaryAppendage := c.primaryAppendageLocked()
+	if primaryAppendage == nil || primaryAppendage.Head == nil {
+		c.primaryHeights = nil
+		return
+	}
+
+	head := primaryAppendage.Head
+	length := int(head.Height()) + 1
+	if len(c.primaryHeights) > length {
+		c.primaryHeights = c.primaryHeights[:length]
+	}
+	for len(c.primaryHeights) < length {
+		c.primaryHeights = append(c.primaryHeights, nil)
+	}
+
+	currentBlock := head
+	for currentBlock != nil {
+		height := currentBlock.Height()
+		if c.primaryHeights[height] == currentBlock {
+			break
+		}
+		c.primaryHeights[height] = currentBlock
+		if currentBlock.Previous == nil {
+			break
+		}
+		currentBlock = currentBlock.Previous.Unwrap()
+	}
+}
+
+// Appendages are changed in place as blocks are added, so this returns copies that are safe to read
+// while the chain keeps changing
+func (c *Blockchain) ListAppendages() []*BlockchainAppendage {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	appendages := make([]*BlockchainAppendage, 0, len(c.Appendages))
+	for _, appendage := range c.Appendages {
+		copied := *appendage
+		appendages = append(appendages, &copied)
+	}
+	return appendages
+}
+func (c *Blockchain) longestAppendageLengthLocked() uint {
 	length := uint(0)
 	for _, appendage := range c.Appendages {
 		if appendage.Length > length {
@@ -148,7 +381,17 @@ func (c *Blockchain) longestAppendageLength() uint {
 	return length
 }
 func (c *Blockchain) LongestAppendages() []*BlockchainAppendage {
-	length := c.longestAppendageLength()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var appendages []*BlockchainAppendage
+	for _, appendage := range c.longestAppendagesLocked() {
+		copied := *appendage
+		appendages = append(appendages, &copied)
+	}
+	return appendages
+}
+func (c *Blockchain) longestAppendagesLocked() []*BlockchainAppendage {
+	length := c.longestAppendageLengthLocked()
 
 	var matchingAppendages []*BlockchainAppendage
 	for _, appendage := range c.Appendages {
@@ -159,9 +402,22 @@ func (c *Blockchain) LongestAppendages() []*BlockchainAppendage {
 
 	return matchingAppendages
 }
+
+// Like ListAppendages, the appendage returned is a copy
 func (c *Blockchain) PrimaryAppendage() *BlockchainAppendage {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	primaryAppendage := c.primaryAppendageLocked()
+	if primaryAppendage == nil {
+		return nil
+	}
+	copied := *primaryAppendage
+	return &copied
+}
+func (c *Blockchain) primaryAppendageLocked() *BlockchainAppendage {
+
 	// Primarily filter based on the appendage that is longest
-	appendages := c.LongestAppendages()
+	appendages := c.longestAppendagesLocked()
 	if len(appendages) == 0 {
 		return nil
 	}
@@ -195,6 +451,9 @@ func (c *Blockchain) PrimaryAppendage() *BlockchainAppendage {
 	return matchingAppendages[0]
 }
 func (c *Blockchain) CullAppendagesShorterThan(minimumLength uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	// This is a goofy way in golang to modify a slice in place
 	// ref: https://zetcode.com/golang/filter-slice/
 	index := 0
@@ -205,4 +464,23 @@ func (c *Blockchain) CullAppendagesShorterThan(minimumLength uint) {
 		}
 	}
 	c.Appendages = c.Appendages[:index]
+	c.updatePrimaryHeightsLocked()
+}
+
+// The height the next block mined on top of the primary appendage will have
+func (c *Blockchain) NextHeight() uint64 {
+	primaryAppendage := c.PrimaryAppendage()
+	if primaryAppendage == nil || primaryAppendage.Head == nil {
+		return 0
+	}
+	return primaryAppendage.Head.Height() + 1
+}
+
+// How many transactions an address has sent in the primary appendage
+func (c *Blockchain) CountTransactionsFrom(address Address) uint64 {
+	primaryAppendage := c.PrimaryAppendage()
+	if primaryAppendage == nil {
+		return 0
+	}
+	return c.NonceAfter(primaryAppendage.Head, address)
 }
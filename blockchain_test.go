@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var testChainStart = time.Unix(1700000000, 0)
+
+// Add a block created at the given time on top of previous, with a made up hash since placement
+// doesn't check proof of work
+func addTestBlock(t *testing.T, chain *Blockchain, previous *Block, data []*Transaction, createdAt time.Time) *Block {
+	block := newTestPlacementBlock(chain, previous, data, createdAt)
+	if !chain.InsertBlockAndPlaceIntoAppendage(block) {
+		t.Fatalf("Failed to add block created at %s!", createdAt)
+	}
+	return block
+}
+func newTestPlacementBlock(chain *Blockchain, previous *Block, data []*Transaction, createdAt time.Time) *Block {
+	var lazyPrevious *LazyBlock
+	if previous != nil {
+		lazyPrevious = NewLazyBlock(chain, previous)
+	}
+	block := NewBlock(lazyPrevious, data, createdAt)
+	hash := BlockHash(sha256.Sum256([]byte(fmt.Sprintf("placement test block %p", block))))
+	block.Hash = &hash
+	return block
+}
+
+// Blocks created a second apart, the last one created at testChainStart
+func newTestChain(t *testing.T, count int) (*Blockchain, *Block) {
+	chain := NewBlockchain(NewManualClock(testChainStart))
+	var head *Block
+	for index := 0; index < count; index += 1 {
+		head = addTestBlock(t, chain, head, []*Transaction{}, testChainStart.Add(time.Duration(index-count+1)*time.Second))
+	}
+	return chain, head
+}
+
+func TestValidatePlacementAfterMedianTime(t *testing.T) {
+	chain, head := newTestChain(t, BLOCK_MEDIAN_TIME_SPAN+5)
+	median := testChainStart.Add(-time.Duration(BLOCK_MEDIAN_TIME_SPAN/2) * time.Second)
+	if got := chain.MedianTimeAfter(head); !got.Equal(median) {
+		t.Fatalf("Expected a median time of %s, got %s!", median, got)
+	}
+
+	for _, test := range []struct {
+		createdAt time.Time
+		valid     bool
+	}{
+		{median.Add(-time.Hour), false},
+		{median, false},
+		{median.Add(time.Nanosecond), true},
+		// Blocks can be created before their previous block, as long as it's after the median
+		{testChainStart.Add(-time.Second), true},
+		{testChainStart.Add(time.Second), true},
+	} {
+		block := newTestPlacementBlock(chain, head, []*Transaction{}, test.createdAt)
+		if err := chain.ValidatePlacement(block); (err == nil) != test.valid {
+			t.Errorf("Expected a block created at %s to be valid: %t, got %v!", test.createdAt, test.valid, err)
+		}
+	}
+
+	// With only one block before it, a block has to be created after that one
+	chain, head = newTestChain(t, 1)
+	if err := chain.ValidatePlacement(newTestPlacementBlock(chain, head, []*Transaction{}, testChainStart)); err == nil {
+		t.Errorf("Expected a block created at the same time as its only previous block to be invalid!")
+	}
+}
+
+func TestValidatePlacementFutureDrift(t *testing.T) {
+	chain, head := newTestChain(t, 3)
+	for _, test := range []struct {
+		createdAt time.Time
+		valid     bool
+	}{
+		{testChainStart.Add(BLOCK_MAX_FUTURE_DRIFT), true},
+		{testChainStart.Add(BLOCK_MAX_FUTURE_DRIFT + time.Second), false},
+		{testChainStart.Add(24 * time.Hour), false},
+	} {
+		block := newTestPlacementBlock(chain, head, []*Transaction{}, test.createdAt)
+		if err := chain.ValidatePlacement(block); (err == nil) != test.valid {
+			t.Errorf("Expected a block created at %s to be valid: %t, got %v!", test.createdAt, test.valid, err)
+		}
+	}
+
+	// The same block is valid once the clock catches up
+	block := newTestPlacementBlock(chain, head, []*Transaction{}, testChainStart.Add(time.Hour))
+	chain.clock.(*ManualClock).Advance(time.Hour)
+	if err := chain.ValidatePlacement(block); err != nil {
+		t.Errorf("Expected a block created at the current time to be valid! %s", err)
+	}
+}
+
+// A miner can't date a block from before a transaction expired, or after it becomes valid, to
+// include it anyway
+func TestValidatePlacementTimeLocks(t *testing.T) {
+	chain, head := newTestChain(t, BLOCK_MEDIAN_TIME_SPAN)
+	privateKey, err := NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := NewTransaction(privateKey, 0, []byte("expired"), SystemEntropy)
+	expired.ValidUntil = uint64(testChainStart.Add(-time.Hour).Unix())
+	locked := NewTransaction(privateKey, 0, []byte("locked"), SystemEntropy)
+	locked.ValidAfter = uint64(testChainStart.Add(time.Hour).Unix())
+	for _, transaction := range []*Transaction{expired, locked} {
+		if err := transaction.Sign(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		transaction *Transaction
+		createdAt   time.Time
+	}{
+		{expired, testChainStart},
+		{expired, testChainStart.Add(-2 * time.Hour)},
+		{locked, testChainStart},
+		{locked, testChainStart.Add(2 * time.Hour)},
+	} {
+		block := newTestPlacementBlock(chain, head, []*Transaction{test.transaction}, test.createdAt)
+		if err := chain.ValidatePlacement(block); err == nil {
+			t.Errorf("Expected a block created at %s with transaction %s to be invalid!", test.createdAt, test.transaction.Data)
+		}
+	}
+}
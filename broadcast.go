@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Messages to other peers are sent from a queue per peer, each with its own worker, so that a slow
+// or offline peer can't hold up the http handlers, the miner, or messages to any other peer.
+const PEER_QUEUE_DEPTH = 64
+const PEER_SEND_MAX_ATTEMPTS = 3
+const PEER_SEND_RETRY_BACKOFF = 500 * time.Millisecond
+
+// A peer's worker exits once its queue has been empty for this long, and is started again the next
+// time there is something to send
+const PEER_QUEUE_IDLE_TIMEOUT = time.Minute
+
+type outboundMessage struct {
+	// Describes the message in logs, ie "block 0000abcd..."
+	description string
+	send        func(peer Peer) error
+}
+
+type BroadcastMetrics struct {
+	Queued  uint64         `json:"queued"`
+	Sent    uint64         `json:"sent"`
+	Retried uint64         `json:"retried"`
+	Failed  uint64         `json:"failed"`
+	Dropped uint64         `json:"dropped"`
+	Depths  map[PeerId]int `json:"depths"`
+}
+
+type Broadcaster struct {
+	peerSet *PeerSet
+
+	mu     sync.Mutex
+	queues map[PeerId]chan outboundMessage
+
+	queued  uint64
+	sent    uint64
+	retried uint64
+	failed  uint64
+	dropped uint64
+}
+
+func NewBroadcaster(peerSet *PeerSet) *Broadcaster {
+	return &Broadcaster{
+		peerSet: peerSet,
+		queues:  map[PeerId]chan outboundMessage{},
+	}
+}
+
+// Queue a message to be sent to a peer. If the peer's queue is full, the message is dropped and false
+// is returned.
+func (b *Broadcaster) Send(peer Peer, description string, send func(peer Peer) error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	queue, ok := b.queues[peer.Id]
+	if !ok {
+		queue = make(chan outboundMessage, PEER_QUEUE_DEPTH)
+		b.queues[peer.Id] = queue
+		go b.work(peer, queue)
+	}
+
+	select {
+	case queue <- outboundMessage{description: description, send: send}:
+		atomic.AddUint64(&b.queued, 1)
+		return true
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+		fmt.Printf("Queue for peer %s is full, dropping %s\n", uuid.UUID(peer.Id).String(), description)
+		return false
+	}
+}
+
+func (b *Broadcaster) work(peer Peer, queue chan outboundMessage) {
+	idle := time.NewTimer(PEER_QUEUE_IDLE_TIMEOUT)
+	defer idle.Stop()
+
+	for {
+		select {
+		case message := <-queue:
+			b.deliver(peer, message)
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(PEER_QUEUE_IDLE_TIMEOUT)
+
+		case <-idle.C:
+			// Messages are only queued while holding the lock, so once the queue is confirmed empty
+			// here nothing else can end up in it
+			b.mu.Lock()
+			if len(queue) > 0 {
+				b.mu.Unlock()
+				idle.Reset(PEER_QUEUE_IDLE_TIMEOUT)
+				continue
+			}
+			delete(b.queues, peer.Id)
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Send a message to a peer, retrying with exponential backoff if the peer couldn't be reached or had
+// a server error. Once out of attempts, the peer is penalized.
+func (b *Broadcaster) deliver(peer Peer, message outboundMessage) {
+	backoff := PEER_SEND_RETRY_BACKOFF
+	offense := PEER_OFFENSE_TIMEOUT
+
+	for attempt := 1; attempt <= PEER_SEND_MAX_ATTEMPTS; attempt += 1 {
+		// The peer may have been removed while the message was waiting in the queue
+		if !b.peerSet.Has(peer.Id) {
+			atomic.AddUint64(&b.dropped, 1)
+			return
+		}
+
+		if attempt > 1 {
+			atomic.AddUint64(&b.retried, 1)
+		}
+
+		err := message.send(peer)
+		// The peer already having what was sent is as good as it being delivered
+		if code, ok := PeerErrorCode(err); err == nil || (ok && code == ERROR_CODE_DUPLICATE) {
+			atomic.AddUint64(&b.sent, 1)
+			return
+		}
+		fmt.Printf("Failed to send %s to peer %s (attempt %d of %d)! %s\n", message.description, uuid.UUID(peer.Id).String(), attempt, PEER_SEND_MAX_ATTEMPTS, err)
+		// The peer got the message and turned it down, so there's no point sending it again, but the
+		// peer didn't do anything wrong either
+		if IsPeerRejection(err) {
+			atomic.AddUint64(&b.failed, 1)
+			return
+		}
+		if !IsRetryablePeerError(err) {
+			offense = PEER_OFFENSE_MALFORMED_RESPONSE
+			break
+		}
+
+		if attempt < PEER_SEND_MAX_ATTEMPTS {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	atomic.AddUint64(&b.failed, 1)
+	b.peerSet.Penalize(peer.Id, offense)
+}
+
+func (b *Broadcaster) Metrics() BroadcastMetrics {
+	b.mu.Lock()
+	depths := map[PeerId]int{}
+	for id, queue := range b.queues {
+		depths[id] = len(queue)
+	}
+	b.mu.Unlock()
+
+	return BroadcastMetrics{
+		Queued:  atomic.LoadUint64(&b.queued),
+		Sent:    atomic.LoadUint64(&b.sent),
+		Retried: atomic.LoadUint64(&b.retried),
+		Failed:  atomic.LoadUint64(&b.failed),
+		Dropped: atomic.LoadUint64(&b.dropped),
+		Depths:  depths,
+	}
+}
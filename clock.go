@@ -0,0 +1,146 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"github.com/google/uuid"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Anything that depends on the current time or on randomness gets it from a Clock or an Entropy
+// rather than calling time.Now or the global random sources directly, so that a simulation can swap
+// in a clock it controls and seeded randomness to replay the exact same scenario.
+type Clock interface {
+	Now() time.Time
+	// Wait until the clock has moved forward by d
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now().UTC()
+}
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+var SystemClock Clock = systemClock{}
+
+// A clock that only moves when told to
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+	// Sleepers waiting for the clock to reach a time
+	sleepers []manualClockSleeper
+}
+
+type manualClockSleeper struct {
+	until time.Time
+	wake  chan struct{}
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start.UTC()}
+}
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+func (c *ManualClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	if d <= 0 {
+		c.mu.Unlock()
+		return
+	}
+	wake := make(chan struct{})
+	c.sleepers = append(c.sleepers, manualClockSleeper{until: c.now.Add(d), wake: wake})
+	c.mu.Unlock()
+	<-wake
+}
+
+// Move the clock forward, waking anything sleeping until then
+func (c *ManualClock) Advance(by time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(by)
+
+	var sleepers []manualClockSleeper
+	for _, sleeper := range c.sleepers {
+		if c.now.Before(sleeper.until) {
+			sleepers = append(sleepers, sleeper)
+		} else {
+			close(sleeper.wake)
+		}
+	}
+	c.sleepers = sleepers
+}
+
+// A source of randomness, for both random bytes (ie, ids and challenges) and random choices (ie, which
+// peers to gossip to). Safe to share between goroutines.
+//
+// Note that keys are always generated from crypto/rand, since they have to be secret, so peer ids
+// still differ between runs.
+type Entropy struct {
+	mu     sync.Mutex
+	bytes  func(p []byte) (int, error)
+	random *rand.Rand
+}
+
+// Entropy from the operating system, for real nodes
+func NewSystemEntropy() *Entropy {
+	var seed [8]byte
+	if _, err := cryptorand.Read(seed[:]); err != nil {
+		panic(err)
+	}
+	return &Entropy{
+		bytes:  cryptorand.Read,
+		random: rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:])))),
+	}
+}
+
+// Entropy that produces the same sequence every time for the same seed. Not suitable for anything
+// that has to be unguessable!
+func NewSeededEntropy(seed int64) *Entropy {
+	random := rand.New(rand.NewSource(seed))
+	return &Entropy{bytes: random.Read, random: random}
+}
+
+var SystemEntropy = NewSystemEntropy()
+
+func (e *Entropy) Read(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.bytes(p)
+}
+func (e *Entropy) NewUUID() uuid.UUID {
+	return uuid.Must(uuid.NewRandomFromReader(e))
+}
+func (e *Entropy) Float64() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.random.Float64()
+}
+func (e *Entropy) ExpFloat64() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.random.ExpFloat64()
+}
+func (e *Entropy) Intn(n int) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.random.Intn(n)
+}
+func (e *Entropy) Int63n(n int64) int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.random.Int63n(n)
+}
+func (e *Entropy) Shuffle(n int, swap func(i, j int)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.random.Shuffle(n, swap)
+}
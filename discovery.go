@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Peers that share the addresses of peers they've recently talked to, see the README
+const FEATURE_ADDRESS_EXCHANGE = "address-exchange"
+
+// How often to ask a random peer for the addresses it knows about
+const PEER_ADDRESS_EXCHANGE_INTERVAL = time.Minute
+
+// Only peers seen within this long are shared with others
+const PEER_ADDRESS_MAX_AGE = 3 * time.Hour
+const PEER_ADDRESS_EXCHANGE_LIMIT = 32
+
+// Addresses from the address book to try each refresh, when short of peers
+const PEER_ADDRESS_BOOK_ATTEMPTS = 8
+
+// Most addresses heard about from other peers to keep, in total and from any one peer
+const PEER_ADDRESS_BOOK_MAX_LEARNED = 1000
+const PEER_ADDRESS_BOOK_MAX_LEARNED_PER_SOURCE = 100
+
+// A peer address as shared between nodes, along with when the sharing node last talked to it
+type PeerAddress struct {
+	Peer     Peer      `json:"peer"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Resolves hostnames to ips. Nodes look up DNS seeds with the system resolver, but anything else
+// (ie, StaticResolver) can stand in for it.
+type Resolver interface {
+	LookupHost(host string) ([]string, error)
+}
+
+type systemResolver struct{}
+
+func (systemResolver) LookupHost(host string) ([]string, error) {
+	return net.LookupHost(host)
+}
+
+var SystemResolver Resolver = systemResolver{}
+
+// A resolver that answers from a fixed map of hostnames to ips
+type StaticResolver map[string][]string
+
+func (r StaticResolver) LookupHost(host string) ([]string, error) {
+	hosts, ok := r[host]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("No such host %s", host))
+	}
+	return hosts, nil
+}
+
+// Read a bootstrap file, which lists one peer address per line. Blank lines and lines starting with
+// # are skipped.
+func ReadBootstrapFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var addresses []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addresses = append(addresses, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// Resolve a DNS seed, given as an address (ie, http://seed.example.com:4000), into the address of
+// every node it points to. The scheme and port of the seed are kept for each node.
+func ResolveSeed(resolver Resolver, seed string) ([]string, error) {
+	seedUrl, err := url.Parse(seed)
+	if err != nil {
+		return nil, err
+	}
+	if len(seedUrl.Hostname()) == 0 {
+		return nil, errors.New(fmt.Sprintf("DNS seed %s has no hostname!", seed))
+	}
+
+	hosts, err := resolver.LookupHost(seedUrl.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, host := range hosts {
+		address := *seedUrl
+		if len(seedUrl.Port()) > 0 {
+			address.Host = net.JoinHostPort(host, seedUrl.Port())
+		} else if strings.Contains(host, ":") {
+			// Bare ipv6 addresses need brackets to go in a url
+			address.Host = "[" + host + "]"
+		} else {
+			address.Host = host
+		}
+		addresses = append(addresses, address.String())
+	}
+	return addresses, nil
+}
+
+// Addresses of recently seen peers that are worth sharing with others. Only peers this node has
+// talked to itself are shared, not ones it has only heard about.
+func (ps *PeerSet) Addresses() []PeerAddress {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := ps.clock.Now()
+	addresses := []PeerAddress{}
+	for id, record := range ps.records {
+		if id == ps.Me.Id || record.Learned || ps.untrustedLocked(id) {
+			continue
+		}
+		if now.Sub(record.LastSeen) > PEER_ADDRESS_MAX_AGE {
+			continue
+		}
+		// Active peers that have been misbehaving aren't worth recommending
+		if rank, ok := ps.rankings[id]; ok && rank < NODE_DEFAULT_PEER_RANKING/2 {
+			continue
+		}
+		addresses = append(addresses, PeerAddress{Peer: record.Peer, LastSeen: record.LastSeen})
+	}
+
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i].LastSeen.After(addresses[j].LastSeen)
+	})
+	if len(addresses) > PEER_ADDRESS_EXCHANGE_LIMIT {
+		addresses = addresses[:PEER_ADDRESS_EXCHANGE_LIMIT]
+	}
+	return addresses
+}
+
+// Add addresses shared by another peer to the address book, so they can be tried later. Returns the
+// number of addresses that were new.
+func (ps *PeerSet) LearnAddresses(from PeerId, addresses []PeerAddress) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := ps.clock.Now()
+	learned := 0
+
+	// Count what's already been learned, so one peer can't fill the address book by itself
+	total := 0
+	fromSource := 0
+	for _, record := range ps.records {
+		if record.Learned {
+			total += 1
+			if record.LearnedFrom != nil && *record.LearnedFrom == from {
+				fromSource += 1
+			}
+		}
+	}
+	for index, address := range addresses {
+		if index >= PEER_ADDRESS_EXCHANGE_LIMIT {
+			break
+		}
+		id := address.Peer.Id
+		if id == ps.Me.Id || ps.untrustedLocked(id) || len(address.Peer.Address) == 0 {
+			continue
+		}
+
+		// Timestamps come from the other peer, so don't believe any from the future
+		lastSeen := address.LastSeen
+		if lastSeen.After(now) {
+			lastSeen = now
+		}
+		if now.Sub(lastSeen) > PEER_ADDRESS_MAX_AGE {
+			continue
+		}
+
+		if _, ok := ps.records[id]; ok {
+			continue
+		}
+		if fromSource >= PEER_ADDRESS_BOOK_MAX_LEARNED_PER_SOURCE {
+			break
+		}
+		if total >= PEER_ADDRESS_BOOK_MAX_LEARNED {
+			if !ps.evictOldestLearnedLocked() {
+				break
+			}
+			total -= 1
+		}
+		ps.records[id] = &PeerRecord{
+			Peer:        Peer{Id: id, Address: address.Peer.Address},
+			FirstSeen:   now,
+			LastSeen:    lastSeen,
+			RankHistory: []PeerRankSample{},
+			Learned:     true,
+			LearnedFrom: &from,
+		}
+		learned += 1
+		total += 1
+		fromSource += 1
+	}
+	return learned
+}
+
+// Forget the address that was learned the longest ago, returning false if there aren't any
+func (ps *PeerSet) evictOldestLearnedLocked() bool {
+	var oldest *PeerRecord
+	for _, record := range ps.records {
+		if record.Learned && (oldest == nil || record.FirstSeen.Before(oldest.FirstSeen)) {
+			oldest = record
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(ps.records, oldest.Peer.Id)
+	return true
+}
+
+// Peers from the address book that aren't currently peers, most recently seen first
+func (ps *PeerSet) candidatePeers(limit int, except map[PeerId]bool) []Peer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var records []*PeerRecord
+	for id, record := range ps.records {
+		if id == ps.Me.Id || ps.hasLocked(id) || ps.untrustedLocked(id) || except[id] {
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+
+	var peers []Peer
+	for index, record := range records {
+		if index >= limit {
+			break
+		}
+		peers = append(peers, record.Peer)
+	}
+	return peers
+}
+
+// Forget an address that was heard about from another peer, once it turns out to be no good.
+// Addresses of peers this node has talked to itself are kept, since they may only be offline for now.
+func (ps *PeerSet) forgetLearned(id PeerId) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if record, ok := ps.records[id]; ok && record.Learned {
+		delete(ps.records, id)
+	}
+}
+
+// Try peers from the address book, other than those in except, until the outbound slots are full
+func (ps *PeerSet) connectFromAddressBook(except map[PeerId]bool) {
+	for _, candidate := range ps.candidatePeers(PEER_ADDRESS_BOOK_ATTEMPTS, except) {
+		if !ps.HasSlot(PEER_DIRECTION_OUTBOUND) {
+			return
+		}
+		info, _, err := ps.fetchPeerInfo(candidate.Address)
+		if err != nil {
+			fmt.Printf("Failed to reach peer %s from the address book! %s\n", uuid.UUID(candidate.Id).String(), err)
+			ps.forgetLearned(candidate.Id)
+			continue
+		}
+		if info.Peer.Id != candidate.Id {
+			fmt.Printf("Peer at %s from the address book actually has id %s, rejecting...\n", candidate.Address, uuid.UUID(info.Peer.Id).String())
+			ps.forgetLearned(candidate.Id)
+			continue
+		}
+		ps.Insert(info.Peer, info.Handshake, PEER_DIRECTION_OUTBOUND)
+	}
+}
+
+// Ask a random peer that supports it for the addresses it knows about, at most once per
+// PEER_ADDRESS_EXCHANGE_INTERVAL
+func (ps *PeerSet) ExchangeAddresses() {
+	ps.mu.Lock()
+	now := ps.clock.Now()
+	if !ps.lastExchange.IsZero() && now.Sub(ps.lastExchange) < PEER_ADDRESS_EXCHANGE_INTERVAL {
+		ps.mu.Unlock()
+		return
+	}
+	ps.lastExchange = now
+
+	var candidates []Peer
+	for _, peer := range ps.listOthersLocked() {
+		if handshake, ok := ps.handshakes[peer.Id]; ok && handshake.Supports(FEATURE_ADDRESS_EXCHANGE) {
+			candidates = append(candidates, peer)
+		}
+	}
+	ps.mu.Unlock()
+
+	if len(candidates) == 0 {
+		return
+	}
+	peer := candidates[ps.entropy.Intn(len(candidates))]
+	addresses, err := ps.transport.GetAddresses(peer.Address)
+	if err != nil {
+		fmt.Printf("Failed to exchange addresses with peer %s! %s\n", uuid.UUID(peer.Id).String(), err)
+		if offense, ok := OffenseOfPeerError(err); ok {
+			ps.Penalize(peer.Id, offense)
+		}
+		return
+	}
+	if learned := ps.LearnAddresses(peer.Id, addresses); learned > 0 {
+		fmt.Printf("Learned %d new address(es) from peer %s\n", learned, uuid.UUID(peer.Id).String())
+	}
+}
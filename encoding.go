@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The canonical binary encoding is what gets hashed and signed, so it has to stay byte-for-byte
+// stable across versions of this program. Every integer is fixed width and big endian, and every
+// variable length field is prefixed with its length as a uint32. Bump the version whenever the
+// layout changes so that old payloads can still be told apart from new ones.
+const ENCODING_VERSION = uint8(1)
+
+type Encoder struct {
+	buffer bytes.Buffer
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+func (e *Encoder) WriteUint8(value uint8) {
+	e.buffer.WriteByte(value)
+}
+func (e *Encoder) WriteUint32(value uint32) {
+	var byt [4]byte
+	binary.BigEndian.PutUint32(byt[:], value)
+	e.buffer.Write(byt[:])
+}
+func (e *Encoder) WriteUint64(value uint64) {
+	var byt [8]byte
+	binary.BigEndian.PutUint64(byt[:], value)
+	e.buffer.Write(byt[:])
+}
+func (e *Encoder) WriteInt64(value int64) {
+	e.WriteUint64(uint64(value))
+}
+func (e *Encoder) WriteBool(value bool) {
+	if value {
+		e.WriteUint8(1)
+	} else {
+		e.WriteUint8(0)
+	}
+}
+
+// Write bytes with a known, fixed length, such as a hash
+func (e *Encoder) WriteFixedBytes(value []byte) {
+	e.buffer.Write(value)
+}
+
+// Write bytes with a length prefix
+func (e *Encoder) WriteBytes(value []byte) {
+	e.WriteUint32(uint32(len(value)))
+	e.buffer.Write(value)
+}
+func (e *Encoder) Bytes() []byte {
+	return e.buffer.Bytes()
+}
+
+type Decoder struct {
+	data   []byte
+	offset int
+}
+
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{data: data, offset: 0}
+}
+func (d *Decoder) take(length int) ([]byte, error) {
+	if length < 0 || d.offset+length > len(d.data) {
+		return nil, errors.New(fmt.Sprintf("Unexpected end of data at offset %d while decoding!", d.offset))
+	}
+	byt := d.data[d.offset : d.offset+length]
+	d.offset += length
+	return byt, nil
+}
+func (d *Decoder) ReadUint8() (uint8, error) {
+	byt, err := d.take(1)
+	if err != nil {
+		return 0, err
+	}
+	return byt[0], nil
+}
+func (d *Decoder) ReadUint32() (uint32, error) {
+	byt, err := d.take(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(byt), nil
+}
+func (d *Decoder) ReadUint64() (uint64, error) {
+	byt, err := d.take(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(byt), nil
+}
+func (d *Decoder) ReadInt64() (int64, error) {
+	value, err := d.ReadUint64()
+	return int64(value), err
+}
+func (d *Decoder) ReadBool() (bool, error) {
+	value, err := d.ReadUint8()
+	if err != nil {
+		return false, err
+	}
+	switch value {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	default:
+		return false, errors.New(fmt.Sprintf("Invalid boolean value %d at offset %d while decoding!", value, d.offset-1))
+	}
+}
+func (d *Decoder) ReadFixedBytes(length int) ([]byte, error) {
+	byt, err := d.take(length)
+	if err != nil {
+		return nil, err
+	}
+	// Copy so that the result doesn't alias the buffer being decoded
+	result := make([]byte, length)
+	copy(result, byt)
+	return result, nil
+}
+func (d *Decoder) ReadBytes() ([]byte, error) {
+	length, err := d.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	if int(length) > len(d.data)-d.offset {
+		return nil, errors.New(fmt.Sprintf("Length prefix %d at offset %d is longer than the remaining data!", length, d.offset-4))
+	}
+	return d.ReadFixedBytes(int(length))
+}
+func (d *Decoder) ReadVersion() error {
+	version, err := d.ReadUint8()
+	if err != nil {
+		return err
+	}
+	if version != ENCODING_VERSION {
+		return errors.New(fmt.Sprintf("Unsupported encoding version %d, expected %d!", version, ENCODING_VERSION))
+	}
+	return nil
+}
+
+// Make sure that nothing is left over, since trailing data would mean two different byte strings
+// decode to the same value
+func (d *Decoder) Finish() error {
+	if d.offset != len(d.data) {
+		return errors.New(fmt.Sprintf("Unexpected %d trailing byte(s) after decoding!", len(d.data)-d.offset))
+	}
+	return nil
+}
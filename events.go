@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Things that happen on a node (blocks joining the primary appendage, reorgs, transactions arriving
+// and being confirmed, and peers coming and going) are recorded as events, which clients can follow
+// from `/v1/events` rather than polling. Each event has an id one higher than the last, and the most
+// recent ones are kept so a client that reconnects can pick up where it left off.
+type EventType string
+
+const EVENT_BLOCK_CONNECTED = EventType("block_connected")
+const EVENT_REORG = EventType("reorg")
+const EVENT_TRANSACTION_ADDED = EventType("transaction_added")
+const EVENT_TRANSACTION_CONFIRMED = EventType("transaction_confirmed")
+const EVENT_PEER_ADDED = EventType("peer_added")
+const EVENT_PEER_REMOVED = EventType("peer_removed")
+
+// How many past events are kept to resume from
+const EVENT_HISTORY_SIZE = 4096
+
+// Events waiting to be written to a client. A client that falls this far behind is disconnected, and
+// can resume from the last event it got.
+const EVENT_SUBSCRIBER_BUFFER = 256
+
+// How often to write a comment to an idle stream, so proxies don't close it
+const EVENT_KEEPALIVE_INTERVAL = 15 * time.Second
+
+type ReorgInfo struct {
+	OldTip       string   `json:"old_tip"`
+	NewTip       string   `json:"new_tip"`
+	ForkHeight   uint64   `json:"fork_height"`
+	Disconnected []string `json:"disconnected"`
+}
+
+type PeerEventInfo struct {
+	Peer      Peer          `json:"peer"`
+	Direction PeerDirection `json:"direction,omitempty"`
+}
+
+type Event struct {
+	Id          uint64           `json:"id"`
+	Type        EventType        `json:"type"`
+	Time        time.Time        `json:"time"`
+	Block       *BlockSummary    `json:"block,omitempty"`
+	Transaction *TransactionView `json:"transaction,omitempty"`
+	Reorg       *ReorgInfo       `json:"reorg,omitempty"`
+	Peer        *PeerEventInfo   `json:"peer,omitempty"`
+
+	// Addresses of the senders of the transactions involved, for filtering
+	addresses []Address
+}
+
+func (e Event) involves(address Address) bool {
+	for _, involved := range e.addresses {
+		if involved == address {
+			return true
+		}
+	}
+	return false
+}
+
+type EventSubscription struct {
+	events chan Event
+	// Closed if the subscriber fell too far behind
+	dropped chan struct{}
+}
+
+type EventLog struct {
+	mu          sync.Mutex
+	clock       Clock
+	chain       *Blockchain
+	lastId      uint64
+	history     []Event
+	subscribers map[*EventSubscription]bool
+
+	// The head of the primary appendage as of the last ChainChanged, and every block back from it
+	head    *Block
+	onChain map[BlockHash]bool
+}
+
+func NewEventLog(chain *Blockchain, clock Clock) *EventLog {
+	return &EventLog{
+		clock:       clock,
+		chain:       chain,
+		history:     []Event{},
+		subscribers: map[*EventSubscription]bool{},
+		onChain:     map[BlockHash]bool{},
+	}
+}
+
+func (l *EventLog) publishLocked(event Event) {
+	l.lastId += 1
+	event.Id = l.lastId
+	event.Time = l.clock.Now()
+
+	l.history = append(l.history, event)
+	if len(l.history) > EVENT_HISTORY_SIZE {
+		l.history = l.history[len(l.history)-EVENT_HISTORY_SIZE:]
+	}
+
+	for subscription := range l.subscribers {
+		select {
+		case subscription.events <- event:
+		default:
+			delete(l.subscribers, subscription)
+			close(subscription.dropped)
+		}
+	}
+}
+
+// Follow new events. If after is given, events after that id are returned to be sent first, or an
+// error if they're no longer kept.
+func (l *EventLog) Subscribe(after *uint64) ([]Event, *EventSubscription, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var past []Event
+	if after != nil {
+		oldest := l.lastId + 1
+		if len(l.history) > 0 {
+			oldest = l.history[0].Id
+		}
+		// An id from the future means the node has restarted since, and its ids started over
+		if *after+1 < oldest || *after > l.lastId {
+			return nil, nil, NewAPIError(ERROR_CODE_CURSOR_EXPIRED, fmt.Sprintf("Events after %d are no longer available!", *after))
+		}
+		for _, event := range l.history {
+			if event.Id > *after {
+				past = append(past, event)
+			}
+		}
+	}
+
+	subscription := &EventSubscription{
+		events:  make(chan Event, EVENT_SUBSCRIBER_BUFFER),
+		dropped: make(chan struct{}),
+	}
+	l.subscribers[subscription] = true
+	return past, subscription, nil
+}
+func (l *EventLog) Unsubscribe(subscription *EventSubscription) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.subscribers, subscription)
+}
+
+func (l *EventLog) TransactionAdded(transaction *Transaction) {
+	view, err := NewTransactionView(transaction)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.publishLocked(Event{Type: EVENT_TRANSACTION_ADDED, Transaction: &view, addresses: []Address{view.Sender}})
+}
+
+func (l *EventLog) PeerAdded(peer Peer, direction PeerDirection) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.publishLocked(Event{Type: EVENT_PEER_ADDED, Peer: &PeerEventInfo{Peer: peer, Direction: direction}})
+}
+func (l *EventLog) PeerRemoved(peer Peer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.publishLocked(Event{Type: EVENT_PEER_REMOVED, Peer: &PeerEventInfo{Peer: peer}})
+}
+
+// Record every block back from head as on the chain, without publishing anything for them
+func (l *EventLog) seedLocked(head *Block) {
+	l.head = head
+	for currentBlock := head; currentBlock != nil; {
+		l.onChain[*currentBlock.Hash] = true
+		if currentBlock.Previous == nil {
+			break
+		}
+		currentBlock = currentBlock.Previous.Unwrap()
+	}
+}
+
+// Compare the primary appendage to how it was last time, and publish events for the blocks that left
+// and joined it. Call this after anything that adds blocks to the chain. The first call, once the
+// chain is created or synced at startup, only records where the chain is.
+func (l *EventLog) ChainChanged() {
+	// The head is read under the lock, so that callers racing each other can't publish an older head
+	// after a newer one
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	primaryAppendage := l.chain.PrimaryAppendage()
+	if primaryAppendage == nil || primaryAppendage.Head == nil || primaryAppendage.Head.Hash == nil {
+		return
+	}
+
+	newHead := primaryAppendage.Head
+	if l.head == nil {
+		l.seedLocked(newHead)
+		return
+	}
+	if *l.head.Hash == *newHead.Hash {
+		return
+	}
+
+	// Walk back from the new head until reaching a block that was already on the primary appendage,
+	// which is where the old and new heads forked
+	var connected []*Block
+	var fork *Block
+	for currentBlock := newHead; currentBlock != nil; {
+		if l.onChain[*currentBlock.Hash] {
+			fork = currentBlock
+			break
+		}
+		connected = append(connected, currentBlock)
+		if currentBlock.Previous == nil {
+			break
+		}
+		currentBlock = currentBlock.Previous.Unwrap()
+	}
+
+	// Then walk back from the old head to the fork, to find the blocks that are no longer on it
+	var disconnected []*Block
+	for currentBlock := l.head; currentBlock != nil; {
+		if fork != nil && *currentBlock.Hash == *fork.Hash {
+			break
+		}
+		disconnected = append(disconnected, currentBlock)
+		delete(l.onChain, *currentBlock.Hash)
+		if currentBlock.Previous == nil {
+			break
+		}
+		currentBlock = currentBlock.Previous.Unwrap()
+	}
+
+	forkHeight := uint64(0)
+	firstHeight := uint64(0)
+	if fork != nil {
+		forkHeight = fork.Height()
+		firstHeight = forkHeight + 1
+	}
+
+	if len(disconnected) > 0 {
+		reorg := &ReorgInfo{
+			OldTip:       fmt.Sprintf("%x", *l.head.Hash),
+			NewTip:       fmt.Sprintf("%x", *newHead.Hash),
+			ForkHeight:   forkHeight,
+			Disconnected: []string{},
+		}
+		var addresses []Address
+		for _, block := range disconnected {
+			reorg.Disconnected = append(reorg.Disconnected, fmt.Sprintf("%x", *block.Hash))
+			addresses = append(addresses, blockSenders(block)...)
+		}
+		l.publishLocked(Event{Type: EVENT_REORG, Reorg: reorg, addresses: addresses})
+	}
+
+	// The connected blocks were collected newest first
+	for index := len(connected) - 1; index >= 0; index -= 1 {
+		block := connected[index]
+		l.onChain[*block.Hash] = true
+		summary, err := NewBlockSummary(block, firstHeight+uint64(len(connected)-1-index))
+		if err != nil {
+			continue
+		}
+		l.publishLocked(Event{Type: EVENT_BLOCK_CONNECTED, Block: &summary, addresses: blockSenders(block)})
+
+		for _, transaction := range block.Data {
+			view, err := NewTransactionView(transaction)
+			if err != nil {
+				continue
+			}
+			l.publishLocked(Event{Type: EVENT_TRANSACTION_CONFIRMED, Block: &summary, Transaction: &view, addresses: []Address{view.Sender}})
+		}
+	}
+	l.head = newHead
+}
+
+func blockSenders(block *Block) []Address {
+	var addresses []Address
+	for _, transaction := range block.Data {
+		if transaction.SenderPublicKey != nil {
+			addresses = append(addresses, transaction.SenderPublicKey.Address())
+		}
+	}
+	return addresses
+}
+
+// Handle `/v1/events`, which streams events as server-sent events. Filter them with
+// `?types=block_connected,reorg` and `?address=<address>`, and resume after an event id with the
+// Last-Event-ID header or `?cursor=<id>`.
+func (l *EventLog) Serve(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, r, NewAPIError(ERROR_CODE_INTERNAL, "Streaming isn't supported!"))
+		return
+	}
+
+	types := map[EventType]bool{}
+	if raw := r.URL.Query().Get("types"); len(raw) > 0 {
+		for _, rawType := range strings.Split(raw, ",") {
+			types[EventType(strings.TrimSpace(rawType))] = true
+		}
+	}
+	address := Address(r.URL.Query().Get("address"))
+
+	var after *uint64
+	rawCursor := r.Header.Get("Last-Event-ID")
+	if raw := r.URL.Query().Get("cursor"); len(raw) > 0 {
+		rawCursor = raw
+	}
+	if len(rawCursor) > 0 {
+		cursor, err := strconv.ParseUint(rawCursor, 10, 64)
+		if err != nil {
+			respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing cursor!"))
+			return
+		}
+		after = &cursor
+	}
+
+	past, subscription, err := l.Subscribe(after)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	defer l.Unsubscribe(subscription)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	write := func(event Event) bool {
+		if len(types) > 0 && !types[event.Type] {
+			return true
+		}
+		if len(address) > 0 && !event.involves(address) {
+			return true
+		}
+		byt, err := json.Marshal(event)
+		if err != nil {
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, byt); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	for _, event := range past {
+		if !write(event) {
+			return
+		}
+	}
+
+	keepalive := time.NewTicker(EVENT_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-subscription.events:
+			if !write(event) {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-subscription.dropped:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A block on top of previous, with a made up hash since the event log doesn't check proof of work
+func newEventTestBlock(chain *Blockchain, previous *Block, index int) *Block {
+	var lazyPrevious *LazyBlock
+	if previous != nil {
+		lazyPrevious = NewLazyBlock(chain, previous)
+	}
+	block := NewBlock(lazyPrevious, []*Transaction{}, time.Unix(int64(index), 0))
+	hash := BlockHash(sha256.Sum256([]byte(fmt.Sprintf("event test block %d", index))))
+	block.Hash = &hash
+	return block
+}
+
+// Callers that read the chain at different times and race to publish it mustn't make the log step
+// back to an older head, which would look like a reorg
+func TestChainChangedConcurrently(t *testing.T) {
+	// Interleavings that show the race are rare with only one thread running goroutines
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	chain := NewBlockchain(SystemClock)
+	events := NewEventLog(chain, SystemClock)
+	head := newEventTestBlock(chain, nil, 0)
+	chain.InsertBlockAndPlaceIntoAppendage(head)
+	events.ChainChanged()
+
+	const blocks = 200
+	const callers = 8
+	var wg sync.WaitGroup
+	for index := 1; index <= blocks; index += 1 {
+		head = newEventTestBlock(chain, head, index)
+		chain.InsertBlockAndPlaceIntoAppendage(head)
+		for caller := 0; caller < callers; caller += 1 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				events.ChainChanged()
+			}()
+		}
+	}
+	wg.Wait()
+	events.ChainChanged()
+
+	after := uint64(0)
+	history, subscription, err := events.Subscribe(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events.Unsubscribe(subscription)
+	connected := map[string]int{}
+	height := uint64(0)
+	for _, event := range history {
+		switch event.Type {
+		case EVENT_REORG:
+			t.Fatalf("Unexpected reorg from %s to %s on a chain that never forked!", event.Reorg.OldTip, event.Reorg.NewTip)
+		case EVENT_BLOCK_CONNECTED:
+			connected[event.Block.Hash] += 1
+			if event.Block.Height != height+1 {
+				t.Fatalf("Expected block %d to be connected next, got %d!", height+1, event.Block.Height)
+			}
+			height = event.Block.Height
+		}
+	}
+	if len(connected) != blocks || height != blocks {
+		t.Errorf("Expected %d blocks connected up to height %d, got %d up to %d!", blocks, blocks, len(connected), height)
+	}
+	for hash, count := range connected {
+		if count != 1 {
+			t.Errorf("Expected block %s to be connected once, got %d!", hash, count)
+		}
+	}
+}
+
+// Each stream holds a slot for as long as it's open, so once they're all taken new subscribers are
+// turned away until one closes
+func TestEventSubscriberLimit(t *testing.T) {
+	_, nodes := startTestNetwork(t, 1)
+	// Each subscriber comes from its own ip, so the per-ip rate limit doesn't turn any away first
+	router := newRouter(nodes[0], "")
+	var subscribers uint32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddUint32(&subscribers, 1)
+		r.RemoteAddr = fmt.Sprintf("10.%d.%d.%d:1234", n>>16&0xff, n>>8&0xff, n&0xff)
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	subscribe := func() *http.Response {
+		resp, err := http.Get(server.URL + "/v1/events")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	var streams []*http.Response
+	for i := 0; i < API_MAX_EVENT_SUBSCRIBERS; i += 1 {
+		resp := subscribe()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected subscriber %d to be let in, got %d!", i, resp.StatusCode)
+		}
+		streams = append(streams, resp)
+	}
+	if resp := subscribe(); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected a subscriber past the limit to be turned away, got %d!", resp.StatusCode)
+	}
+
+	streams[0].Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := subscribe()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+		resp.Body.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a subscriber to be let in once a stream closed, got %d!", resp.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Explorer endpoints page through the blocks in the primary appendage by height, returning summaries
+// (and views, see view.go) decoded into plain json rather than the wire format peers use.
+const EXPLORER_DEFAULT_PAGE_SIZE = 20
+const EXPLORER_MAX_PAGE_SIZE = 100
+
+type BlockSummary struct {
+	Hash             string    `json:"hash"`
+	PreviousHash     string    `json:"previous_hash,omitempty"`
+	Height           uint64    `json:"height"`
+	CreatedAt        time.Time `json:"created_at"`
+	Number           uint      `json:"number"`
+	TransactionCount int       `json:"transaction_count"`
+	// Size of the block in its binary wire encoding, in bytes
+	Size int `json:"size"`
+}
+
+func NewBlockSummary(block *Block, height uint64) (BlockSummary, error) {
+	byt, err := block.Encode()
+	if err != nil {
+		return BlockSummary{}, err
+	}
+	summary := BlockSummary{
+		Hash:             fmt.Sprintf("%x", *block.Hash),
+		Height:           height,
+		CreatedAt:        block.CreatedAt,
+		Number:           block.Number,
+		TransactionCount: len(block.Data),
+		Size:             len(byt),
+	}
+	if block.Previous != nil && block.Previous.Hash != nil {
+		summary.PreviousHash = fmt.Sprintf("%x", *block.Previous.Hash)
+	}
+	return summary, nil
+}
+
+// Up to limit blocks in the primary appendage, in order of height starting at fromHeight, along with
+// how many blocks the primary appendage has
+func (c *Blockchain) PrimaryBlocks(fromHeight uint64, limit int) ([]*Block, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	length := uint64(len(c.primaryHeights))
+	blocks := []*Block{}
+	for height := fromHeight; height < length && len(blocks) < limit; height += 1 {
+		blocks = append(blocks, c.primaryHeights[height])
+	}
+	return blocks, length
+}
+
+// The block at a height in the primary appendage, if there is one
+func (c *Blockchain) BlockAtHeight(height uint64) *Block {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if height >= uint64(len(c.primaryHeights)) {
+		return nil
+	}
+	return c.primaryHeights[height]
+}
+
+// A transaction in the primary appendage, along with the block it's in
+func (c *Blockchain) FindTransaction(id uuid.UUID) (*Transaction, *Block) {
+	c.indexMu.RLock()
+	blocks := c.transactions[id]
+	c.indexMu.RUnlock()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, block := range blocks {
+		height := block.Height()
+		if height >= uint64(len(c.primaryHeights)) || c.primaryHeights[height] != block {
+			continue
+		}
+		for _, transaction := range block.Data {
+			if transaction.Id == id {
+				return transaction, block
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Up to limit transactions sent from an address in the primary appendage, newest first, along with
+// the block each one is in
+func (c *Blockchain) TransactionsFrom(address Address, limit int) ([]*Transaction, []*Block) {
+	c.indexMu.RLock()
+	blocks := c.senders[address]
+	c.indexMu.RUnlock()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var transactions []*Transaction
+	var containing []*Block
+	// Blocks are indexed after their previous block, so the primary ones are in order of height
+	for index := len(blocks) - 1; index >= 0 && len(transactions) < limit; index -= 1 {
+		block := blocks[index]
+		height := block.Height()
+		if height >= uint64(len(c.primaryHeights)) || c.primaryHeights[height] != block {
+			continue
+		}
+		for i := len(block.Data) - 1; i >= 0 && len(transactions) < limit; i -= 1 {
+			transaction := block.Data[i]
+			if transaction.SenderPublicKey != nil && transaction.SenderPublicKey.Address() == address {
+				transactions = append(transactions, transaction)
+				containing = append(containing, block)
+			}
+		}
+	}
+	return transactions, containing
+}
+
+func parseHeight(raw string) (uint64, error) {
+	height, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing height!")
+	}
+	return height, nil
+}
+
+// The block with a hash given in hex. Lookups like this one are shared by the rest and rpc apis, so
+// both send the same errors.
+func findBlock(chain *Blockchain, rawHash string) (*Block, error) {
+	hash, err := HexToBlockHash(rawHash)
+	if err != nil {
+		return nil, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing block hash!")
+	}
+	block := chain.GetBlockWithHash(*hash)
+	if block == nil {
+		return nil, NewAPIError(ERROR_CODE_NOT_FOUND, "Block not found!")
+	}
+	return block, nil
+}
+
+func findBlockAtHeight(chain *Blockchain, height uint64) (*Block, error) {
+	block := chain.BlockAtHeight(height)
+	if block == nil {
+		return nil, NewAPIError(ERROR_CODE_NOT_FOUND, "No block at that height!")
+	}
+	return block, nil
+}
+
+// A transaction in the mempool, or in the primary appendage along with the block it's in
+func findTransaction(chain *Blockchain, memPool *MemPool, rawId string) (*Transaction, *Block, error) {
+	id, err := uuid.Parse(rawId)
+	if err != nil {
+		return nil, nil, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing transaction id!")
+	}
+	if transaction := memPool.Get(id); transaction != nil {
+		return transaction, nil, nil
+	}
+	transaction, block := chain.FindTransaction(id)
+	if transaction == nil {
+		return nil, nil, NewAPIError(ERROR_CODE_NOT_FOUND, "Transaction not found!")
+	}
+	return transaction, block, nil
+}
+
+// The head of the primary appendage
+func findTip(chain *Blockchain) (*Block, error) {
+	primaryAppendage := chain.PrimaryAppendage()
+	if primaryAppendage == nil || primaryAppendage.Head == nil {
+		return nil, NewAPIError(ERROR_CODE_NOT_FOUND, "The chain is empty!")
+	}
+	return primaryAppendage.Head, nil
+}
+
+func mountExplorerRoutes(r chi.Router, chain *Blockchain) {
+	limited := limitConcurrency(API_MAX_CONCURRENT_EXPLORER_REQUESTS)
+
+	// List block summaries by height, ie /v1/blocks?from_height=100&limit=20
+	r.With(limited).Get("/v1/blocks", func(w http.ResponseWriter, r *http.Request) {
+		fromHeight := uint64(0)
+		if raw := r.URL.Query().Get("from_height"); len(raw) > 0 {
+			height, err := parseHeight(raw)
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+			fromHeight = height
+		}
+		limit := EXPLORER_DEFAULT_PAGE_SIZE
+		if raw := r.URL.Query().Get("limit"); len(raw) > 0 {
+			parsed, err := strconv.Atoi(raw)
+			if err != nil || parsed < 1 {
+				respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing limit!"))
+				return
+			}
+			limit = parsed
+		}
+		if limit > EXPLORER_MAX_PAGE_SIZE {
+			limit = EXPLORER_MAX_PAGE_SIZE
+		}
+
+		blocks, length := chain.PrimaryBlocks(fromHeight, limit)
+		summaries := []BlockSummary{}
+		for _, block := range blocks {
+			summary, err := NewBlockSummary(block, block.Height())
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+			summaries = append(summaries, summary)
+		}
+
+		response := map[string]interface{}{"blocks": summaries}
+		// Where the next page starts, if there is one
+		if next := fromHeight + uint64(len(summaries)); next < length {
+			response["next_height"] = next
+		}
+		render.JSON(w, r, response)
+	})
+
+	r.With(limited).Get("/v1/blocks/by-height/{height}", func(w http.ResponseWriter, r *http.Request) {
+		height, err := parseHeight(chi.URLParam(r, "height"))
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		block, err := findBlockAtHeight(chain, height)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+
+		view, err := NewBlockView(block, height)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		render.JSON(w, r, map[string]interface{}{"block": view})
+	})
+
+	// The head of the primary appendage
+	r.With(limited).Get("/v1/tip", func(w http.ResponseWriter, r *http.Request) {
+		tip, err := findTip(chain)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		summary, err := NewBlockSummary(tip, tip.Height())
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		render.JSON(w, r, map[string]interface{}{
+			"block":      summary,
+			"appendages": len(chain.ListAppendages()),
+		})
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Hashes that aren't exactly a block hash long are bad requests in every api that looks blocks up
+func TestFindBlockBadHash(t *testing.T) {
+	_, nodes := startTestNetwork(t, 1)
+	r := newRouter(nodes[0], "")
+	request := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if len(body) > 0 {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, hash := range []string{strings.Repeat("00", len(BlockHash{})+1), strings.Repeat("00", 1000), "00", "zz"} {
+		w := request("GET", "/v1/blocks/"+hash, "")
+		apiError, ok := parseAPIError(w.Body.Bytes())
+		if w.Code != http.StatusBadRequest || !ok || apiError.Code != ERROR_CODE_BAD_REQUEST {
+			t.Errorf("Expected a bad request for block %s, got %d %s!", hash, w.Code, w.Body.String())
+		}
+
+		w = request("POST", "/rpc", `{"jsonrpc": "2.0", "method": "getBlock", "params": {"hash": "`+hash+`"}, "id": 1}`)
+		var rpcResponse struct {
+			Error *struct {
+				Data struct {
+					Code ErrorCode `json:"code"`
+				} `json:"data"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &rpcResponse); err != nil {
+			t.Fatal(err)
+		}
+		if rpcResponse.Error == nil || rpcResponse.Error.Data.Code != ERROR_CODE_BAD_REQUEST {
+			t.Errorf("Expected a bad request error from getBlock for %s, got %s!", hash, w.Body.String())
+		}
+
+		w = request("POST", "/graphql", `{"query": "{ block(hash: \"`+hash+`\") { height } }"}`)
+		var graphQLResponse GraphQLResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &graphQLResponse); err != nil {
+			t.Fatal(err)
+		}
+		if len(graphQLResponse.Errors) != 1 || graphQLResponse.Errors[0].Message != "Error parsing block hash!" {
+			t.Errorf("Expected an error parsing the hash from block for %s, got %s!", hash, w.Body.String())
+		}
+	}
+}
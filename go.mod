@@ -3,8 +3,10 @@ module blockchain
 go 1.17
 
 require (
-	github.com/go-chi/chi v1.5.4 // indirect
-	github.com/go-chi/render v1.0.1 // indirect
-	github.com/google/uuid v1.3.0 // indirect
-	github.com/tidwall/btree v1.1.0 // indirect
+	github.com/go-chi/chi v1.5.4
+	github.com/go-chi/render v1.0.1
+	github.com/google/uuid v1.3.0
+	github.com/gorilla/websocket v1.5.0
 )
+
+require github.com/tidwall/btree v1.1.0 // indirect
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// Rather than pushing every block and transaction to every peer, nodes announce the hashes of new
+// items to a few peers, and those peers fetch only the items they don't have yet. A cache of recently
+// seen items stops the same announcement from bouncing back and forth between peers forever.
+const FEATURE_INVENTORY_GOSSIP = "inventory-gossip"
+const INVENTORY_TYPE_BLOCK = "block"
+const INVENTORY_TYPE_TRANSACTION = "transaction"
+
+const NODE_DEFAULT_GOSSIP_FANOUT = 8
+const GOSSIP_SEEN_CACHE_TTL = 10 * time.Minute
+const GOSSIP_SEEN_CACHE_CAPACITY = 10000
+
+// An item being fetched from one peer isn't fetched again from another until this long has passed,
+// in case the first peer never sends it
+const GOSSIP_FETCH_TIMEOUT = 30 * time.Second
+
+// Received items and announcements are handled by a fixed number of workers, and dropped if this
+// many are already waiting
+const GOSSIP_WORKERS = 8
+const GOSSIP_QUEUE_SIZE = 1000
+
+// Blocks that arrive before their previous block are held until it does, up to this many
+const GOSSIP_MAX_ORPHANS = 100
+
+// How far back to fetch the missing ancestors of a block from the peer that sent it
+const GOSSIP_MAX_ORPHAN_FETCH_DEPTH = 20
+
+var errTransactionExpired = NewAPIError(ERROR_CODE_EXPIRED, "Transaction has expired!")
+
+type InventoryItem struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+func BlockInventoryItem(block *Block) InventoryItem {
+	return InventoryItem{Type: INVENTORY_TYPE_BLOCK, Id: fmt.Sprintf("%x", *block.Hash)}
+}
+func TransactionInventoryItem(transaction *Transaction) InventoryItem {
+	return InventoryItem{Type: INVENTORY_TYPE_TRANSACTION, Id: transaction.Id.String()}
+}
+
+type SeenCache struct {
+	mu    sync.Mutex
+	items map[InventoryItem]time.Time
+	// Items that have been asked for but haven't arrived yet, and when they were asked for
+	inFlight map[InventoryItem]time.Time
+	clock    Clock
+}
+
+func NewSeenCache(clock Clock) *SeenCache {
+	return &SeenCache{items: map[InventoryItem]time.Time{}, inFlight: map[InventoryItem]time.Time{}, clock: clock}
+}
+
+// Mark an item as seen, returning false if it had already been seen
+func (c *SeenCache) Add(item InventoryItem) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	delete(c.inFlight, item)
+	if seenAt, ok := c.items[item]; ok && now.Sub(seenAt) < GOSSIP_SEEN_CACHE_TTL {
+		return false
+	}
+	if len(c.items) >= GOSSIP_SEEN_CACHE_CAPACITY {
+		c.pruneLocked()
+	}
+	c.items[item] = now
+	return true
+}
+
+// Mark an item as being fetched, returning false if it has already been seen or is being fetched.
+// The item only counts as seen once it arrives, so if fetching fails it should be released.
+func (c *SeenCache) Request(item InventoryItem) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	if seenAt, ok := c.items[item]; ok && now.Sub(seenAt) < GOSSIP_SEEN_CACHE_TTL {
+		return false
+	}
+	if requestedAt, ok := c.inFlight[item]; ok && now.Sub(requestedAt) < GOSSIP_FETCH_TIMEOUT {
+		return false
+	}
+	if len(c.inFlight) >= GOSSIP_SEEN_CACHE_CAPACITY {
+		c.pruneLocked()
+	}
+	c.inFlight[item] = now
+	return true
+}
+
+// Let an item that couldn't be fetched be asked for again
+func (c *SeenCache) Release(item InventoryItem) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inFlight, item)
+}
+func (c *SeenCache) Prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pruneLocked()
+}
+func (c *SeenCache) pruneLocked() {
+	now := c.clock.Now()
+	for item, requestedAt := range c.inFlight {
+		if now.Sub(requestedAt) >= GOSSIP_FETCH_TIMEOUT {
+			delete(c.inFlight, item)
+		}
+	}
+	for item, seenAt := range c.items {
+		if now.Sub(seenAt) >= GOSSIP_SEEN_CACHE_TTL {
+			delete(c.items, item)
+		}
+	}
+
+	// If everything is still fresh, forget the oldest half so the cache can't grow without bound
+	if len(c.items) >= GOSSIP_SEEN_CACHE_CAPACITY {
+		cutoff := now.Add(-GOSSIP_SEEN_CACHE_TTL / 2)
+		for item, seenAt := range c.items {
+			if seenAt.Before(cutoff) {
+				delete(c.items, item)
+			}
+		}
+	}
+}
+
+// A block waiting on its previous block, along with the peer that sent it
+type orphanBlock struct {
+	block *Block
+	from  *PeerId
+}
+
+type Gossip struct {
+	peerSet     *PeerSet
+	broadcaster *Broadcaster
+	transport   Transport
+	chain       *Blockchain
+	memPool     *MemPool
+	seen        *SeenCache
+	fanout      int
+	wireFormat  WireFormat
+	clock       Clock
+	entropy     *Entropy
+
+	// Set when websocket links are enabled, so announcements can skip making an http request
+	links *LinkManager
+	// Set to record new blocks and transactions as events
+	events *EventLog
+
+	orphansMu sync.Mutex
+	orphans   map[BlockHash]orphanBlock
+	// Hashes of the orphans, oldest first
+	orphanOrder []BlockHash
+
+	queue chan func()
+}
+
+func NewGossip(peerSet *PeerSet, broadcaster *Broadcaster, transport Transport, chain *Blockchain, memPool *MemPool, fanout int, wireFormat WireFormat, clock Clock, entropy *Entropy) *Gossip {
+	gossip := &Gossip{
+		peerSet:     peerSet,
+		broadcaster: broadcaster,
+		transport:   transport,
+		chain:       chain,
+		memPool:     memPool,
+		seen:        NewSeenCache(clock),
+		fanout:      fanout,
+		wireFormat:  wireFormat,
+		clock:       clock,
+		entropy:     entropy,
+		orphans:     map[BlockHash]orphanBlock{},
+		queue:       make(chan func(), GOSSIP_QUEUE_SIZE),
+	}
+	for i := 0; i < GOSSIP_WORKERS; i += 1 {
+		go gossip.work()
+	}
+	return gossip
+}
+
+func (g *Gossip) work() {
+	for fn := range g.queue {
+		fn()
+	}
+}
+
+// Handle something a peer sent in the background, returning false if too much is already waiting
+func (g *Gossip) Enqueue(fn func()) bool {
+	select {
+	case g.queue <- fn:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pick up to fanout peers at random to relay an item to, leaving out the peer it came from
+func (g *Gossip) pickPeers(except *PeerId) []Peer {
+	var candidates []Peer
+	for _, peer := range g.peerSet.ListOthers() {
+		if except != nil && peer.Id == *except {
+			continue
+		}
+		candidates = append(candidates, peer)
+	}
+	g.entropy.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if g.fanout > 0 && len(candidates) > g.fanout {
+		candidates = candidates[:g.fanout]
+	}
+	return candidates
+}
+
+// Validate a block (whether pushed in full or fetched after an announcement), add it to the chain,
+// and let other peers know about it. A block whose previous block isn't known yet is held until it
+// is. Returns false if the block was already known.
+func (g *Gossip) AcceptBlock(block *Block, from *PeerId) (bool, error) {
+	g.seen.Add(BlockInventoryItem(block))
+
+	if err := block.Validate(); err != nil {
+		return false, err
+	}
+	if g.chain.GetBlockWithHash(*block.Hash) != nil {
+		return false, nil
+	}
+	if !block.ParentKnown() {
+		return g.holdOrphan(block, from), nil
+	}
+
+	if err := g.chain.ValidatePlacement(block); err != nil {
+		return false, err
+	}
+	if ok := g.chain.InsertBlockAndPlaceIntoAppendage(block); !ok {
+		return false, nil
+	}
+	if g.events != nil {
+		g.events.ChainChanged()
+	}
+	g.memPool.Remove(block.Data)
+	g.AnnounceBlock(block, from)
+	g.connectOrphans(block)
+	return true, nil
+}
+
+// Hold onto a block until its previous block arrives, returning false if it's already held
+func (g *Gossip) holdOrphan(block *Block, from *PeerId) bool {
+	g.orphansMu.Lock()
+	defer g.orphansMu.Unlock()
+
+	if _, ok := g.orphans[*block.Hash]; ok {
+		return false
+	}
+	// Make room by forgetting the oldest orphan
+	for len(g.orphans) >= GOSSIP_MAX_ORPHANS && len(g.orphanOrder) > 0 {
+		delete(g.orphans, g.orphanOrder[0])
+		g.orphanOrder = g.orphanOrder[1:]
+	}
+	g.orphans[*block.Hash] = orphanBlock{block: block, from: from}
+	g.orphanOrder = append(g.orphanOrder, *block.Hash)
+	return true
+}
+
+// Remove and return the orphans whose previous block is parent
+func (g *Gossip) takeOrphansOf(parent *Block) []orphanBlock {
+	g.orphansMu.Lock()
+	defer g.orphansMu.Unlock()
+
+	var children []orphanBlock
+	remaining := g.orphanOrder[:0]
+	for _, hash := range g.orphanOrder {
+		orphan := g.orphans[hash]
+		if *orphan.block.Previous.Hash == *parent.Hash {
+			children = append(children, orphan)
+			delete(g.orphans, hash)
+		} else {
+			remaining = append(remaining, hash)
+		}
+	}
+	g.orphanOrder = remaining
+	return children
+}
+
+// Now that a block is in the chain, add any orphans that were waiting on it, and any waiting on them
+func (g *Gossip) connectOrphans(parent *Block) {
+	waiting := g.takeOrphansOf(parent)
+	for len(waiting) > 0 {
+		orphan := waiting[0]
+		waiting = waiting[1:]
+
+		if err := g.chain.ValidatePlacement(orphan.block); err != nil {
+			fmt.Printf("Orphan block %x is invalid! %s\n", *orphan.block.Hash, err)
+			if orphan.from != nil {
+				g.peerSet.Penalize(*orphan.from, PEER_OFFENSE_INVALID_BLOCK)
+			}
+			continue
+		}
+		if ok := g.chain.InsertBlockAndPlaceIntoAppendage(orphan.block); !ok {
+			continue
+		}
+		if g.events != nil {
+			g.events.ChainChanged()
+		}
+		g.memPool.Remove(orphan.block.Data)
+		g.AnnounceBlock(orphan.block, orphan.from)
+		waiting = append(waiting, g.takeOrphansOf(orphan.block)...)
+	}
+}
+
+// Fetch the blocks before a block from the peer that sent it, until reaching one already in the chain
+func (g *Gossip) FetchMissingAncestors(from PeerId, block *Block) error {
+	peer, ok := g.peerSet.Get(from)
+	if !ok {
+		return nil
+	}
+
+	currentBlock := block
+	for depth := 0; depth < GOSSIP_MAX_ORPHAN_FETCH_DEPTH && !currentBlock.ParentKnown(); depth += 1 {
+		previousHash := *currentBlock.Previous.Hash
+		previousBlock, err := g.fetchBlock(peer, previousHash)
+		if err != nil {
+			fmt.Printf("Failed to fetch block %x from peer %s! %s\n", previousHash, uuid.UUID(from).String(), err)
+			if offense, ok := OffenseOfPeerError(err); ok {
+				g.peerSet.Penalize(from, offense)
+			}
+			return nil
+		}
+		if _, err := g.AcceptBlock(previousBlock, &from); err != nil {
+			return err
+		}
+		currentBlock = previousBlock
+	}
+	return nil
+}
+
+// Validate a transaction, add it to the mempool, and let other peers know about it. Returns false if
+// the transaction was already in the mempool.
+func (g *Gossip) AcceptTransaction(transaction *Transaction, from *PeerId) (bool, error) {
+	g.seen.Add(TransactionInventoryItem(transaction))
+
+	if ok, err := transaction.Verify(); err != nil || !ok {
+		return false, NewAPIError(ERROR_CODE_INVALID_SIGNATURE, "Transaction signature is invalid!")
+	}
+	if transaction.LockStatus(g.chain.NextHeight(), g.clock.Now()) == TRANSACTION_LOCK_EXPIRED {
+		return false, errTransactionExpired
+	}
+	if g.memPool.Get(transaction.Id) != nil {
+		return false, nil
+	}
+	if nonce := g.NextNonce(transaction.SenderPublicKey.Address()); transaction.Nonce != nonce {
+		return false, NewAPIError(ERROR_CODE_INVALID_NONCE, fmt.Sprintf("Transaction has nonce %d, but the sender's next transaction should have %d!", transaction.Nonce, nonce))
+	}
+
+	if ok := g.memPool.Submit(transaction); !ok {
+		return false, nil
+	}
+	if g.events != nil {
+		g.events.TransactionAdded(transaction)
+	}
+	g.AnnounceTransaction(transaction, from)
+	return true, nil
+}
+
+// The nonce an address's next transaction should have, counting the ones in the primary appendage
+// and the mempool
+func (g *Gossip) NextNonce(address Address) uint64 {
+	return g.memPool.NextNonce(address, g.chain.CountTransactionsFrom(address))
+}
+
+// Transactions can expire or have their nonce used up while they're being relayed, so errors like
+// those aren't the fault of the peer that sent the transaction
+func peerAtFault(err error) bool {
+	var apiError APIError
+	if errors.As(err, &apiError) {
+		return apiError.Code != ERROR_CODE_EXPIRED && apiError.Code != ERROR_CODE_INVALID_NONCE
+	}
+	return true
+}
+
+func (g *Gossip) AnnounceBlock(block *Block, from *PeerId) {
+	item := BlockInventoryItem(block)
+	for _, peer := range g.pickPeers(from) {
+		if g.links != nil && g.links.Announce(peer.Id, []InventoryItem{item}) {
+			continue
+		}
+		if handshake, ok := g.peerSet.Handshake(peer.Id); ok && handshake.Supports(FEATURE_INVENTORY_GOSSIP) {
+			g.announceToPeer(peer, []InventoryItem{item})
+		} else {
+			// Peers that don't understand announcements get the whole block like before
+			g.pushBlockToPeer(peer, block)
+		}
+	}
+}
+func (g *Gossip) AnnounceTransaction(transaction *Transaction, from *PeerId) {
+	item := TransactionInventoryItem(transaction)
+	for _, peer := range g.pickPeers(from) {
+		if g.links != nil && g.links.Announce(peer.Id, []InventoryItem{item}) {
+			continue
+		}
+		if handshake, ok := g.peerSet.Handshake(peer.Id); ok && handshake.Supports(FEATURE_INVENTORY_GOSSIP) {
+			g.announceToPeer(peer, []InventoryItem{item})
+		} else {
+			g.pushTransactionToPeer(peer, transaction)
+		}
+	}
+}
+
+func (g *Gossip) announceToPeer(peer Peer, items []InventoryItem) {
+	g.broadcaster.Send(peer, fmt.Sprintf("announcement of %d item(s)", len(items)), func(peer Peer) error {
+		return g.transport.Announce(peer.Address, items)
+	})
+}
+
+// Filter announced items down to the ones this node doesn't have and hasn't already asked for,
+// marking them as being fetched. Announcing items that can't be parsed costs the peer ranking.
+func (g *Gossip) UnseenItems(from PeerId, items []InventoryItem) []InventoryItem {
+	var unseen []InventoryItem
+	for _, item := range items {
+		switch item.Type {
+		case INVENTORY_TYPE_BLOCK:
+			hash, err := HexToBlockHash(item.Id)
+			if err != nil {
+				g.peerSet.Penalize(from, PEER_OFFENSE_MALFORMED_RESPONSE)
+				continue
+			}
+			if g.chain.GetBlockWithHash(*hash) != nil || !g.seen.Request(item) {
+				continue
+			}
+			unseen = append(unseen, item)
+
+		case INVENTORY_TYPE_TRANSACTION:
+			id, err := uuid.Parse(item.Id)
+			if err != nil {
+				g.peerSet.Penalize(from, PEER_OFFENSE_MALFORMED_RESPONSE)
+				continue
+			}
+			if g.memPool.Get(id) != nil || !g.seen.Request(item) {
+				continue
+			}
+			unseen = append(unseen, item)
+
+		default:
+			// Could be a kind of item from a newer version of the protocol, so just skip it
+			continue
+		}
+	}
+	return unseen
+}
+
+// Handle an announcement from a peer, fetching any items that haven't been seen before
+func (g *Gossip) HandleAnnouncement(from PeerId, items []InventoryItem) {
+	peer, ok := g.peerSet.Get(from)
+	if !ok {
+		return
+	}
+
+	for _, item := range g.UnseenItems(from, items) {
+		switch item.Type {
+		case INVENTORY_TYPE_BLOCK:
+			hash, _ := HexToBlockHash(item.Id)
+			block, err := g.fetchBlock(peer, *hash)
+			if err != nil {
+				g.seen.Release(item)
+				fmt.Printf("Failed to fetch announced block %s from peer %s! %s\n", item.Id, uuid.UUID(from).String(), err)
+				if offense, ok := OffenseOfPeerError(err); ok {
+					g.peerSet.Penalize(from, offense)
+				}
+				continue
+			}
+			g.ReceiveBlock(from, block)
+
+		case INVENTORY_TYPE_TRANSACTION:
+			id, _ := uuid.Parse(item.Id)
+			transaction, err := g.fetchTransaction(peer, id)
+			if err != nil {
+				g.seen.Release(item)
+				fmt.Printf("Failed to fetch announced transaction %s from peer %s! %s\n", item.Id, uuid.UUID(from).String(), err)
+				// The peer may have dropped the transaction from its mempool since announcing it
+				if code, ok := PeerErrorCode(err); ok && code == ERROR_CODE_NOT_FOUND {
+					continue
+				}
+				if offense, ok := OffenseOfPeerError(err); ok {
+					g.peerSet.Penalize(from, offense)
+				}
+				continue
+			}
+			g.ReceiveTransaction(from, transaction)
+		}
+	}
+}
+
+// Accept an item that a peer sent, holding the peer responsible if it turns out to be invalid
+func (g *Gossip) ReceiveBlock(from PeerId, block *Block) {
+	_, err := g.AcceptBlock(block, &from)
+	if err == nil && !block.ParentKnown() {
+		err = g.FetchMissingAncestors(from, block)
+	}
+	if err != nil {
+		fmt.Printf("Block %x from peer %s is invalid! %s\n", *block.Hash, uuid.UUID(from).String(), err)
+		g.peerSet.Penalize(from, PEER_OFFENSE_INVALID_BLOCK)
+	}
+}
+func (g *Gossip) ReceiveTransaction(from PeerId, transaction *Transaction) {
+	if _, err := g.AcceptTransaction(transaction, &from); err != nil && peerAtFault(err) {
+		fmt.Printf("Transaction %s from peer %s is invalid! %s\n", transaction.Id, uuid.UUID(from).String(), err)
+		g.peerSet.Penalize(from, PEER_OFFENSE_INVALID_TRANSACTION)
+	}
+}
+
+func (g *Gossip) fetchBlock(peer Peer, hash BlockHash) (*Block, error) {
+	block, err := g.transport.GetBlock(peer.Address, g.peerSet.WireFormatFor(peer.Id, g.wireFormat), g.chain, hash)
+	if err != nil {
+		return nil, err
+	}
+	if block.Hash == nil || *block.Hash != hash {
+		return nil, errors.New("Peer sent a different block than the one requested!")
+	}
+	return block, nil
+}
+func (g *Gossip) fetchTransaction(peer Peer, id uuid.UUID) (*Transaction, error) {
+	transaction, err := g.transport.GetTransaction(peer.Address, g.peerSet.WireFormatFor(peer.Id, g.wireFormat), id)
+	if err != nil {
+		return nil, err
+	}
+	if transaction.Id != id {
+		return nil, errors.New("Peer sent a different transaction than the one requested!")
+	}
+	return transaction, nil
+}
+
+func (g *Gossip) pushBlockToPeer(peer Peer, block *Block) {
+	g.broadcaster.Send(peer, fmt.Sprintf("block %x", *block.Hash), func(peer Peer) error {
+		return g.transport.PushBlock(peer.Address, g.peerSet.WireFormatFor(peer.Id, g.wireFormat), block)
+	})
+}
+func (g *Gossip) pushTransactionToPeer(peer Peer, transaction *Transaction) {
+	g.broadcaster.Send(peer, fmt.Sprintf("transaction %s", transaction.Id), func(peer Peer) error {
+		return g.transport.PushTransaction(peer.Address, g.peerSet.WireFormatFor(peer.Id, g.wireFormat), transaction)
+	})
+}
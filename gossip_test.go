@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"testing"
+)
+
+func peerRanking(node *Node, id PeerId) PeerRanking {
+	node.peerSet.mu.Lock()
+	defer node.peerSet.mu.Unlock()
+	return node.peerSet.rankings[id]
+}
+
+// A peer that announced a transaction may have mined or dropped it by the time it's fetched, which
+// isn't the peer's fault
+func TestAnnouncedTransactionNotFound(t *testing.T) {
+	_, nodes := startTestNetwork(t, 2)
+	announcer := nodes[0].Me().Id
+	before := peerRanking(nodes[1], announcer)
+
+	item := InventoryItem{Type: INVENTORY_TYPE_TRANSACTION, Id: uuid.New().String()}
+	nodes[1].gossip.HandleAnnouncement(announcer, []InventoryItem{item})
+
+	if ranking := peerRanking(nodes[1], announcer); ranking != before {
+		t.Errorf("Expected the peer's ranking to stay at %d, got %d!", before, ranking)
+	}
+	// Another peer may still have it
+	if !nodes[1].gossip.seen.Request(item) {
+		t.Errorf("Expected the transaction to be fetched again when it's next announced!")
+	}
+}
+
+// A block is never dropped once it's been announced, so a peer that can't send one is penalized
+func TestAnnouncedBlockNotFound(t *testing.T) {
+	_, nodes := startTestNetwork(t, 2)
+	announcer := nodes[0].Me().Id
+	before := peerRanking(nodes[1], announcer)
+
+	item := InventoryItem{Type: INVENTORY_TYPE_BLOCK, Id: "00000000000000000000000000000000000000000000000000000000000000ff"}
+	nodes[1].gossip.HandleAnnouncement(announcer, []InventoryItem{item})
+
+	if ranking := peerRanking(nodes[1], announcer); ranking >= before {
+		t.Errorf("Expected the peer's ranking to drop below %d, got %d!", before, ranking)
+	}
+}
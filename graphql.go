@@ -0,0 +1,1060 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Queries are run by a small parser and executor here, with the types in graphqlschema.go, see the README
+const API_MAX_GRAPHQL_BODY_SIZE = 64 * 1024
+
+// How deeply selections can nest, since each level can multiply the work of the one above it
+const GRAPHQL_MAX_DEPTH = 12
+
+// How deeply brackets of any kind can nest, checked while parsing so a query can't exhaust the stack
+const GRAPHQL_MAX_NESTING = 32
+
+// How much work one query can do. Each field costs one, fields that look things up in the chain or
+// the mempool cost GRAPHQL_LOOKUP_COST more, and lists cost one more per item.
+const GRAPHQL_MAX_COST = 50000
+const GRAPHQL_LOOKUP_COST = 10
+
+type gqlTokenKind int
+
+const (
+	GQL_TOKEN_EOF gqlTokenKind = iota
+	GQL_TOKEN_PUNCTUATOR
+	GQL_TOKEN_NAME
+	GQL_TOKEN_INT
+	GQL_TOKEN_FLOAT
+	GQL_TOKEN_STRING
+)
+
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	at    int
+}
+
+func isGraphQLNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+func isGraphQLDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func lexGraphQL(source string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		// Commas are insignificant in GraphQL, like whitespace
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i += 1
+		case strings.HasPrefix(source[i:], "\uFEFF"):
+			// A byte order mark
+			i += len("\uFEFF")
+		case c == '#':
+			for i < len(source) && source[i] != '\n' && source[i] != '\r' {
+				i += 1
+			}
+		case strings.HasPrefix(source[i:], "..."):
+			tokens = append(tokens, gqlToken{kind: GQL_TOKEN_PUNCTUATOR, value: "...", at: i})
+			i += 3
+		case strings.IndexByte("!$&():=@[]{}|", c) >= 0:
+			tokens = append(tokens, gqlToken{kind: GQL_TOKEN_PUNCTUATOR, value: string(c), at: i})
+			i += 1
+		case isGraphQLNameStart(c):
+			start := i
+			for i < len(source) && (isGraphQLNameStart(source[i]) || isGraphQLDigit(source[i])) {
+				i += 1
+			}
+			tokens = append(tokens, gqlToken{kind: GQL_TOKEN_NAME, value: source[start:i], at: start})
+		case c == '-' || isGraphQLDigit(c):
+			start := i
+			kind := GQL_TOKEN_INT
+			if c == '-' {
+				i += 1
+			}
+			for i < len(source) && isGraphQLDigit(source[i]) {
+				i += 1
+			}
+			if i < len(source) && source[i] == '.' {
+				kind = GQL_TOKEN_FLOAT
+				i += 1
+				for i < len(source) && isGraphQLDigit(source[i]) {
+					i += 1
+				}
+			}
+			if i < len(source) && (source[i] == 'e' || source[i] == 'E') {
+				kind = GQL_TOKEN_FLOAT
+				i += 1
+				if i < len(source) && (source[i] == '+' || source[i] == '-') {
+					i += 1
+				}
+				for i < len(source) && isGraphQLDigit(source[i]) {
+					i += 1
+				}
+			}
+			tokens = append(tokens, gqlToken{kind: kind, value: source[start:i], at: start})
+		case strings.HasPrefix(source[i:], `"""`):
+			// Block strings are kept as written, without removing their indentation
+			end := strings.Index(source[i+3:], `"""`)
+			if end < 0 {
+				return nil, errors.New(fmt.Sprintf("Unterminated string at %d!", i))
+			}
+			tokens = append(tokens, gqlToken{kind: GQL_TOKEN_STRING, value: source[i+3 : i+3+end], at: i})
+			i += 3 + end + 3
+		case c == '"':
+			value, length, err := lexGraphQLString(source[i:])
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s at %d!", err, i))
+			}
+			tokens = append(tokens, gqlToken{kind: GQL_TOKEN_STRING, value: value, at: i})
+			i += length
+		default:
+			return nil, errors.New(fmt.Sprintf("Unexpected character %q at %d!", c, i))
+		}
+	}
+	return append(tokens, gqlToken{kind: GQL_TOKEN_EOF, at: len(source)}), nil
+}
+
+// Read a quoted string from the start of source, returning it unescaped along with how many bytes of
+// source it took up
+func lexGraphQLString(source string) (string, int, error) {
+	var value strings.Builder
+	i := 1
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case c == '"':
+			return value.String(), i + 1, nil
+		case c == '\n' || c == '\r':
+			return "", 0, errors.New("Unterminated string")
+		case c == '\\' && i+1 < len(source):
+			escaped := source[i+1]
+			i += 2
+			switch escaped {
+			case '"', '\\', '/':
+				value.WriteByte(escaped)
+			case 'b':
+				value.WriteByte('\b')
+			case 'f':
+				value.WriteByte('\f')
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			case 'u':
+				if i+4 > len(source) {
+					return "", 0, errors.New("Invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(source[i:i+4], 16, 32)
+				if err != nil {
+					return "", 0, errors.New("Invalid unicode escape")
+				}
+				value.WriteRune(rune(code))
+				i += 4
+			default:
+				return "", 0, errors.New(fmt.Sprintf("Invalid escape \\%c", escaped))
+			}
+		default:
+			r, size := utf8.DecodeRuneInString(source[i:])
+			value.WriteRune(r)
+			i += size
+		}
+	}
+	return "", 0, errors.New("Unterminated string")
+}
+
+// Values in a query are parsed into plain go values (string, int64, float64, bool, nil, []interface{}
+// and map[string]interface{}), except for variables and enum values
+type gqlVariable string
+type gqlEnum string
+
+type gqlSelectionKind int
+
+const (
+	GQL_SELECTION_FIELD gqlSelectionKind = iota
+	GQL_SELECTION_FRAGMENT_SPREAD
+	GQL_SELECTION_INLINE_FRAGMENT
+)
+
+type gqlDirective struct {
+	name      string
+	arguments map[string]interface{}
+}
+
+type gqlSelection struct {
+	kind gqlSelectionKind
+	// For fields
+	alias     string
+	name      string
+	arguments map[string]interface{}
+	// For fragment spreads, the fragment's name
+	fragment string
+	// For inline fragments, the type they apply to, if they have one
+	typeCondition string
+	directives    []gqlDirective
+	selections    []*gqlSelection
+}
+
+func (s *gqlSelection) responseKey() string {
+	if len(s.alias) > 0 {
+		return s.alias
+	}
+	return s.name
+}
+
+type gqlVariableDefinition struct {
+	name         string
+	required     bool
+	defaultValue interface{}
+	hasDefault   bool
+}
+
+type gqlOperation struct {
+	kind       string
+	name       string
+	variables  []gqlVariableDefinition
+	selections []*gqlSelection
+}
+
+type gqlFragment struct {
+	name          string
+	typeCondition string
+	selections    []*gqlSelection
+}
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+	// How many brackets the parser is inside
+	nesting int
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+func (p *gqlParser) next() gqlToken {
+	token := p.tokens[p.pos]
+	if token.kind != GQL_TOKEN_EOF {
+		p.pos += 1
+	}
+	return token
+}
+func (p *gqlParser) isPunctuator(value string) bool {
+	token := p.peek()
+	return token.kind == GQL_TOKEN_PUNCTUATOR && token.value == value
+}
+func (p *gqlParser) unexpected() error {
+	token := p.peek()
+	if token.kind == GQL_TOKEN_EOF {
+		return errors.New("Unexpected end of query!")
+	}
+	return errors.New(fmt.Sprintf("Unexpected %q at %d!", token.value, token.at))
+}
+func (p *gqlParser) expectPunctuator(value string) error {
+	if !p.isPunctuator(value) {
+		return p.unexpected()
+	}
+	p.next()
+	return nil
+}
+
+// Go into a bracket, failing if that's nested too deeply. Every enter is matched by a leave.
+func (p *gqlParser) enter() error {
+	p.nesting += 1
+	if p.nesting > GRAPHQL_MAX_NESTING {
+		return errors.New(fmt.Sprintf("Queries can't nest brackets more than %d deep!", GRAPHQL_MAX_NESTING))
+	}
+	return nil
+}
+func (p *gqlParser) leave() {
+	p.nesting -= 1
+}
+func (p *gqlParser) expectName() (string, error) {
+	if p.peek().kind != GQL_TOKEN_NAME {
+		return "", p.unexpected()
+	}
+	return p.next().value, nil
+}
+
+func parseGraphQL(source string) (*gqlDocument, error) {
+	tokens, err := lexGraphQL(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	document := &gqlDocument{fragments: map[string]*gqlFragment{}}
+
+	for p.peek().kind != GQL_TOKEN_EOF {
+		token := p.peek()
+		switch {
+		case token.kind == GQL_TOKEN_PUNCTUATOR && token.value == "{":
+			// A query can be written as just a selection set
+			selections, err := p.parseSelections()
+			if err != nil {
+				return nil, err
+			}
+			document.operations = append(document.operations, &gqlOperation{kind: "query", selections: selections})
+		case token.kind == GQL_TOKEN_NAME && token.value == "fragment":
+			fragment, err := p.parseFragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := document.fragments[fragment.name]; ok {
+				return nil, errors.New(fmt.Sprintf("Fragment %s is defined more than once!", fragment.name))
+			}
+			document.fragments[fragment.name] = fragment
+		case token.kind == GQL_TOKEN_NAME && (token.value == "query" || token.value == "mutation" || token.value == "subscription"):
+			operation, err := p.parseOperation()
+			if err != nil {
+				return nil, err
+			}
+			document.operations = append(document.operations, operation)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+
+	if len(document.operations) == 0 {
+		return nil, errors.New("No operations in query!")
+	}
+	return document, nil
+}
+
+func (p *gqlParser) parseOperation() (*gqlOperation, error) {
+	operation := &gqlOperation{kind: p.next().value}
+	if p.peek().kind == GQL_TOKEN_NAME {
+		operation.name = p.next().value
+	}
+
+	if p.isPunctuator("(") {
+		p.next()
+		for !p.isPunctuator(")") {
+			if err := p.expectPunctuator("$"); err != nil {
+				return nil, err
+			}
+			name, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectPunctuator(":"); err != nil {
+				return nil, err
+			}
+			required, err := p.parseType()
+			if err != nil {
+				return nil, err
+			}
+			definition := gqlVariableDefinition{name: name, required: required}
+			if p.isPunctuator("=") {
+				p.next()
+				value, err := p.parseValue(true)
+				if err != nil {
+					return nil, err
+				}
+				definition.defaultValue = value
+				definition.hasDefault = true
+			}
+			operation.variables = append(operation.variables, definition)
+		}
+		p.next()
+	}
+
+	if _, err := p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	selections, err := p.parseSelections()
+	if err != nil {
+		return nil, err
+	}
+	operation.selections = selections
+	return operation, nil
+}
+
+// Types of variables aren't checked (arguments are checked when they're used instead), so this only
+// returns whether the type is non null
+func (p *gqlParser) parseType() (bool, error) {
+	if p.isPunctuator("[") {
+		p.next()
+		if err := p.enter(); err != nil {
+			return false, err
+		}
+		if _, err := p.parseType(); err != nil {
+			return false, err
+		}
+		if err := p.expectPunctuator("]"); err != nil {
+			return false, err
+		}
+		p.leave()
+	} else if _, err := p.expectName(); err != nil {
+		return false, err
+	}
+
+	if p.isPunctuator("!") {
+		p.next()
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *gqlParser) parseFragment() (*gqlFragment, error) {
+	p.next()
+	name, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+	if name == "on" {
+		return nil, errors.New("A fragment can't be named on!")
+	}
+	if on, err := p.expectName(); err != nil || on != "on" {
+		return nil, errors.New(fmt.Sprintf("Expected a type condition for fragment %s!", name))
+	}
+	typeCondition, err := p.expectName()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	selections, err := p.parseSelections()
+	if err != nil {
+		return nil, err
+	}
+	return &gqlFragment{name: name, typeCondition: typeCondition, selections: selections}, nil
+}
+
+func (p *gqlParser) parseSelections() ([]*gqlSelection, error) {
+	if err := p.expectPunctuator("{"); err != nil {
+		return nil, err
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	var selections []*gqlSelection
+	for !p.isPunctuator("}") {
+		selection, err := p.parseSelection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, selection)
+	}
+	p.next()
+	if len(selections) == 0 {
+		return nil, errors.New("Selection sets can't be empty!")
+	}
+	return selections, nil
+}
+
+func (p *gqlParser) parseSelection() (*gqlSelection, error) {
+	var err error
+	selection := &gqlSelection{}
+
+	if p.isPunctuator("...") {
+		p.next()
+		if p.peek().kind == GQL_TOKEN_NAME && p.peek().value != "on" {
+			selection.kind = GQL_SELECTION_FRAGMENT_SPREAD
+			selection.fragment = p.next().value
+			selection.directives, err = p.parseDirectives()
+			return selection, err
+		}
+
+		selection.kind = GQL_SELECTION_INLINE_FRAGMENT
+		if p.peek().kind == GQL_TOKEN_NAME {
+			p.next()
+			if selection.typeCondition, err = p.expectName(); err != nil {
+				return nil, err
+			}
+		}
+		if selection.directives, err = p.parseDirectives(); err != nil {
+			return nil, err
+		}
+		selection.selections, err = p.parseSelections()
+		return selection, err
+	}
+
+	selection.kind = GQL_SELECTION_FIELD
+	if selection.name, err = p.expectName(); err != nil {
+		return nil, err
+	}
+	if p.isPunctuator(":") {
+		p.next()
+		selection.alias = selection.name
+		if selection.name, err = p.expectName(); err != nil {
+			return nil, err
+		}
+	}
+	if selection.arguments, err = p.parseArguments(); err != nil {
+		return nil, err
+	}
+	if selection.directives, err = p.parseDirectives(); err != nil {
+		return nil, err
+	}
+	if p.isPunctuator("{") {
+		if selection.selections, err = p.parseSelections(); err != nil {
+			return nil, err
+		}
+	}
+	return selection, nil
+}
+
+func (p *gqlParser) parseArguments() (map[string]interface{}, error) {
+	arguments := map[string]interface{}{}
+	if !p.isPunctuator("(") {
+		return arguments, nil
+	}
+	p.next()
+	for !p.isPunctuator(")") {
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunctuator(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.parseValue(false)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := arguments[name]; ok {
+			return nil, errors.New(fmt.Sprintf("Argument %s is given more than once!", name))
+		}
+		arguments[name] = value
+	}
+	p.next()
+	return arguments, nil
+}
+
+func (p *gqlParser) parseDirectives() ([]gqlDirective, error) {
+	var directives []gqlDirective
+	for p.isPunctuator("@") {
+		p.next()
+		name, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		arguments, err := p.parseArguments()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, gqlDirective{name: name, arguments: arguments})
+	}
+	return directives, nil
+}
+
+// Default values of variables have to be constant, so they can't use other variables
+func (p *gqlParser) parseValue(constant bool) (interface{}, error) {
+	token := p.peek()
+	switch token.kind {
+	case GQL_TOKEN_INT:
+		p.next()
+		value, err := strconv.ParseInt(token.value, 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid int %s at %d!", token.value, token.at))
+		}
+		return value, nil
+	case GQL_TOKEN_FLOAT:
+		p.next()
+		value, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid float %s at %d!", token.value, token.at))
+		}
+		return value, nil
+	case GQL_TOKEN_STRING:
+		p.next()
+		return token.value, nil
+	case GQL_TOKEN_NAME:
+		p.next()
+		switch token.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		default:
+			return gqlEnum(token.value), nil
+		}
+	case GQL_TOKEN_PUNCTUATOR:
+		switch token.value {
+		case "$":
+			if constant {
+				return nil, errors.New(fmt.Sprintf("Variables can't be used at %d!", token.at))
+			}
+			p.next()
+			name, err := p.expectName()
+			if err != nil {
+				return nil, err
+			}
+			return gqlVariable(name), nil
+		case "[":
+			p.next()
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			list := []interface{}{}
+			for !p.isPunctuator("]") {
+				value, err := p.parseValue(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, value)
+			}
+			p.next()
+			return list, nil
+		case "{":
+			p.next()
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			object := map[string]interface{}{}
+			for !p.isPunctuator("}") {
+				name, err := p.expectName()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expectPunctuator(":"); err != nil {
+					return nil, err
+				}
+				value, err := p.parseValue(constant)
+				if err != nil {
+					return nil, err
+				}
+				object[name] = value
+			}
+			p.next()
+			return object, nil
+		}
+	}
+	return nil, p.unexpected()
+}
+
+// An object in a response, which keeps its fields in the order they were asked for
+type gqlObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (o *gqlObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var builder strings.Builder
+	builder.WriteByte('{')
+	for index, key := range o.keys {
+		if index > 0 {
+			builder.WriteByte(',')
+		}
+		keyBytes, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		valueBytes, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		builder.Write(keyBytes)
+		builder.WriteByte(':')
+		builder.Write(valueBytes)
+	}
+	builder.WriteByte('}')
+	return []byte(builder.String()), nil
+}
+
+type GraphQLError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+type GraphQLResponse struct {
+	Data   interface{}    `json:"data,omitempty"`
+	Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+type gqlExecution struct {
+	schema    *GraphQLSchema
+	fragments map[string]*gqlFragment
+	variables map[string]interface{}
+	errors    []GraphQLError
+	cost      int
+	// The deepest each fragment has been validated at, since it's valid anywhere shallower too
+	validated map[string]int
+}
+
+// Run a query. Errors parsing or validating it are returned as an error, while errors resolving
+// fields are in the response alongside the fields that did resolve.
+func (s *GraphQLSchema) Execute(query string, variables map[string]interface{}, operationName string) (GraphQLResponse, error) {
+	document, err := parseGraphQL(query)
+	if err != nil {
+		return GraphQLResponse{}, err
+	}
+
+	var operation *gqlOperation
+	for _, candidate := range document.operations {
+		if candidate.name == operationName || (len(operationName) == 0 && len(document.operations) == 1) {
+			operation = candidate
+			break
+		}
+	}
+	if operation == nil {
+		if len(operationName) == 0 {
+			return GraphQLResponse{}, errors.New("operationName is required when a query has more than one operation!")
+		}
+		return GraphQLResponse{}, errors.New(fmt.Sprintf("No operation named %s!", operationName))
+	}
+	if operation.kind != "query" {
+		return GraphQLResponse{}, errors.New(fmt.Sprintf("Only queries are supported, not %ss!", operation.kind))
+	}
+
+	// Work out the value of every variable, from what was passed or its default
+	values := map[string]interface{}{}
+	for _, definition := range operation.variables {
+		if value, ok := variables[definition.name]; ok && value != nil {
+			values[definition.name] = value
+		} else if definition.hasDefault {
+			values[definition.name] = definition.defaultValue
+		} else if definition.required {
+			return GraphQLResponse{}, errors.New(fmt.Sprintf("Variable $%s is required!", definition.name))
+		}
+	}
+
+	execution := &gqlExecution{schema: s, fragments: document.fragments, variables: values, validated: map[string]int{}}
+	if err := execution.validate(GRAPHQL_QUERY_TYPE, operation.selections, 1, map[string]bool{}); err != nil {
+		return GraphQLResponse{}, err
+	}
+	data := execution.executeSelections(GRAPHQL_QUERY_TYPE, nil, operation.selections, []interface{}{})
+	return GraphQLResponse{Data: data, Errors: execution.errors}, nil
+}
+
+// Check the selections against the schema before running anything, so a query with a typo fails
+// without doing any work. spreading holds the fragments being checked, to catch ones that include
+// themselves.
+func (e *gqlExecution) validate(typeName string, selections []*gqlSelection, depth int, spreading map[string]bool) error {
+	if depth > GRAPHQL_MAX_DEPTH {
+		return errors.New(fmt.Sprintf("Queries can't be nested more than %d deep!", GRAPHQL_MAX_DEPTH))
+	}
+	fields := e.schema.types[typeName]
+
+	for _, selection := range selections {
+		for _, directive := range selection.directives {
+			if directive.name != "skip" && directive.name != "include" {
+				return errors.New(fmt.Sprintf("Unknown directive @%s!", directive.name))
+			}
+		}
+
+		switch selection.kind {
+		case GQL_SELECTION_FRAGMENT_SPREAD:
+			fragment, ok := e.fragments[selection.fragment]
+			if !ok {
+				return errors.New(fmt.Sprintf("Unknown fragment %s!", selection.fragment))
+			}
+			if spreading[fragment.name] {
+				return errors.New(fmt.Sprintf("Fragment %s includes itself!", fragment.name))
+			}
+			// A fragment spread many times is only checked again when it's used deeper than before,
+			// so fragments spreading each other can't make this take exponentially long
+			if validatedAt, ok := e.validated[fragment.name]; ok && validatedAt >= depth {
+				continue
+			}
+			if err := e.validateTypeCondition(typeName, fragment.typeCondition); err != nil {
+				return err
+			}
+			spreading[fragment.name] = true
+			err := e.validate(typeName, fragment.selections, depth, spreading)
+			delete(spreading, fragment.name)
+			if err != nil {
+				return err
+			}
+			e.validated[fragment.name] = depth
+
+		case GQL_SELECTION_INLINE_FRAGMENT:
+			if len(selection.typeCondition) > 0 {
+				if err := e.validateTypeCondition(typeName, selection.typeCondition); err != nil {
+					return err
+				}
+			}
+			if err := e.validate(typeName, selection.selections, depth, spreading); err != nil {
+				return err
+			}
+
+		case GQL_SELECTION_FIELD:
+			if selection.name == "__typename" {
+				if len(selection.selections) > 0 {
+					return errors.New("__typename can't have a selection!")
+				}
+				continue
+			}
+			field, ok := fields[selection.name]
+			if !ok {
+				return errors.New(fmt.Sprintf("%s has no field %s!", typeName, selection.name))
+			}
+			for argument := range selection.arguments {
+				if !field.hasArgument(argument) {
+					return errors.New(fmt.Sprintf("%s.%s has no argument %s!", typeName, selection.name, argument))
+				}
+			}
+			_, isObject := e.schema.types[field.typ]
+			if isObject && len(selection.selections) == 0 {
+				return errors.New(fmt.Sprintf("%s.%s is a %s, so it needs a selection!", typeName, selection.name, field.typ))
+			}
+			if !isObject && len(selection.selections) > 0 {
+				return errors.New(fmt.Sprintf("%s.%s is a %s, so it can't have a selection!", typeName, selection.name, field.typ))
+			}
+			if isObject {
+				if err := e.validate(field.typ, selection.selections, depth+1, spreading); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// There are no interfaces or unions, so a fragment has to be on the exact type it's used in
+func (e *gqlExecution) validateTypeCondition(typeName string, typeCondition string) error {
+	if _, ok := e.schema.types[typeCondition]; !ok {
+		return errors.New(fmt.Sprintf("Unknown type %s!", typeCondition))
+	}
+	if typeCondition != typeName {
+		return errors.New(fmt.Sprintf("A fragment on %s can't be used on %s!", typeCondition, typeName))
+	}
+	return nil
+}
+
+// Replace variables in a value with what they were set to. ok is false if the value is a variable
+// that wasn't given, in which case the argument is left out.
+func (e *gqlExecution) resolveValue(value interface{}) (interface{}, bool) {
+	switch typed := value.(type) {
+	case gqlVariable:
+		resolved, ok := e.variables[string(typed)]
+		return resolved, ok
+	case []interface{}:
+		list := []interface{}{}
+		for _, item := range typed {
+			resolved, _ := e.resolveValue(item)
+			list = append(list, resolved)
+		}
+		return list, true
+	case map[string]interface{}:
+		object := map[string]interface{}{}
+		for key, item := range typed {
+			if resolved, ok := e.resolveValue(item); ok {
+				object[key] = resolved
+			}
+		}
+		return object, true
+	default:
+		return value, true
+	}
+}
+
+func (e *gqlExecution) resolveArguments(arguments map[string]interface{}) map[string]interface{} {
+	resolved := map[string]interface{}{}
+	for name, value := range arguments {
+		if value, ok := e.resolveValue(value); ok {
+			resolved[name] = value
+		}
+	}
+	return resolved
+}
+
+// Whether @skip or @include leave a selection out
+func (e *gqlExecution) included(selection *gqlSelection) (bool, error) {
+	for _, directive := range selection.directives {
+		condition, ok, err := gqlBooleanArgument(e.resolveArguments(directive.arguments), "if")
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			return false, errors.New(fmt.Sprintf("@%s needs an if argument!", directive.name))
+		}
+		if (directive.name == "skip" && condition) || (directive.name == "include" && !condition) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Flatten fragments into the fields they select, grouped by the key each will have in the response.
+// Fields asked for more than once under the same key are resolved once, with their selections merged,
+// and a fragment spread more than once is only collected once.
+func (e *gqlExecution) collectFields(selections []*gqlSelection, keys *[]string, fields map[string][]*gqlSelection, spread map[string]bool, path []interface{}) {
+	for _, selection := range selections {
+		include, err := e.included(selection)
+		if err != nil {
+			e.errors = append(e.errors, GraphQLError{Message: err.Error(), Path: path})
+			continue
+		}
+		if !include {
+			continue
+		}
+
+		switch selection.kind {
+		case GQL_SELECTION_FIELD:
+			key := selection.responseKey()
+			if _, ok := fields[key]; !ok {
+				*keys = append(*keys, key)
+			}
+			fields[key] = append(fields[key], selection)
+		case GQL_SELECTION_FRAGMENT_SPREAD:
+			if spread[selection.fragment] {
+				continue
+			}
+			spread[selection.fragment] = true
+			e.collectFields(e.fragments[selection.fragment].selections, keys, fields, spread, path)
+		case GQL_SELECTION_INLINE_FRAGMENT:
+			e.collectFields(selection.selections, keys, fields, spread, path)
+		}
+	}
+}
+
+func (e *gqlExecution) executeSelections(typeName string, source interface{}, selections []*gqlSelection, path []interface{}) *gqlObject {
+	var keys []string
+	fields := map[string][]*gqlSelection{}
+	e.collectFields(selections, &keys, fields, map[string]bool{}, path)
+
+	object := &gqlObject{values: map[string]interface{}{}}
+	for _, key := range keys {
+		selection := fields[key][0]
+		fieldPath := append(append([]interface{}{}, path...), key)
+
+		if selection.name == "__typename" {
+			object.set(key, typeName)
+			continue
+		}
+
+		field := e.schema.types[typeName][selection.name]
+		if !e.charge(1+field.cost, fieldPath) {
+			object.set(key, nil)
+			continue
+		}
+		value, err := field.resolve(source, e.resolveArguments(selection.arguments))
+		if err != nil {
+			e.errors = append(e.errors, GraphQLError{Message: err.Error(), Path: fieldPath})
+			object.set(key, nil)
+			continue
+		}
+
+		var subselections []*gqlSelection
+		for _, merged := range fields[key] {
+			subselections = append(subselections, merged.selections...)
+		}
+		object.set(key, e.completeValue(field, value, subselections, fieldPath))
+	}
+	return object
+}
+
+// Add to what the query has cost, returning false once it's over GRAPHQL_MAX_COST, in which case
+// whatever was being resolved is left null
+func (e *gqlExecution) charge(cost int, path []interface{}) bool {
+	overBefore := e.cost > GRAPHQL_MAX_COST
+	e.cost += cost
+	if e.cost <= GRAPHQL_MAX_COST {
+		return true
+	}
+	// Only the first thing over the limit gets an error, rather than every field after it
+	if !overBefore {
+		e.errors = append(e.errors, GraphQLError{Message: fmt.Sprintf("Query costs more than %d!", GRAPHQL_MAX_COST), Path: path})
+	}
+	return false
+}
+
+// Turn what a resolver returned into what goes in the response, resolving the selections on objects
+func (e *gqlExecution) completeValue(field gqlFieldDefinition, value interface{}, selections []*gqlSelection, path []interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	_, isObject := e.schema.types[field.typ]
+
+	if field.list {
+		items := value.([]interface{})
+		if !e.charge(len(items), path) {
+			return nil
+		}
+		completed := make([]interface{}, 0, len(items))
+		for index, item := range items {
+			if isObject && item != nil {
+				itemPath := append(append([]interface{}{}, path...), index)
+				completed = append(completed, e.executeSelections(field.typ, item, selections, itemPath))
+			} else {
+				completed = append(completed, item)
+			}
+		}
+		return completed
+	}
+	if isObject {
+		return e.executeSelections(field.typ, value, selections, path)
+	}
+	return value
+}
+
+func respondGraphQLError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	render.Status(r, status)
+	render.JSON(w, r, GraphQLResponse{Errors: []GraphQLError{{Message: err.Error()}}})
+}
+
+// Handle `/graphql`. Queries can be POSTed as json ({"query": "...", "variables": {...},
+// "operationName": "..."}) or as the query alone with a Content-Type of application/graphql, or sent
+// with GET as `?query=...&variables=...`.
+func (s *GraphQLSchema) Serve(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Query         string                 `json:"query"`
+		Variables     map[string]interface{} `json:"variables"`
+		OperationName string                 `json:"operationName"`
+	}
+
+	if r.Method == http.MethodGet {
+		request.Query = r.URL.Query().Get("query")
+		request.OperationName = r.URL.Query().Get("operationName")
+		if raw := r.URL.Query().Get("variables"); len(raw) > 0 {
+			if err := json.Unmarshal([]byte(raw), &request.Variables); err != nil {
+				respondGraphQLError(w, r, http.StatusBadRequest, errors.New("Error parsing variables!"))
+				return
+			}
+		}
+	} else {
+		byt, ok := readBody(w, r, API_MAX_GRAPHQL_BODY_SIZE)
+		if !ok {
+			return
+		}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/graphql") {
+			request.Query = string(byt)
+		} else if err := json.Unmarshal(byt, &request); err != nil {
+			respondGraphQLError(w, r, http.StatusBadRequest, errors.New("Error parsing body!"))
+			return
+		}
+	}
+	if len(request.Query) == 0 {
+		respondGraphQLError(w, r, http.StatusBadRequest, errors.New("query is required!"))
+		return
+	}
+
+	response, err := s.Execute(request.Query, request.Variables, request.OperationName)
+	if err != nil {
+		respondGraphQLError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	render.JSON(w, r, response)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A schema over plain ints, so the executor can be tested without a chain:
+//
+//	type Query { echo(value: String): String, number(value: Int): Int, item: Item, items(count: Int): [Item] }
+//	type Item { index: Int, next: Item, items(count: Int): [Item], expensive: Int }
+func newTestGraphQLSchema() *GraphQLSchema {
+	items := func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+		count, ok, err := gqlIntArgument(arguments, "count")
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			count = 2
+		}
+		list := []interface{}{}
+		for index := int64(0); index < count; index += 1 {
+			list = append(list, int(index))
+		}
+		return list, nil
+	}
+
+	query := map[string]gqlFieldDefinition{
+		"echo": {typ: "String", arguments: []string{"value"}, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			value, _, err := gqlStringArgument(arguments, "value")
+			return value, err
+		}},
+		"number": {typ: "Int", arguments: []string{"value"}, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			value, ok, err := gqlIntArgument(arguments, "value")
+			if err != nil || !ok {
+				return nil, err
+			}
+			return value, nil
+		}},
+		"item": {typ: "Item", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return 0, nil
+		}},
+		"items": {typ: "Item", list: true, arguments: []string{"count"}, resolve: items},
+	}
+	item := map[string]gqlFieldDefinition{
+		"index": {typ: "Int", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return source.(int), nil
+		}},
+		"next": {typ: "Item", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return source.(int) + 1, nil
+		}},
+		"items": {typ: "Item", list: true, arguments: []string{"count"}, resolve: items},
+		"expensive": {typ: "Int", cost: GRAPHQL_LOOKUP_COST, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return source.(int), nil
+		}},
+	}
+	return &GraphQLSchema{types: map[string]map[string]gqlFieldDefinition{
+		GRAPHQL_QUERY_TYPE: query,
+		"Item":             item,
+	}}
+}
+
+// Run a query, returning the response as json
+func executeTestGraphQL(t *testing.T, schema *GraphQLSchema, query string, variables map[string]interface{}) (string, []GraphQLError) {
+	response, err := schema.Execute(query, variables, "")
+	if err != nil {
+		t.Fatalf("Error running %q! %s", query, err)
+	}
+	byt, err := json.Marshal(response.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(byt), response.Errors
+}
+
+func TestGraphQLLex(t *testing.T) {
+	tokens, err := lexGraphQL("\uFEFF{ a(b: -12, c: 1.5e3, d: \"x\\n\\\"y\\u0041\", e: \"\"\"raw \\n\"\"\") # comment\n ...F }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, token := range tokens {
+		values = append(values, token.value)
+	}
+	expected := []string{"{", "a", "(", "b", ":", "-12", "c", ":", "1.5e3", "d", ":", "x\n\"yA", "e", ":", "raw \\n", ")", "...", "F", "}", ""}
+	if strings.Join(values, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Expected tokens %q, got %q!", expected, values)
+	}
+	if tokens[5].kind != GQL_TOKEN_INT || tokens[8].kind != GQL_TOKEN_FLOAT || tokens[11].kind != GQL_TOKEN_STRING {
+		t.Errorf("Numbers and strings were lexed as the wrong kinds!")
+	}
+}
+
+func TestGraphQLParseErrors(t *testing.T) {
+	queries := []string{
+		"",
+		"# only a comment",
+		"{",
+		"{ a",
+		"{ }",
+		"{ a } }",
+		"{ a(b: ) }",
+		"{ a(b: 1 b: 2) }",
+		"{ a(b: \"unterminated) }",
+		"{ a(b: \"line\nbreak\") }",
+		"{ a(b: \"\\q\") }",
+		"{ a(b: \"\\u12\") }",
+		"{ a(b: \"\"\"unterminated) }",
+		"{ a(b: 99999999999999999999) }",
+		"{ a @ }",
+		"{ a: }",
+		"{ ... }",
+		"{ a } %",
+		"query ($a: ) { a }",
+		"query ($a: Int = $b) { a }",
+		"query ($a: [Int) { a }",
+		"fragment on on Item { index }",
+		"fragment F Item { index }",
+		"fragment F on Item { index } fragment F on Item { index } { item { ...F } }",
+		"fragment F on Item { index }",
+		"nonsense { a }",
+	}
+	for _, query := range queries {
+		if _, err := parseGraphQL(query); err == nil {
+			t.Errorf("Expected %q to fail to parse!", query)
+		}
+	}
+}
+
+func TestGraphQLParseNesting(t *testing.T) {
+	nested := func(open string, inner string, close string, depth int) string {
+		return strings.Repeat(open, depth) + inner + strings.Repeat(close, depth)
+	}
+
+	// Within the limit is fine, whatever the brackets are
+	within := []string{
+		"{" + nested("a {", "b", "}", GRAPHQL_MAX_NESTING-1) + "}",
+		"{ a(b: " + nested("[", "1", "]", GRAPHQL_MAX_NESTING-1) + ") }",
+		"{ a(b: " + nested("{c: ", "1", "}", GRAPHQL_MAX_NESTING-1) + ") }",
+		"query ($a: " + nested("[", "Int", "]", GRAPHQL_MAX_NESTING) + ") { a }",
+	}
+	for _, query := range within {
+		if _, err := parseGraphQL(query); err != nil {
+			t.Errorf("Expected a query nested %d deep to parse! %s", GRAPHQL_MAX_NESTING, err)
+		}
+	}
+
+	// Past it fails without going any deeper, even when the query is far too deep to recurse through
+	for _, depth := range []int{GRAPHQL_MAX_NESTING + 1, 100000} {
+		tooDeep := []string{
+			"{" + nested("a {", "b", "}", depth) + "}",
+			"{ a(b: " + nested("[", "1", "]", depth) + ") }",
+			"{ a(b: " + nested("{c: ", "1", "}", depth) + ") }",
+			"query ($a: " + nested("[", "Int", "]", depth+1) + ") { a }",
+			"{" + nested("... {", "b", "}", depth) + "}",
+		}
+		for _, query := range tooDeep {
+			_, err := parseGraphQL(query)
+			if err == nil || !strings.Contains(err.Error(), "nest") {
+				t.Errorf("Expected a query nested %d deep to fail to parse, got %v!", depth, err)
+			}
+		}
+	}
+}
+
+func TestGraphQLExecute(t *testing.T) {
+	schema := newTestGraphQLSchema()
+	cases := []struct {
+		query     string
+		variables map[string]interface{}
+		expected  string
+	}{
+		{`{ echo(value: "hi") number(value: 3) }`, nil, `{"echo":"hi","number":3}`},
+		// Fields keep the order they were asked for, under their aliases
+		{`{ b: number(value: 2) a: number(value: 1) }`, nil, `{"b":2,"a":1}`},
+		{`{ item { __typename index next { index } } }`, nil, `{"item":{"__typename":"Item","index":0,"next":{"index":1}}}`},
+		// The same field asked for twice is resolved once, with the selections merged
+		{`{ item { index } item { next { index } } }`, nil, `{"item":{"index":0,"next":{"index":1}}}`},
+		{`{ items(count: 3) { index } }`, nil, `{"items":[{"index":0},{"index":1},{"index":2}]}`},
+		{`{ items(count: 0) { index } }`, nil, `{"items":[]}`},
+		{`{ item { ...Index ... on Item { next { ...Index } } } } fragment Index on Item { index }`, nil, `{"item":{"index":0,"next":{"index":1}}}`},
+		{`{ item { ... { index } } }`, nil, `{"item":{"index":0}}`},
+		{`query Q($value: String) { echo(value: $value) }`, map[string]interface{}{"value": "from a variable"}, `{"echo":"from a variable"}`},
+		// Ints in variables come from json as floats
+		{`query ($value: Int) { number(value: $value) }`, map[string]interface{}{"value": float64(7)}, `{"number":7}`},
+		{`query ($value: Int = 5) { number(value: $value) }`, nil, `{"number":5}`},
+		{`query ($value: Int = 5) { number(value: $value) }`, map[string]interface{}{"value": float64(6)}, `{"number":6}`},
+		// A variable that isn't given leaves its argument out
+		{`query ($value: Int) { number(value: $value) }`, nil, `{"number":null}`},
+		{`query ($skip: Boolean!) { a: number(value: 1) @skip(if: $skip) b: number(value: 2) @include(if: $skip) }`, map[string]interface{}{"skip": true}, `{"b":2}`},
+		{`query ($skip: Boolean!) { a: number(value: 1) @skip(if: $skip) b: number(value: 2) @include(if: $skip) }`, map[string]interface{}{"skip": false}, `{"a":1}`},
+		{`{ item { ...Index @skip(if: true) next { index } } } fragment Index on Item { index }`, nil, `{"item":{"next":{"index":1}}}`},
+	}
+	for _, c := range cases {
+		data, errs := executeTestGraphQL(t, schema, c.query, c.variables)
+		if len(errs) > 0 {
+			t.Errorf("Unexpected errors running %q! %v", c.query, errs)
+		}
+		if data != c.expected {
+			t.Errorf("Expected %q to return %s, got %s!", c.query, c.expected, data)
+		}
+	}
+}
+
+// Errors resolving a field come back alongside the fields that did resolve
+func TestGraphQLFieldErrors(t *testing.T) {
+	schema := newTestGraphQLSchema()
+	data, errs := executeTestGraphQL(t, schema, `{ a: number(value: "not an int") b: number(value: 2) }`, nil)
+	if data != `{"a":null,"b":2}` {
+		t.Errorf("Expected the other field to resolve, got %s!", data)
+	}
+	if len(errs) != 1 || len(errs[0].Path) != 1 || errs[0].Path[0] != "a" {
+		t.Errorf("Expected one error at a, got %v!", errs)
+	}
+
+	_, errs = executeTestGraphQL(t, schema, `query ($if: Boolean) { number(value: 1) @skip(if: $if) }`, map[string]interface{}{"if": "yes"})
+	if len(errs) != 1 {
+		t.Errorf("Expected an error for a directive with a string condition, got %v!", errs)
+	}
+}
+
+func TestGraphQLInvalidQueries(t *testing.T) {
+	schema := newTestGraphQLSchema()
+	queries := map[string]string{
+		"unknown field":             `{ missing }`,
+		"unknown argument":          `{ echo(other: "x") }`,
+		"object without selection":  `{ item }`,
+		"scalar with selection":     `{ echo { index } }`,
+		"typename with selection":   `{ __typename { index } }`,
+		"unknown fragment":          `{ item { ...Missing } }`,
+		"unknown type condition":    `{ item { ... on Missing { index } } }`,
+		"wrong type condition":      `{ ...Index } fragment Index on Item { index }`,
+		"unknown directive":         `{ echo(value: "x") @defer }`,
+		"fragment including itself": `{ item { ...Loop } } fragment Loop on Item { index ...Loop }`,
+		"fragments including each other": `{ item { ...A } }
+			fragment A on Item { index next { ...B } }
+			fragment B on Item { index next { ...A } }`,
+		"mutation":                  `mutation { echo(value: "x") }`,
+		"subscription":              `subscription { echo(value: "x") }`,
+		"several operations":        `query A { echo(value: "a") } query B { echo(value: "b") }`,
+		"missing required var":      `query ($value: String!) { echo(value: $value) }`,
+		"too deep":                  "{ item {" + strings.Repeat(" next {", GRAPHQL_MAX_DEPTH) + " index" + strings.Repeat(" }", GRAPHQL_MAX_DEPTH) + " } }",
+		"too deep through fragment": "{ item { ...Deep } } fragment Deep on Item {" + strings.Repeat(" next {", GRAPHQL_MAX_DEPTH) + " index" + strings.Repeat(" }", GRAPHQL_MAX_DEPTH) + " }",
+	}
+	for name, query := range queries {
+		if _, err := schema.Execute(query, nil, ""); err == nil {
+			t.Errorf("Expected the %s query to be rejected!", name)
+		}
+	}
+
+	// A fragment that was fine where it was first used is still checked when it's used deeper
+	deep := "{ item { ...Deep" + strings.Repeat(" next {", GRAPHQL_MAX_DEPTH-2) + " ...Deep" + strings.Repeat(" }", GRAPHQL_MAX_DEPTH-2) + " } } fragment Deep on Item { next { index } }"
+	if _, err := schema.Execute(deep, nil, ""); err == nil {
+		t.Errorf("Expected a fragment used too deep to be rejected!")
+	}
+
+	// Naming the operation picks one out
+	response, err := schema.Execute(`query A { echo(value: "a") } query B { echo(value: "b") }`, nil, "B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byt, _ := json.Marshal(response.Data); string(byt) != `{"echo":"b"}` {
+		t.Errorf("Expected operation B to run, got %s!", byt)
+	}
+	if _, err := schema.Execute(`query A { echo(value: "a") }`, nil, "C"); err == nil {
+		t.Errorf("Expected an unknown operation name to be rejected!")
+	}
+}
+
+// Fragments that each spread the next one twice would expand exponentially if they were walked every
+// time they're spread
+func TestGraphQLFragmentFanOut(t *testing.T) {
+	schema := newTestGraphQLSchema()
+	var query strings.Builder
+	query.WriteString("{ item { ...F0 } }")
+	const fragments = 40
+	for index := 0; index < fragments; index += 1 {
+		if index == fragments-1 {
+			fmt.Fprintf(&query, " fragment F%d on Item { index }", index)
+		} else {
+			fmt.Fprintf(&query, " fragment F%d on Item { ...F%d ...F%d }", index, index+1, index+1)
+		}
+	}
+
+	done := make(chan struct{})
+	var data string
+	var errs []GraphQLError
+	go func() {
+		data, errs = executeTestGraphQL(t, schema, query.String(), nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Fragments spreading each other took too long to run!")
+	}
+	if len(errs) > 0 || data != `{"item":{"index":0}}` {
+		t.Errorf("Expected the fragments to resolve to one field, got %s %v!", data, errs)
+	}
+}
+
+func TestGraphQLCostLimit(t *testing.T) {
+	schema := newTestGraphQLSchema()
+
+	// 100 items with 100 items each, with a lookup on each, costs well over the limit
+	data, errs := executeTestGraphQL(t, schema, `{ items(count: 100) { items(count: 100) { expensive } } }`, nil)
+	if len(errs) != 1 || !strings.Contains(errs[0].Message, "costs more than") {
+		t.Fatalf("Expected a single error for going over the cost limit, got %v!", errs)
+	}
+	if !strings.Contains(data, `"expensive":null`) {
+		t.Errorf("Expected fields past the limit to be null!")
+	}
+	if !strings.Contains(data, `"expensive":0`) {
+		t.Errorf("Expected fields before the limit to resolve!")
+	}
+
+	// A list longer than what's left of the budget is left out altogether
+	_, errs = executeTestGraphQL(t, schema, fmt.Sprintf(`{ items(count: %d) { index } }`, GRAPHQL_MAX_COST), nil)
+	if len(errs) != 1 {
+		t.Errorf("Expected a list over the cost limit to fail, got %v!", errs)
+	}
+
+	// Cheaper queries are fine
+	_, errs = executeTestGraphQL(t, schema, `{ items(count: 100) { items(count: 10) { expensive } } }`, nil)
+	if len(errs) > 0 {
+		t.Errorf("Expected a query under the cost limit to run, got %v!", errs)
+	}
+}
+
+// Address fields are looked up in the chain's indexes rather than walking it
+func TestGraphQLAddressTransactions(t *testing.T) {
+	nodeKey, err := LoadOrCreateNodeKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := NewMemoryNetwork(NewSeededEntropy(1))
+	node := NewNode(NodeConfig{Address: "mem://graphql", Clock: SystemClock, Entropy: NewSeededEntropy(1)}, nodeKey, network.Transport)
+	network.Join(node)
+	if err := node.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, err := NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := (*PublicKey)(&privateKey.PublicKey).Address()
+	for block := 0; block < 3; block += 1 {
+		for index := 0; index < 2; index += 1 {
+			transaction := NewTransaction(privateKey, 0, []byte(fmt.Sprintf("transaction %d in block %d", index, block)), NewSeededEntropy(int64(block*2+index)))
+			transaction.Nonce = node.NextNonce(sender)
+			if err := transaction.Sign(); err != nil {
+				t.Fatal(err)
+			}
+			if err := node.ReceiveTransaction(transaction, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if node.MineBlock() == nil {
+			t.Fatal("Expected a block to be mined!")
+		}
+	}
+
+	schema := NewGraphQLSchema(node)
+	query := fmt.Sprintf(`{ address(address: %q) { nonce transactionCount transactions(limit: 3) { nonce pending block { height } } } block(height: 2) { height transactionCount } }`, sender)
+	data, errs := executeTestGraphQL(t, schema, query, nil)
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected errors! %v", errs)
+	}
+	expected := `{"address":{"nonce":6,"transactionCount":6,"transactions":[` +
+		`{"nonce":5,"pending":false,"block":{"height":3}},` +
+		`{"nonce":4,"pending":false,"block":{"height":3}},` +
+		`{"nonce":3,"pending":false,"block":{"height":2}}]},` +
+		`"block":{"height":2,"transactionCount":2}}`
+	if data != expected {
+		t.Errorf("Expected %s, got %s!", expected, data)
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"math"
+	"time"
+)
+
+// The types served from `/graphql`:
+//
+//	type Query {
+//	  tip: Block
+//	  block(hash: String, height: Int): Block
+//	  blocks(fromHeight: Int, limit: Int): [Block]
+//	  transaction(id: String!): Transaction
+//	  address(address: String!): Address
+//	  appendages: [Appendage]
+//	  mempool: MemPool
+//	  peers: [Peer]
+//	}
+//	type Block {
+//	  hash: String, previousHash: String, previous: Block, height: Int, createdAt: String,
+//	  number: Int, size: Int, transactionCount: Int, transactions: [Transaction]
+//	}
+//	type Transaction {
+//	  id: String, sender: Address, cost: Int, nonce: Int, validAfter: Int, validUntil: Int,
+//	  data: String, dataEncoding: String, signature: String, signatureValid: Boolean, size: Int,
+//	  pending: Boolean, block: Block
+//	}
+//	type Address {
+//	  address: String, nonce: Int, transactionCount: Int, transactions(limit: Int): [Transaction],
+//	  pendingTransactions: [Transaction]
+//	}
+//	type Appendage { primary: Boolean, length: Int, updatedAt: String, head: Block, genesis: Block }
+//	type MemPool { size: Int, transactions: [Transaction] }
+//	type Peer { id: String, address: String }
+const GRAPHQL_QUERY_TYPE = "Query"
+
+type gqlResolver func(source interface{}, arguments map[string]interface{}) (interface{}, error)
+
+type gqlFieldDefinition struct {
+	// Either the name of an object type, or of a scalar (String, Int, Float or Boolean)
+	typ       string
+	list      bool
+	arguments []string
+	resolve   gqlResolver
+	// What resolving the field costs on top of one, see GRAPHQL_MAX_COST
+	cost int
+}
+
+func (f gqlFieldDefinition) hasArgument(name string) bool {
+	for _, argument := range f.arguments {
+		if argument == name {
+			return true
+		}
+	}
+	return false
+}
+
+type GraphQLSchema struct {
+	types map[string]map[string]gqlFieldDefinition
+}
+
+// A transaction, along with the block it's in if it isn't still in the mempool. Its view is worked
+// out when a field first needs it, since that means checking the signature.
+type gqlTransaction struct {
+	transaction *Transaction
+	block       *Block
+	view        *TransactionView
+}
+
+func (t *gqlTransaction) View() (*TransactionView, error) {
+	if t.view == nil {
+		view, err := NewTransactionView(t.transaction)
+		if err != nil {
+			return nil, err
+		}
+		t.view = &view
+	}
+	return t.view, nil
+}
+
+func gqlStringArgument(arguments map[string]interface{}, name string) (string, bool, error) {
+	value, ok := arguments[name]
+	if !ok || value == nil {
+		return "", false, nil
+	}
+	typed, ok := value.(string)
+	if !ok {
+		return "", false, errors.New(fmt.Sprintf("%s must be a string!", name))
+	}
+	return typed, true, nil
+}
+
+// Ints from the query itself are parsed as int64, while ones in variables come from json as float64
+func gqlIntArgument(arguments map[string]interface{}, name string) (int64, bool, error) {
+	value, ok := arguments[name]
+	if !ok || value == nil {
+		return 0, false, nil
+	}
+	switch typed := value.(type) {
+	case int64:
+		return typed, true, nil
+	case float64:
+		if typed == math.Trunc(typed) && math.Abs(typed) < (1<<53) {
+			return int64(typed), true, nil
+		}
+	}
+	return 0, false, errors.New(fmt.Sprintf("%s must be an int!", name))
+}
+
+func gqlBooleanArgument(arguments map[string]interface{}, name string) (bool, bool, error) {
+	value, ok := arguments[name]
+	if !ok || value == nil {
+		return false, false, nil
+	}
+	typed, ok := value.(bool)
+	if !ok {
+		return false, false, errors.New(fmt.Sprintf("%s must be a boolean!", name))
+	}
+	return typed, true, nil
+}
+
+func gqlLimitArgument(arguments map[string]interface{}) (int, error) {
+	limit, ok, err := gqlIntArgument(arguments, "limit")
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return EXPLORER_DEFAULT_PAGE_SIZE, nil
+	}
+	if limit < 1 {
+		return 0, errors.New("limit must be at least 1!")
+	}
+	if limit > EXPLORER_MAX_PAGE_SIZE {
+		return EXPLORER_MAX_PAGE_SIZE, nil
+	}
+	return int(limit), nil
+}
+
+// Things that can't be found resolve to null rather than an error
+func gqlNullIfNotFound(err error) (interface{}, error) {
+	var apiError APIError
+	if errors.As(err, &apiError) && apiError.Code == ERROR_CODE_NOT_FOUND {
+		return nil, nil
+	}
+	return nil, err
+}
+
+func gqlTransactionsOf(transactions []*Transaction, block *Block) []interface{} {
+	list := []interface{}{}
+	for _, transaction := range transactions {
+		list = append(list, &gqlTransaction{transaction: transaction, block: block})
+	}
+	return list
+}
+
+// A resolver for a scalar field on a transaction's view
+func gqlTransactionViewField(field func(view *TransactionView) interface{}) gqlResolver {
+	return func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+		view, err := source.(*gqlTransaction).View()
+		if err != nil {
+			return nil, err
+		}
+		return field(view), nil
+	}
+}
+
+func NewGraphQLSchema(node *Node) *GraphQLSchema {
+	chain := node.chain
+	memPool := node.memPool
+	peerSet := node.peerSet
+
+	query := map[string]gqlFieldDefinition{
+		"tip": {typ: "Block", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			tip, err := findTip(chain)
+			if err != nil {
+				return gqlNullIfNotFound(err)
+			}
+			return tip, nil
+		}},
+
+		"block": {typ: "Block", arguments: []string{"hash", "height"}, cost: GRAPHQL_LOOKUP_COST, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			hash, hasHash, err := gqlStringArgument(arguments, "hash")
+			if err != nil {
+				return nil, err
+			}
+			height, hasHeight, err := gqlIntArgument(arguments, "height")
+			if err != nil {
+				return nil, err
+			}
+			if hasHash == hasHeight {
+				return nil, errors.New("Exactly one of hash or height is required!")
+			}
+
+			var block *Block
+			if hasHeight {
+				if height < 0 {
+					return nil, nil
+				}
+				block, err = findBlockAtHeight(chain, uint64(height))
+			} else {
+				block, err = findBlock(chain, hash)
+			}
+			if err != nil {
+				return gqlNullIfNotFound(err)
+			}
+			return block, nil
+		}},
+
+		// Blocks in the primary appendage by height, like `/v1/blocks`
+		"blocks": {typ: "Block", list: true, arguments: []string{"fromHeight", "limit"}, cost: GRAPHQL_LOOKUP_COST, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			fromHeight, _, err := gqlIntArgument(arguments, "fromHeight")
+			if err != nil {
+				return nil, err
+			}
+			if fromHeight < 0 {
+				return nil, errors.New("fromHeight can't be negative!")
+			}
+			limit, err := gqlLimitArgument(arguments)
+			if err != nil {
+				return nil, err
+			}
+
+			blocks, _ := chain.PrimaryBlocks(uint64(fromHeight), limit)
+			list := []interface{}{}
+			for _, block := range blocks {
+				list = append(list, block)
+			}
+			return list, nil
+		}},
+
+		// A transaction in the mempool, or in the primary appendage
+		"transaction": {typ: "Transaction", arguments: []string{"id"}, cost: GRAPHQL_LOOKUP_COST, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			rawId, ok, err := gqlStringArgument(arguments, "id")
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, errors.New("id is required!")
+			}
+			id, err := uuid.Parse(rawId)
+			if err != nil {
+				return nil, errors.New("Error parsing transaction id!")
+			}
+
+			if transaction := memPool.Get(id); transaction != nil {
+				return &gqlTransaction{transaction: transaction}, nil
+			}
+			transaction, block := chain.FindTransaction(id)
+			if transaction == nil {
+				return nil, nil
+			}
+			return &gqlTransaction{transaction: transaction, block: block}, nil
+		}},
+
+		"address": {typ: "Address", arguments: []string{"address"}, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			address, ok, err := gqlStringArgument(arguments, "address")
+			if err != nil {
+				return nil, err
+			}
+			if !ok || len(address) == 0 {
+				return nil, errors.New("address is required!")
+			}
+			return Address(address), nil
+		}},
+
+		"appendages": {typ: "Appendage", list: true, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			list := []interface{}{}
+			for _, appendage := range chain.ListAppendages() {
+				list = append(list, appendage)
+			}
+			return list, nil
+		}},
+
+		"mempool": {typ: "MemPool", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return memPool, nil
+		}},
+
+		"peers": {typ: "Peer", list: true, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			list := []interface{}{}
+			for _, peer := range peerSet.List() {
+				list = append(list, peer)
+			}
+			return list, nil
+		}},
+	}
+
+	block := map[string]gqlFieldDefinition{
+		"hash": {typ: "String", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return fmt.Sprintf("%x", *source.(*Block).Hash), nil
+		}},
+		"previousHash": {typ: "String", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			previous := source.(*Block).Previous
+			if previous == nil || previous.Hash == nil {
+				return nil, nil
+			}
+			return fmt.Sprintf("%x", *previous.Hash), nil
+		}},
+		"previous": {typ: "Block", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			previous := source.(*Block).Previous
+			if previous == nil {
+				return nil, nil
+			}
+			if previousBlock := previous.Unwrap(); previousBlock != nil {
+				return previousBlock, nil
+			}
+			return nil, nil
+		}},
+		"height": {typ: "Int", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return source.(*Block).Height(), nil
+		}},
+		"createdAt": {typ: "String", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return source.(*Block).CreatedAt.Format(time.RFC3339Nano), nil
+		}},
+		"number": {typ: "Int", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return source.(*Block).Number, nil
+		}},
+		// Encoding the block is as much work as a lookup
+		"size": {typ: "Int", cost: GRAPHQL_LOOKUP_COST, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			byt, err := source.(*Block).Encode()
+			if err != nil {
+				return nil, err
+			}
+			return len(byt), nil
+		}},
+		"transactionCount": {typ: "Int", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return len(source.(*Block).Data), nil
+		}},
+		"transactions": {typ: "Transaction", list: true, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return gqlTransactionsOf(source.(*Block).Data, source.(*Block)), nil
+		}},
+	}
+
+	transaction := map[string]gqlFieldDefinition{
+		"id":             {typ: "String", resolve: gqlTransactionViewField(func(view *TransactionView) interface{} { return view.Id })},
+		"cost":           {typ: "Int", resolve: gqlTransactionViewField(func(view *TransactionView) interface{} { return view.Cost })},
+		"nonce":          {typ: "Int", resolve: gqlTransactionViewField(func(view *TransactionView) interface{} { return view.Nonce })},
+		"validAfter":     {typ: "Int", resolve: gqlTransactionViewField(func(view *TransactionView) interface{} { return view.ValidAfter })},
+		"validUntil":     {typ: "Int", resolve: gqlTransactionViewField(func(view *TransactionView) interface{} { return view.ValidUntil })},
+		"data":           {typ: "String", resolve: gqlTransactionViewField(func(view *TransactionView) interface{} { return view.Data })},
+		"dataEncoding":   {typ: "String", resolve: gqlTransactionViewField(func(view *TransactionView) interface{} { return view.DataEncoding })},
+		"signature":      {typ: "String", resolve: gqlTransactionViewField(func(view *TransactionView) interface{} { return view.Signature })},
+		"signatureValid": {typ: "Boolean", resolve: gqlTransactionViewField(func(view *TransactionView) interface{} { return view.SignatureValid })},
+		"size":           {typ: "Int", resolve: gqlTransactionViewField(func(view *TransactionView) interface{} { return view.Size })},
+		"sender": {typ: "Address", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			senderPublicKey := source.(*gqlTransaction).transaction.SenderPublicKey
+			if senderPublicKey == nil {
+				return nil, nil
+			}
+			return senderPublicKey.Address(), nil
+		}},
+		// Whether the transaction is still waiting in the mempool
+		"pending": {typ: "Boolean", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return source.(*gqlTransaction).block == nil, nil
+		}},
+		"block": {typ: "Block", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			if block := source.(*gqlTransaction).block; block != nil {
+				return block, nil
+			}
+			return nil, nil
+		}},
+	}
+
+	address := map[string]gqlFieldDefinition{
+		"address": {typ: "String", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return string(source.(Address)), nil
+		}},
+		// The nonce the address's next transaction should have, like `/v1/transactions/params`
+		"nonce": {typ: "Int", cost: GRAPHQL_LOOKUP_COST, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return node.NextNonce(source.(Address)), nil
+		}},
+		"transactionCount": {typ: "Int", cost: GRAPHQL_LOOKUP_COST, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return chain.CountTransactionsFrom(source.(Address)), nil
+		}},
+		// Transactions sent from the address in the primary appendage, newest first
+		"transactions": {typ: "Transaction", list: true, arguments: []string{"limit"}, cost: GRAPHQL_LOOKUP_COST, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			limit, err := gqlLimitArgument(arguments)
+			if err != nil {
+				return nil, err
+			}
+			transactions, blocks := chain.TransactionsFrom(source.(Address), limit)
+			list := []interface{}{}
+			for index, transaction := range transactions {
+				list = append(list, &gqlTransaction{transaction: transaction, block: blocks[index]})
+			}
+			return list, nil
+		}},
+		"pendingTransactions": {typ: "Transaction", list: true, cost: GRAPHQL_LOOKUP_COST, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			var pending []*Transaction
+			for _, transaction := range memPool.List() {
+				if transaction.SenderPublicKey != nil && transaction.SenderPublicKey.Address() == source.(Address) {
+					pending = append(pending, transaction)
+				}
+			}
+			return gqlTransactionsOf(pending, nil), nil
+		}},
+	}
+
+	appendage := map[string]gqlFieldDefinition{
+		"primary": {typ: "Boolean", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			head := source.(*BlockchainAppendage).Head
+			primaryAppendage := chain.PrimaryAppendage()
+			if head == nil || primaryAppendage == nil || primaryAppendage.Head == nil {
+				return false, nil
+			}
+			return *primaryAppendage.Head.Hash == *head.Hash, nil
+		}},
+		"length": {typ: "Int", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return source.(*BlockchainAppendage).Length, nil
+		}},
+		"updatedAt": {typ: "String", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return source.(*BlockchainAppendage).UpdatedAt.Format(time.RFC3339Nano), nil
+		}},
+		"head": {typ: "Block", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			if head := source.(*BlockchainAppendage).Head; head != nil {
+				return head, nil
+			}
+			return nil, nil
+		}},
+		"genesis": {typ: "Block", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			if genesis := source.(*BlockchainAppendage).Genesis; genesis != nil {
+				return genesis, nil
+			}
+			return nil, nil
+		}},
+	}
+
+	memPoolType := map[string]gqlFieldDefinition{
+		"size": {typ: "Int", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return source.(*MemPool).Count(), nil
+		}},
+		"transactions": {typ: "Transaction", list: true, cost: GRAPHQL_LOOKUP_COST, resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return gqlTransactionsOf(source.(*MemPool).List(), nil), nil
+		}},
+	}
+
+	peer := map[string]gqlFieldDefinition{
+		"id": {typ: "String", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return uuid.UUID(source.(Peer).Id).String(), nil
+		}},
+		"address": {typ: "String", resolve: func(source interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return source.(Peer).Address, nil
+		}},
+	}
+
+	return &GraphQLSchema{types: map[string]map[string]gqlFieldDefinition{
+		GRAPHQL_QUERY_TYPE: query,
+		"Block":            block,
+		"Transaction":      transaction,
+		"Address":          address,
+		"Appendage":        appendage,
+		"MemPool":          memPoolType,
+		"Peer":             peer,
+	}}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Bump PROTOCOL_VERSION whenever a change is made that older nodes can't understand, and
+// MINIMUM_PROTOCOL_VERSION once nodes running older versions should no longer be peered with.
+const PROTOCOL_VERSION = uint(1)
+const MINIMUM_PROTOCOL_VERSION = uint(1)
+
+// Optional features a node may support, which peers can check before relying on them
+const FEATURE_BINARY_WIRE = "binary-wire"
+
+var NODE_FEATURES = []string{FEATURE_BINARY_WIRE, FEATURE_INVENTORY_GOSSIP, FEATURE_ADDRESS_EXCHANGE}
+
+// Every block requires about this many hashes to be mined, given the fixed difficulty
+const BLOCK_WORK = uint64(1) << (4 * HASH_ZERO_PREFIX_LENGTH)
+
+// Information exchanged between peers (as part of `/v1/me`) so that nodes running incompatible code
+// or following a different chain can be detected before they are peered with
+type Handshake struct {
+	ProtocolVersion        uint     `json:"protocol_version"`
+	MinimumProtocolVersion uint     `json:"minimum_protocol_version"`
+	ChainId                string   `json:"chain_id"`
+	BestHeight             uint64   `json:"best_height"`
+	BestWork               uint64   `json:"best_work"`
+	Features               []string `json:"features"`
+}
+
+func NewHandshake(chain *Blockchain, features []string) Handshake {
+	handshake := Handshake{
+		ProtocolVersion:        PROTOCOL_VERSION,
+		MinimumProtocolVersion: MINIMUM_PROTOCOL_VERSION,
+		ChainId:                ChainId(chain),
+		BestHeight:             0,
+		BestWork:               0,
+		Features:               features,
+	}
+
+	primaryAppendage := chain.PrimaryAppendage()
+	if primaryAppendage != nil && primaryAppendage.Head != nil {
+		handshake.BestHeight = primaryAppendage.Head.Height()
+		handshake.BestWork = (handshake.BestHeight + 1) * BLOCK_WORK
+	}
+	return handshake
+}
+
+// The chain id is the hash of the genesis block that the primary appendage builds on. A node that
+// hasn't synced or created a chain yet has an empty chain id, and will peer with any chain.
+func ChainId(chain *Blockchain) string {
+	primaryAppendage := chain.PrimaryAppendage()
+	if primaryAppendage == nil || primaryAppendage.Genesis == nil || primaryAppendage.Genesis.Hash == nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", *primaryAppendage.Genesis.Hash)
+}
+
+func (h Handshake) Supports(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error describing why the other node can't be peered with, or nil if it can
+func (h Handshake) CompatibleWith(other Handshake) error {
+	if other.ProtocolVersion < h.MinimumProtocolVersion {
+		return errors.New(fmt.Sprintf("Protocol version %d is older than the minimum supported version %d", other.ProtocolVersion, h.MinimumProtocolVersion))
+	}
+	if h.ProtocolVersion < other.MinimumProtocolVersion {
+		return errors.New(fmt.Sprintf("Peer requires protocol version %d, but this node only supports %d", other.MinimumProtocolVersion, h.ProtocolVersion))
+	}
+	if len(h.ChainId) > 0 && len(other.ChainId) > 0 && h.ChainId != other.ChainId {
+		return errors.New(fmt.Sprintf("Chain id %s does not match this node's chain id %s", other.ChainId, h.ChainId))
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net"
+	"net/url"
+)
+
+// Checking a peer that introduced itself means calling it back at the address it claims, so it's
+// done in the background by a few workers rather than while the request that made the claim waits
+const PEER_INTRODUCTION_QUEUE_DEPTH = 32
+const PEER_INTRODUCTION_WORKERS = 2
+
+// Each ip can have a few introductions checked at once, then one a minute
+const PEER_INTRODUCTION_RATE_PER_IP = 1.0 / 60
+const PEER_INTRODUCTION_BURST_PER_IP = 3.0
+
+type peerIntroduction struct {
+	claimed    Peer
+	remoteHost string
+}
+
+// Introductions that peers have made in requests (ie, with X-Peer-Info), waiting to be checked
+type IntroductionQueue struct {
+	peerSet   *PeerSet
+	introduce func(claimed Peer)
+	byIp      *RateLimiter
+	queue     chan peerIntroduction
+}
+
+func NewIntroductionQueue(peerSet *PeerSet, clock Clock, introduce func(claimed Peer)) *IntroductionQueue {
+	return &IntroductionQueue{
+		peerSet:   peerSet,
+		introduce: introduce,
+		byIp:      NewRateLimiter(clock, PEER_INTRODUCTION_RATE_PER_IP, PEER_INTRODUCTION_BURST_PER_IP),
+		queue:     make(chan peerIntroduction, PEER_INTRODUCTION_QUEUE_DEPTH),
+	}
+}
+
+// Queue a peer's claim, made in a request from remoteAddr, to be checked. Claims from ips that have
+// made too many lately, or that arrive while the queue is full, are dropped.
+func (q *IntroductionQueue) Enqueue(claimed Peer, remoteAddr string) {
+	if q.peerSet.Has(claimed.Id) || q.peerSet.Untrusted(claimed.Id) || !q.peerSet.HasSlot(PEER_DIRECTION_INBOUND) {
+		return
+	}
+	remoteHost, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		remoteHost = remoteAddr
+	}
+	if !q.byIp.Allow(remoteHost) {
+		return
+	}
+
+	select {
+	case q.queue <- peerIntroduction{claimed: claimed, remoteHost: remoteHost}:
+	default:
+		fmt.Printf("Introduction queue is full, dropping peer %s (address %s)\n", uuid.UUID(claimed.Id).String(), claimed.Address)
+	}
+}
+
+// Check queued introductions, forever
+func (q *IntroductionQueue) Run() {
+	for i := 0; i < PEER_INTRODUCTION_WORKERS; i += 1 {
+		go q.introduceQueued()
+	}
+}
+func (q *IntroductionQueue) introduceQueued() {
+	for introduction := range q.queue {
+		if err := checkIntroducedAddress(q.peerSet.resolver, introduction.claimed.Address, introduction.remoteHost); err != nil {
+			fmt.Printf("Warning: not calling back peer %s! %s\n", uuid.UUID(introduction.claimed.Id).String(), err)
+			continue
+		}
+		q.introduce(introduction.claimed)
+	}
+}
+
+// Make sure the address a peer claims is where its request came from, so that a request can't have
+// the node call somewhere else. Loopback addresses are allowed, so that many nodes can still run on
+// one machine, but other addresses that aren't public (ie, on a private network) aren't.
+func checkIntroducedAddress(resolver Resolver, address string, remoteHost string) error {
+	peerUrl, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	if peerUrl.Scheme != "http" && peerUrl.Scheme != "https" {
+		return errors.New(fmt.Sprintf("Peer address %s isn't http or https!", address))
+	}
+	ips, err := resolvePeerIps(resolver, address)
+	if err != nil {
+		return err
+	}
+
+	remoteIp := net.ParseIP(remoteHost)
+	fromRemote := false
+	for _, rawIp := range ips {
+		ip := net.ParseIP(rawIp)
+		if ip == nil {
+			return errors.New(fmt.Sprintf("Peer address %s resolved to %s, which isn't an ip!", address, rawIp))
+		}
+		if !ip.IsLoopback() && !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			return errors.New(fmt.Sprintf("Peer address %s resolves to %s, which isn't public!", address, ip))
+		}
+		if ip.Equal(remoteIp) {
+			fromRemote = true
+		}
+	}
+	if !fromRemote {
+		return errors.New(fmt.Sprintf("Peer address %s doesn't resolve to %s, where its request came from!", address, remoteHost))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckIntroducedAddress(t *testing.T) {
+	resolver := StaticResolver{
+		"node.example":    {"203.0.113.7"},
+		"mixed.example":   {"203.0.113.7", "10.0.0.7"},
+		"private.example": {"192.168.1.7"},
+	}
+	for _, test := range []struct {
+		address    string
+		remoteHost string
+		valid      bool
+	}{
+		{"http://203.0.113.7:3000", "203.0.113.7", true},
+		{"https://node.example", "203.0.113.7", true},
+		{"http://127.0.0.1:4001", "127.0.0.1", true},
+		{"http://[::1]:4001", "::1", true},
+		// Somewhere other than where the request came from
+		{"http://203.0.113.8:3000", "203.0.113.7", false},
+		{"http://127.0.0.1:4001", "203.0.113.7", false},
+		{"https://node.example", "203.0.113.8", false},
+		{"https://unknown.example", "203.0.113.7", false},
+		// Not public, even when the request came from there
+		{"http://10.0.0.7:3000", "10.0.0.7", false},
+		{"https://private.example", "192.168.1.7", false},
+		{"https://mixed.example", "203.0.113.7", false},
+		{"http://169.254.169.254", "169.254.169.254", false},
+		{"http://0.0.0.0:3000", "0.0.0.0", false},
+		{"http://[fd00::7]:3000", "fd00::7", false},
+		// Not something the node should call at all
+		{"mem://test-node-0", "203.0.113.7", false},
+		{"ftp://203.0.113.7", "203.0.113.7", false},
+	} {
+		err := checkIntroducedAddress(resolver, test.address, test.remoteHost)
+		if test.valid && err != nil {
+			t.Errorf("Expected %s from %s to be called back! %s", test.address, test.remoteHost, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("Expected %s from %s not to be called back!", test.address, test.remoteHost)
+		}
+	}
+}
+
+// Each ip only gets a burst of introductions queued, and none are checked while the request waits
+func TestIntroductionQueueRateLimitsByIp(t *testing.T) {
+	_, nodes := startTestNetwork(t, 1)
+	var introduced int32
+	queue := NewIntroductionQueue(nodes[0].peerSet, nodes[0].clock, func(claimed Peer) {
+		atomic.AddInt32(&introduced, 1)
+	})
+
+	introduce := func(remoteAddr string) {
+		queue.Enqueue(Peer{Id: PeerId(uuid.New()), Address: "http://203.0.113.7:3000"}, remoteAddr)
+	}
+	for i := 0; i < 2*PEER_INTRODUCTION_BURST_PER_IP; i += 1 {
+		introduce("203.0.113.7:1234")
+	}
+	if queued := len(queue.queue); queued != PEER_INTRODUCTION_BURST_PER_IP {
+		t.Errorf("Expected %d introductions from one ip to be queued, got %d!", int(PEER_INTRODUCTION_BURST_PER_IP), queued)
+	}
+	introduce("203.0.113.8:1234")
+	if queued := len(queue.queue); queued != PEER_INTRODUCTION_BURST_PER_IP+1 {
+		t.Errorf("Expected another ip's introduction to be queued, got %d queued!", queued)
+	}
+	if count := atomic.LoadInt32(&introduced); count != 0 {
+		t.Errorf("Expected nothing to be checked until the queue runs, got %d!", count)
+	}
+}
+
+// A request with X-Peer-Info is answered without waiting for the claim to be checked
+func TestPeerInfoIsCheckedInTheBackground(t *testing.T) {
+	_, nodes := startTestNetwork(t, 1)
+	req := httptest.NewRequest("GET", "/v1/peers", nil)
+	peer := Peer{Id: PeerId(uuid.New()), Address: "http://203.0.113.7:3000"}
+	req.Header.Set("X-Peer-Info", peer.Header())
+	w := httptest.NewRecorder()
+	newRouter(nodes[0], "").ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed, got %d %s!", w.Code, w.Body.String())
+	}
+	if queued := len(nodes[0].introductions.queue); queued != 1 {
+		t.Errorf("Expected the introduction to be queued, got %d queued!", queued)
+	}
+	if nodes[0].peerSet.Has(peer.Id) {
+		t.Errorf("Expected the peer not to be added before its claim is checked!")
+	}
+}
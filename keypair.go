@@ -3,9 +3,14 @@ package main
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/big"
 )
 
@@ -41,3 +46,75 @@ func (p *PublicKey) UnmarshalJSON(byt []byte) error {
 	p.E = temp.E
 	return nil
 }
+
+// An address is a short, stable identifier for a public key, so that clients can refer to a sender
+// without passing around the whole rsa modulus
+type Address string
+
+const ADDRESS_BYTE_LENGTH = 20
+
+func (p *PublicKey) Address() Address {
+	hash := sha256.Sum256(x509.MarshalPKCS1PublicKey((*rsa.PublicKey)(p)))
+	return Address(hex.EncodeToString(hash[:ADDRESS_BYTE_LENGTH]))
+}
+func (p *PublicKey) Equal(to *PublicKey) bool {
+	if p == nil || to == nil {
+		return p == to
+	}
+	return p.E == to.E && p.N.Cmp(to.N) == 0
+}
+
+func ReadPrivateKeyFile(path string) (*rsa.PrivateKey, error) {
+	privateFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(privateFile)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, errors.New(fmt.Sprintf("Corrupted private key in %s!", path))
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+func WritePrivateKeyFile(path string, privateKey *rsa.PrivateKey) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	}), 0600)
+}
+func WritePublicKeyFile(path string, publicKey *PublicKey) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey((*rsa.PublicKey)(publicKey)),
+	}), 0644)
+}
+func ReadPublicKeyFile(path string) (*PublicKey, error) {
+	publicFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(publicFile)
+	if block == nil {
+		return nil, errors.New(fmt.Sprintf("Corrupted public key in %s!", path))
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		publicKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return (*PublicKey)(publicKey), nil
+	case "RSA PRIVATE KEY":
+		// Accept a private key too, since it contains the public key
+		privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		publicKey := PublicKey(privateKey.PublicKey)
+		return &publicKey, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported key type %s in %s!", block.Type, path))
+	}
+}
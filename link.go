@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When enabled with --websocket, a node keeps a long lived websocket open to each peer that supports
+// it. Announcements, requests for the announced items, and heartbeats all travel over the link, so
+// new blocks reach the peer right away and the peer doesn't need to be polled to know it's alive.
+const FEATURE_WEBSOCKET_LINK = "websocket-link"
+
+const PEER_LINK_PING_INTERVAL = 10 * time.Second
+
+// A link that hasn't heard anything from the other side in this long is considered dead
+const PEER_LINK_TIMEOUT = 3 * PEER_LINK_PING_INTERVAL
+
+const PEER_LINK_WRITE_TIMEOUT = PEER_REQUEST_TIMEOUT
+const PEER_LINK_MAX_MESSAGE_SIZE = 4 * 1024 * 1024
+
+const LINK_MESSAGE_PING = "ping"
+const LINK_MESSAGE_ANNOUNCE = "announce"
+const LINK_MESSAGE_REQUEST = "request"
+const LINK_MESSAGE_BLOCK = "block"
+const LINK_MESSAGE_TRANSACTION = "transaction"
+
+// Blocks and transactions are sent in their text serialized form, the same as the http endpoints
+type LinkMessage struct {
+	Type        string          `json:"type"`
+	Items       []InventoryItem `json:"items,omitempty"`
+	Handshake   *Handshake      `json:"handshake,omitempty"`
+	Block       string          `json:"block,omitempty"`
+	Transaction string          `json:"transaction,omitempty"`
+}
+
+type PeerLink struct {
+	peer   Peer
+	conn   *websocket.Conn
+	send   chan LinkMessage
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *PeerLink) Close() {
+	l.once.Do(func() {
+		close(l.closed)
+		l.conn.Close()
+	})
+}
+
+type LinkManager struct {
+	peerSet *PeerSet
+	gossip  *Gossip
+	chain   *Blockchain
+	memPool *MemPool
+	tls     *tls.Config
+
+	mu    sync.Mutex
+	links map[PeerId]*PeerLink
+}
+
+var linkUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+func NewLinkManager(peerSet *PeerSet, gossip *Gossip, chain *Blockchain, memPool *MemPool, tlsConfig *tls.Config) *LinkManager {
+	return &LinkManager{
+		peerSet: peerSet,
+		gossip:  gossip,
+		chain:   chain,
+		memPool: memPool,
+		tls:     tlsConfig,
+		links:   map[PeerId]*PeerLink{},
+	}
+}
+
+// Send an announcement over the link to a peer, returning false if there is no link to it
+func (m *LinkManager) Announce(id PeerId, items []InventoryItem) bool {
+	return m.sendTo(id, LinkMessage{Type: LINK_MESSAGE_ANNOUNCE, Items: items})
+}
+
+func (m *LinkManager) sendTo(id PeerId, message LinkMessage) bool {
+	m.mu.Lock()
+	link, ok := m.links[id]
+	m.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case link.send <- message:
+		return true
+	case <-link.closed:
+		return false
+	default:
+		fmt.Printf("Link to peer %s is backed up, dropping %s message\n", uuid.UUID(id).String(), message.Type)
+		return false
+	}
+}
+
+// Handle `/v1/ws`. Only known peers may open a link, since everything sent over it is attributed to
+// that peer.
+func (m *LinkManager) Serve(w http.ResponseWriter, r *http.Request) {
+	peerId, ok := peerInRequest(m.peerSet, r)
+	if !ok {
+		respondError(w, r, NewAPIError(ERROR_CODE_FORBIDDEN, "Links can only be opened by known peers!"))
+		return
+	}
+	peer, ok := m.peerSet.Get(peerId)
+	if !ok {
+		respondError(w, r, NewAPIError(ERROR_CODE_FORBIDDEN, "Links can only be opened by known peers!"))
+		return
+	}
+
+	conn, err := linkUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("Failed to open link with peer %s! %s\n", uuid.UUID(peerId).String(), err)
+		return
+	}
+	m.run(peer, conn)
+}
+
+// Open links to every peer which supports them and doesn't have one yet, and close links to peers
+// which have been removed. To avoid both sides dialing each other, only the peer with the lower id
+// dials.
+func (m *LinkManager) Connect() {
+	m.mu.Lock()
+	for id, link := range m.links {
+		if !m.peerSet.Has(id) {
+			link.Close()
+		}
+	}
+	m.mu.Unlock()
+
+	for _, peer := range m.peerSet.ListOthers() {
+		if bytes.Compare(m.peerSet.Me.Id[:], peer.Id[:]) >= 0 {
+			continue
+		}
+		handshake, ok := m.peerSet.Handshake(peer.Id)
+		if !ok || !handshake.Supports(FEATURE_WEBSOCKET_LINK) {
+			continue
+		}
+		m.mu.Lock()
+		_, linked := m.links[peer.Id]
+		m.mu.Unlock()
+		if linked {
+			continue
+		}
+
+		if err := m.dial(peer); err != nil {
+			fmt.Printf("Failed to open link to peer %s! %s\n", uuid.UUID(peer.Id).String(), err)
+		}
+	}
+}
+
+func (m *LinkManager) dial(peer Peer) error {
+	address := peer.Address
+	if strings.HasPrefix(address, "https://") {
+		address = "wss://" + strings.TrimPrefix(address, "https://")
+	} else {
+		address = "ws://" + strings.TrimPrefix(address, "http://")
+	}
+
+	dialer := websocket.Dialer{HandshakeTimeout: PEER_REQUEST_TIMEOUT, TLSClientConfig: m.tls}
+	header := http.Header{}
+	header.Add("X-Peer-Info", m.peerSet.Me.Header())
+	conn, resp, err := dialer.Dial(fmt.Sprintf("%s/v1/ws", address), header)
+	if err != nil {
+		if resp != nil {
+			return errors.New(fmt.Sprintf("Failed with %d! %s", resp.StatusCode, err))
+		}
+		return err
+	}
+
+	go m.run(peer, conn)
+	return nil
+}
+
+// Run a link until it fails, replacing any existing link to the same peer
+func (m *LinkManager) run(peer Peer, conn *websocket.Conn) {
+	link := &PeerLink{
+		peer:   peer,
+		conn:   conn,
+		send:   make(chan LinkMessage, PEER_QUEUE_DEPTH),
+		closed: make(chan struct{}),
+	}
+
+	m.mu.Lock()
+	if existing, ok := m.links[peer.Id]; ok {
+		existing.Close()
+	}
+	m.links[peer.Id] = link
+	m.mu.Unlock()
+	fmt.Printf("Opened link with peer %s\n", uuid.UUID(peer.Id).String())
+
+	go m.write(link)
+	err := m.read(link)
+	link.Close()
+
+	m.mu.Lock()
+	if m.links[peer.Id] == link {
+		delete(m.links, peer.Id)
+	}
+	m.mu.Unlock()
+	fmt.Printf("Closed link with peer %s: %s\n", uuid.UUID(peer.Id).String(), err)
+
+	// If the peer went quiet rather than hanging up, it's treated like any other timeout
+	if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+		m.peerSet.Penalize(peer.Id, PEER_OFFENSE_TIMEOUT)
+	}
+}
+
+// Gorilla websockets only allow one writer at a time, so all messages are sent from here
+func (m *LinkManager) write(link *PeerLink) {
+	ticker := time.NewTicker(PEER_LINK_PING_INTERVAL)
+	defer ticker.Stop()
+
+	if err := m.ping(link); err != nil {
+		link.Close()
+		return
+	}
+	for {
+		select {
+		case message := <-link.send:
+			link.conn.SetWriteDeadline(time.Now().Add(PEER_LINK_WRITE_TIMEOUT))
+			if err := link.conn.WriteJSON(message); err != nil {
+				link.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := m.ping(link); err != nil {
+				link.Close()
+				return
+			}
+		case <-link.closed:
+			return
+		}
+	}
+}
+
+// Pings carry the node's latest handshake, which stands in for polling `/v1/me`
+func (m *LinkManager) ping(link *PeerLink) error {
+	handshake := m.peerSet.localHandshake()
+	link.conn.SetWriteDeadline(time.Now().Add(PEER_LINK_WRITE_TIMEOUT))
+	return link.conn.WriteJSON(LinkMessage{Type: LINK_MESSAGE_PING, Handshake: &handshake})
+}
+
+func (m *LinkManager) read(link *PeerLink) error {
+	link.conn.SetReadLimit(PEER_LINK_MAX_MESSAGE_SIZE)
+	from := link.peer.Id
+
+	for {
+		link.conn.SetReadDeadline(time.Now().Add(PEER_LINK_TIMEOUT))
+		_, byt, err := link.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var message LinkMessage
+		if err := json.Unmarshal(byt, &message); err != nil {
+			m.peerSet.Penalize(from, PEER_OFFENSE_MALFORMED_RESPONSE)
+			continue
+		}
+
+		switch message.Type {
+		case LINK_MESSAGE_PING:
+			if message.Handshake == nil {
+				m.peerSet.Penalize(from, PEER_OFFENSE_MALFORMED_RESPONSE)
+				continue
+			}
+			if err := m.peerSet.Heartbeat(from, *message.Handshake); err != nil {
+				return err
+			}
+
+		case LINK_MESSAGE_ANNOUNCE:
+			// If the request can't be sent, the items can be asked for again. Otherwise they stay in
+			// flight until the peer sends them, or the fetch times out.
+			unseen := m.gossip.UnseenItems(from, message.Items)
+			if len(unseen) > 0 && !m.sendTo(from, LinkMessage{Type: LINK_MESSAGE_REQUEST, Items: unseen}) {
+				for _, item := range unseen {
+					m.gossip.seen.Release(item)
+				}
+			}
+
+		case LINK_MESSAGE_REQUEST:
+			m.respond(link, message.Items)
+
+		case LINK_MESSAGE_BLOCK:
+			block, err := NewBlockFromBytes(m.chain, []byte(message.Block))
+			if err != nil {
+				m.peerSet.Penalize(from, PEER_OFFENSE_MALFORMED_RESPONSE)
+				continue
+			}
+			if !m.gossip.Enqueue(func() { m.gossip.ReceiveBlock(from, block) }) {
+				m.gossip.seen.Release(BlockInventoryItem(block))
+			}
+
+		case LINK_MESSAGE_TRANSACTION:
+			transaction, err := NewTransactionFromBytes([]byte(message.Transaction))
+			if err != nil {
+				m.peerSet.Penalize(from, PEER_OFFENSE_MALFORMED_RESPONSE)
+				continue
+			}
+			if !m.gossip.Enqueue(func() { m.gossip.ReceiveTransaction(from, transaction) }) {
+				m.gossip.seen.Release(TransactionInventoryItem(transaction))
+			}
+
+		default:
+			// Could be a kind of message from a newer version of the protocol, so just skip it
+			continue
+		}
+	}
+}
+
+// Send the peer each requested item this node has. Items it doesn't have are left out, and the peer
+// will hear about them again from someone else.
+func (m *LinkManager) respond(link *PeerLink, items []InventoryItem) {
+	for _, item := range items {
+		switch item.Type {
+		case INVENTORY_TYPE_BLOCK:
+			hash, err := HexToBlockHash(item.Id)
+			if err != nil {
+				continue
+			}
+			block := m.chain.GetBlockWithHash(*hash)
+			if block == nil {
+				continue
+			}
+			byt, err := block.Serialize()
+			if err != nil {
+				continue
+			}
+			m.sendTo(link.peer.Id, LinkMessage{Type: LINK_MESSAGE_BLOCK, Block: string(byt)})
+
+		case INVENTORY_TYPE_TRANSACTION:
+			id, err := uuid.Parse(item.Id)
+			if err != nil {
+				continue
+			}
+			transaction := m.memPool.Get(id)
+			if transaction == nil {
+				continue
+			}
+			byt, err := transaction.Serialize()
+			if err != nil {
+				continue
+			}
+			m.sendTo(link.peer.Id, LinkMessage{Type: LINK_MESSAGE_TRANSACTION, Transaction: string(byt)})
+		}
+	}
+}
+
+// Record that a peer is alive, along with its latest handshake. While heartbeats keep arriving,
+// Refresh doesn't need to poll the peer.
+func (ps *PeerSet) Heartbeat(id PeerId, handshake Handshake) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if !ps.hasLocked(id) {
+		return errors.New(fmt.Sprintf("Peer %s is no longer in the peer set", uuid.UUID(id).String()))
+	}
+	if err := ps.localHandshake().CompatibleWith(handshake); err != nil {
+		fmt.Printf("Peer %s is no longer compatible, removing: %s\n", uuid.UUID(id).String(), err)
+		ps.removeLocked(id)
+		return err
+	}
+	ps.handshakes[id] = handshake
+	ps.heartbeats[id] = ps.clock.Now()
+	ps.touchLocked(ps.peers[id])
+	return nil
+}
+
+func (ps *PeerSet) heartbeatIsFresh(id PeerId) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	lastHeartbeat, ok := ps.heartbeats[id]
+	return ok && ps.clock.Now().Sub(lastHeartbeat) < PEER_LINK_TIMEOUT
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A block whose hash is a byte longer than a block hash can be
+var overLongHashBlock = "AA==." + strings.Repeat("00", len(BlockHash{})+1)
+
+// Open a websocket to a server that hands its side of the connection back
+func openTestLink(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	accepted := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := linkUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Failed to upgrade link! %s", err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws://"+strings.TrimPrefix(server.URL, "http://"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	select {
+	case conn := <-accepted:
+		return conn, client
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the link to open!")
+		return nil, nil
+	}
+}
+
+func TestHexToBlockHash(t *testing.T) {
+	valid := strings.Repeat("ab", len(BlockHash{}))
+	if hash, err := HexToBlockHash(valid); err != nil || hash[0] != 0xab {
+		t.Fatalf("Expected %s to parse, got %x! %v", valid, hash, err)
+	}
+	for _, invalid := range []string{"", "ab", valid[2:], valid + "ab", valid + "zz", strings.Repeat("00", 1000)} {
+		if hash, err := HexToBlockHash(invalid); err == nil {
+			t.Errorf("Expected %q not to parse, got %x!", invalid, *hash)
+		}
+	}
+}
+
+// A block with an over-long hash sent over a link costs the peer ranking rather than crashing the node
+func TestLinkBlockWithOverLongHash(t *testing.T) {
+	_, nodes := startTestNetwork(t, 2)
+	node := nodes[1]
+	peer := nodes[0].Me()
+	links := NewLinkManager(node.peerSet, node.gossip, node.chain, node.memPool, nil)
+	before := peerRanking(node, peer.Id)
+
+	conn, client := openTestLink(t)
+	if err := client.WriteJSON(LinkMessage{Type: LINK_MESSAGE_BLOCK, Block: overLongHashBlock}); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	link := &PeerLink{peer: peer, conn: conn, send: make(chan LinkMessage, 1), closed: make(chan struct{})}
+	if err := links.read(link); err == nil {
+		t.Fatal("Expected reading from a closed link to fail!")
+	}
+	if ranking := peerRanking(node, peer.Id); ranking >= before {
+		t.Errorf("Expected the peer's ranking to drop below %d, got %d!", before, ranking)
+	}
+}
+
+// A peer answering a block fetch with an over-long hash fails the fetch rather than crashing the node
+func TestFetchBlockWithOverLongHash(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"block": "` + overLongHashBlock + `"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	_, nodes := startTestNetwork(t, 1)
+	node := nodes[0]
+	gossip := &Gossip{peerSet: node.peerSet, transport: NewHTTPTransport(node.Me()), chain: node.chain, wireFormat: WIRE_FORMAT_TEXT}
+	if _, err := gossip.fetchBlock(Peer{Address: server.URL}, BlockHash{}); err == nil {
+		t.Fatal("Expected fetching a block with an over-long hash to fail!")
+	}
+}
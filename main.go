@@ -2,24 +2,22 @@ package main
 
 import (
 	"bytes"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"flag"
 	"fmt"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
-	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
-	"time"
 )
 
-func addPeerInRequest(peerSet *PeerSet, r *http.Request) {
+func addPeerInRequest(node *Node, r *http.Request) {
 	rawPeerInfo, ok := r.Header["X-Peer-Info"]
 
 	if !ok {
@@ -39,363 +37,439 @@ func addPeerInRequest(peerSet *PeerSet, r *http.Request) {
 		return
 	}
 
-	if peerSet.Has(PeerId(peerId)) {
-		return
+	node.introductions.Enqueue(Peer{Id: PeerId(peerId), Address: peerInfo[1]}, r.RemoteAddr)
+}
+
+// Figure out which known peer sent a request, so that it can be held responsible for what it sent.
+// Since the X-Peer-Info header could be forged, it's only believed if the request came from the host
+// in the peer's address, or an ip it resolved to when the peer was added.
+func peerInRequest(peerSet *PeerSet, r *http.Request) (PeerId, bool) {
+	peerInfo := strings.Split(strings.Join(r.Header["X-Peer-Info"], " "), " ")
+	if len(peerInfo) < 2 {
+		return PeerId{}, false
 	}
 
-	if err := peerSet.InsertByAddress(peerInfo[1]); err != nil {
-		fmt.Printf("Warning: failed to get peer info: %s", err)
+	rawPeerId, err := uuid.Parse(peerInfo[0])
+	if err != nil {
+		return PeerId{}, false
+	}
+	peerId := PeerId(rawPeerId)
+	peer, ok := peerSet.Get(peerId)
+	if !ok {
+		return PeerId{}, false
 	}
-}
 
-func sendBlockBytesToPeers(peerSet *PeerSet, blockBytes []byte) {
-	for _, peer := range peerSet.ListOthers() {
-		resp, err := http.Post(
-			fmt.Sprintf("%s/v1/blocks", peer.Address),
-			"text/plain",
-			bytes.NewBuffer(blockBytes),
-		)
-		if err != nil {
-			fmt.Printf("Failed to propegate block to peer %s! %s\n", uuid.UUID(peer.Id).String(), err)
-			peerSet.Decrement(peer.Id, NODE_PEER_OFFLINE_DECREMENT)
-			continue
-		}
-		if resp.StatusCode != 200 {
-			fmt.Printf("Failed to propegate block to peer %s, failed with %d!\n", peer, resp.StatusCode)
-			peerSet.Decrement(peer.Id, NODE_PEER_INVALID_REQUEST_DECREMENT)
-			continue
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return PeerId{}, false
+	}
+	peerUrl, err := url.Parse(peer.Address)
+	if err != nil {
+		return PeerId{}, false
+	}
+	if peerUrl.Hostname() == remoteHost {
+		return peerId, true
+	}
+	for _, ip := range peerSet.Ips(peerId) {
+		if ip == remoteHost {
+			return peerId, true
 		}
 	}
+	return PeerId{}, false
+}
+
+// The peer that sent a request, or nil if it didn't come from a known peer
+func senderOfRequest(peerSet *PeerSet, r *http.Request) *PeerId {
+	if peerId, ok := peerInRequest(peerSet, r); ok {
+		return &peerId
+	}
+	return nil
+}
+
+func penalizePeerInRequest(peerSet *PeerSet, r *http.Request, offense PeerOffense) {
+	if peerId, ok := peerInRequest(peerSet, r); ok {
+		peerSet.Penalize(peerId, offense)
+	}
 }
 
+// The fee a node suggests to clients building transactions offline
+const NODE_SUGGESTED_TRANSACTION_FEE = Currency(0)
+
 func setupNode(args []string) {
 	nodeCmd := flag.NewFlagSet("node", flag.ExitOnError)
 
 	peersRaw := nodeCmd.String("peers", "", "Comma-seperated list of peers to propegate network events to")
 	addressRaw := nodeCmd.String("address", "", "Network address other peers can use to reach this peer")
+	wireRaw := nodeCmd.String("wire", "text", "Format to send blocks and transactions to peers in, either text or binary")
+	adminTokenRaw := nodeCmd.String("admin-token", "", "Bearer token required to use the /v1/admin endpoints, which are disabled if not set")
+	dataDirRaw := nodeCmd.String("data-dir", "", "Directory to store the node key and peer database in, so they persist across restarts")
+	websocketRaw := nodeCmd.Bool("websocket", false, "Keep a websocket open to each peer that supports it, rather than polling them")
+	webhooksRaw := nodeCmd.Bool("webhooks", false, "Let clients register urls to be sent a request when transactions are included and confirmed")
+	gossipFanout := nodeCmd.Int("gossip-fanout", NODE_DEFAULT_GOSSIP_FANOUT, "Number of peers to announce each new block and transaction to")
+	bootstrapFileRaw := nodeCmd.String("bootstrap-file", "", "File listing peer addresses to try when starting up, one per line")
+	dnsSeedsRaw := nodeCmd.String("dns-seeds", "", "Comma-seperated list of addresses (ie, http://seed.example.com:4000) whose hostnames resolve to the ips of peers")
+	tlsOptions := addTLSFlags(nodeCmd)
+	nodeCmd.BoolVar(&tlsOptions.RequireClientCerts, "mtls", false, "Require peers and clients to present a certificate signed by --tls-ca")
 
 	if err := nodeCmd.Parse(args); err != nil {
 		panic(err)
 	}
 
+	wireFormat, err := ParseWireFormat(*wireRaw)
+	if err != nil {
+		panic(err)
+	}
+
 	if len(*addressRaw) == 0 {
 		panic("--address is required!")
 	}
-	peerSet := NewPeerSet(*addressRaw)
-	memPool := NewMemPool()
-	chain := NewBlockchain()
+	nodeKey, err := LoadOrCreateNodeKey(*dataDirRaw)
+	if err != nil {
+		panic(err)
+	}
+
+	serverTLS, err := tlsOptions.ServerConfig()
+	if err != nil {
+		panic(err)
+	}
+	clientTLS, err := tlsOptions.ClientConfig()
+	if err != nil {
+		panic(err)
+	}
+	if serverTLS != nil && !strings.HasPrefix(*addressRaw, "https://") {
+		fmt.Printf("Warning: serving https, but --address %s isn't an https address!\n", *addressRaw)
+	}
+
+	var peers []string
+	if len(*peersRaw) > 0 {
+		for _, rawPeerAddress := range strings.Split(*peersRaw, ",") {
+			peers = append(peers, strings.Trim(rawPeerAddress, " "))
+		}
+	}
+	var dnsSeeds []string
+	if len(*dnsSeedsRaw) > 0 {
+		for _, rawSeed := range strings.Split(*dnsSeedsRaw, ",") {
+			dnsSeeds = append(dnsSeeds, strings.Trim(rawSeed, " "))
+		}
+	}
+	node := NewNode(NodeConfig{
+		Address:       *addressRaw,
+		Peers:         peers,
+		WireFormat:    wireFormat,
+		DataDir:       *dataDirRaw,
+		GossipFanout:  *gossipFanout,
+		Websocket:     *websocketRaw,
+		Webhooks:      *webhooksRaw,
+		BootstrapFile: *bootstrapFileRaw,
+		DNSSeeds:      dnsSeeds,
+		TLS:           clientTLS,
+	}, nodeKey, NewHTTPTransportWithClient(NewPeerClient(clientTLS)))
+	r := newRouter(node, *adminTokenRaw)
+	if node.webhooks != nil {
+		go node.webhooks.Run()
+	}
+	node.introductions.Run()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	// HTTP SERVER
+	go func() {
+		defer wg.Done()
+
+		port := ":3000"
+		if rawPort, ok := os.LookupEnv("PORT"); ok {
+			port = fmt.Sprintf(":%s", rawPort)
+		}
+		if serverTLS == nil {
+			fmt.Printf("Running on %s\n", port)
+			http.ListenAndServe(port, r)
+			return
+		}
+
+		fmt.Printf("Running on %s with tls\n", port)
+		server := &http.Server{Addr: port, Handler: r, TLSConfig: serverTLS}
+		// The certificate is already in the tls config, so no files need to be given here
+		if err := server.ListenAndServeTLS("", ""); err != nil {
+			panic(err)
+		}
+	}()
+
+	// MANAGE PEERS
+	go func() {
+		defer wg.Done()
+
+		if err := node.Connect(); err != nil {
+			panic(err)
+		}
+		if err := node.Sync(); err != nil {
+			panic(err)
+		}
+		node.ManagePeers()
+	}()
+
+	// MINING
+	go func() {
+		defer wg.Done()
+		node.Mine()
+	}()
+
+	wg.Wait()
+}
+
+func newRouter(node *Node, adminToken string) chi.Router {
+	chain := node.chain
+	memPool := node.memPool
+	peerSet := node.peerSet
 
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
+	r.Use(rateLimit(peerSet, node.clock))
 
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Ryan made a blockchain.")
 	})
 
-	r.Post("/v1/blocks", func(w http.ResponseWriter, r *http.Request) {
-		byt, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			render.JSON(w, r, map[string]interface{}{"error": "Error readng body!"})
-			return
-		}
-
-		newBlock, err := NewBlockFromBytes(chain, byt)
-		if err != nil {
-			render.JSON(w, r, map[string]interface{}{"error": "Error parsing body into block!"})
+	r.With(limitConcurrency(API_MAX_CONCURRENT_BLOCK_SUBMISSIONS)).Post("/v1/blocks", func(w http.ResponseWriter, r *http.Request) {
+		byt, ok := readBody(w, r, API_MAX_BLOCK_BODY_SIZE)
+		if !ok {
 			return
 		}
 
-		ok, err := newBlock.Verify()
+		newBlock, err := WireFormatOfContentType(r.Header.Get("Content-Type")).DecodeBlock(chain, byt)
 		if err != nil {
-			render.JSON(w, r, map[string]interface{}{"error": "Error verifying block"})
-			return
-		}
-
-		if !ok {
-			render.JSON(w, r, map[string]interface{}{"error": "Block could not be validated, rejecting."})
+			penalizePeerInRequest(peerSet, r, PEER_OFFENSE_MALFORMED_RESPONSE)
+			respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing body into block!"))
 			return
 		}
 
 		// If the block is valid, further propegate it
-		if ok := chain.InsertBlockAndPlaceIntoAppendage(newBlock); ok {
-			sendBlockBytesToPeers(peerSet, byt)
+		if err := node.ReceiveBlock(newBlock, senderOfRequest(peerSet, r)); err != nil {
+			respondError(w, r, err)
+			return
 		}
 		render.JSON(w, r, map[string]interface{}{"status": "ok"})
 	})
 
-	r.Get("/v1/chain", func(w http.ResponseWriter, r *http.Request) {
+	// Encoding the whole chain is the most expensive thing a node serves
+	r.With(limitConcurrency(API_MAX_CONCURRENT_CHAIN_REQUESTS)).Get("/v1/chain", func(w http.ResponseWriter, r *http.Request) {
+		if WireFormatOfAccept(r) == WIRE_FORMAT_BINARY {
+			byt, err := EncodeChain(chain)
+			if err != nil {
+				respondError(w, r, NewAPIError(ERROR_CODE_INTERNAL, "Failed to encode chain!"))
+				return
+			}
+			writeBinary(w, byt)
+			return
+		}
 		render.JSON(w, r, chain)
 	})
 
 	r.Get("/v1/blocks/{hash}", func(w http.ResponseWriter, r *http.Request) {
-		hash, err := HexToBlockHash(chi.URLParam(r, "hash"))
+		block, err := findBlock(chain, chi.URLParam(r, "hash"))
 		if err != nil {
-			render.JSON(w, r, map[string]interface{}{"error": "Error parsing block hash!"})
+			respondError(w, r, err)
 			return
 		}
-		if hash == nil {
-			render.JSON(w, r, map[string]interface{}{"error": "Hash is nil!"})
+		view, err := ResponseViewOf(r)
+		if err != nil {
+			respondError(w, r, err)
+			return
 		}
-		block := chain.GetBlockWithHash(*hash)
-		if block == nil {
-			render.JSON(w, r, map[string]interface{}{"error": "Block not found!"})
+
+		if view == RESPONSE_VIEW_JSON {
+			blockView, err := NewBlockView(block, block.Height())
+			if err != nil {
+				respondError(w, r, err)
+				return
+			}
+			render.JSON(w, r, map[string]interface{}{"block": blockView})
+		} else if WireFormatOfAccept(r) == WIRE_FORMAT_BINARY {
+			byt, err := block.Encode()
+			if err != nil {
+				respondError(w, r, NewAPIError(ERROR_CODE_INTERNAL, "Failed to encode block!"))
+				return
+			}
+			writeBinary(w, byt)
 		} else {
 			byt, err := block.Serialize()
 			if err != nil {
-				render.JSON(w, r, map[string]interface{}{"error": "Failed to serialize block!"})
+				respondError(w, r, NewAPIError(ERROR_CODE_INTERNAL, "Failed to serialize block!"))
 				return
 			}
 			render.JSON(w, r, map[string]interface{}{"block": string(byt)})
 		}
 	})
 
+	mountExplorerRoutes(r, chain)
+
 	r.Get("/v1/mempool", func(w http.ResponseWriter, r *http.Request) {
-		render.JSON(w, r, memPool)
+		view, err := ResponseViewOf(r)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		if view == RESPONSE_VIEW_RAW {
+			render.JSON(w, r, memPool)
+			return
+		}
+
+		transactions, err := NewTransactionViews(memPool.List())
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		render.JSON(w, r, map[string]interface{}{"transactions": transactions})
 	})
 
 	r.Get("/v1/me", func(w http.ResponseWriter, r *http.Request) {
-		render.JSON(w, r, peerSet.Me)
+		info, err := peerSet.MeInfo(r.URL.Query().Get("challenge"))
+		if err != nil {
+			respondError(w, r, NewAPIError(ERROR_CODE_INTERNAL, "Failed to sign challenge!"))
+			return
+		}
+		render.JSON(w, r, info)
+	})
+
+	r.With(limitConcurrency(API_MAX_EVENT_SUBSCRIBERS)).Get("/v1/events", node.events.Serve)
+	r.With(limitConcurrency(API_MAX_CONCURRENT_RPC_REQUESTS)).Post("/rpc", NewRPCServer(node).Serve)
+	graphQLSchema := NewGraphQLSchema(node)
+	graphQLLimited := limitConcurrency(API_MAX_CONCURRENT_GRAPHQL_REQUESTS)
+	r.With(graphQLLimited).Get("/graphql", graphQLSchema.Serve)
+	r.With(graphQLLimited).Post("/graphql", graphQLSchema.Serve)
+
+	r.Get("/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, map[string]interface{}{"broadcast": node.broadcaster.Metrics()})
 	})
 
 	r.Get("/v1/peers", func(w http.ResponseWriter, r *http.Request) {
 		// Add this peer if we've never heard of them before
-		addPeerInRequest(peerSet, r)
+		addPeerInRequest(node, r)
 
 		render.JSON(w, r, map[string]interface{}{"peers": peerSet.List()})
 	})
 
+	// Share recently seen peers, along with when they were last seen
+	r.Get("/v1/addresses", func(w http.ResponseWriter, r *http.Request) {
+		addPeerInRequest(node, r)
+
+		render.JSON(w, r, map[string]interface{}{"addresses": node.Addresses()})
+	})
+
+	// Get the values a client needs to build a transaction without talking to the node again
+	r.Get("/v1/transactions/params", func(w http.ResponseWriter, r *http.Request) {
+		address := Address(r.URL.Query().Get("address"))
+		if len(address) == 0 {
+			respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "address is required!"))
+			return
+		}
+
+		render.JSON(w, r, map[string]interface{}{
+			"address": address,
+			"nonce":   node.NextNonce(address),
+			"fee":     NODE_SUGGESTED_TRANSACTION_FEE,
+		})
+	})
+
+	if node.links != nil {
+		r.Get("/v1/ws", node.links.Serve)
+	}
+	if node.webhooks != nil {
+		mountWebhookRoutes(r, node.webhooks, adminToken)
+	}
+
+	if len(adminToken) > 0 {
+		r.Route("/v1/admin", func(r chi.Router) {
+			mountAdminRoutes(r, peerSet, adminToken)
+		})
+	}
+
 	// Submit a transaction, eiher from a client or a peer
 	r.Post("/v1/transactions", func(w http.ResponseWriter, r *http.Request) {
-		byt, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			render.JSON(w, r, map[string]interface{}{"error": "Error readng body!"})
+		byt, ok := readBody(w, r, API_MAX_TRANSACTION_BODY_SIZE)
+		if !ok {
 			return
 		}
-		transaction, err := NewTransactionFromBytes(byt)
+		transaction, err := WireFormatOfContentType(r.Header.Get("Content-Type")).DecodeTransaction(byt)
 		if err != nil {
-			render.JSON(w, r, map[string]interface{}{"error": "Error parsing transaction!"})
+			penalizePeerInRequest(peerSet, r, PEER_OFFENSE_MALFORMED_RESPONSE)
+			respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing transaction!"))
 			return
 		}
 
-		if ok := memPool.Submit(transaction); ok {
-			// If the transaction was newly added to the mempool, proegate it to other nodes
-			for _, peer := range peerSet.ListOthers() {
-				resp, err := http.Post(
-					fmt.Sprintf("%s/v1/transactions", peer.Address),
-					"text/plain",
-					bytes.NewBuffer(byt),
-				)
-				if err != nil {
-					fmt.Printf("Failed to propegate transaction to peer %s! %s\n", uuid.UUID(peer.Id).String(), err)
-					peerSet.Decrement(peer.Id, NODE_PEER_OFFLINE_DECREMENT)
-					continue
-				}
-				if resp.StatusCode != 200 {
-					fmt.Printf("Failed to propegate transaction to peer %s, failed with %d!\n", peer, resp.StatusCode)
-					peerSet.Decrement(peer.Id, NODE_PEER_INVALID_REQUEST_DECREMENT)
-					continue
-				}
-			}
+		// If the transaction was newly added to the mempool, proegate it to other nodes
+		if err := node.ReceiveTransaction(transaction, senderOfRequest(peerSet, r)); err != nil {
+			respondError(w, r, err)
+			return
 		}
+		render.JSON(w, r, map[string]interface{}{"status": "ok"})
 	})
 
-	var wg sync.WaitGroup
-	wg.Add(3)
-
-	// HTTP SERVER
-	go func() {
-		defer wg.Done()
-
-		port := ":3000"
-		if rawPort, ok := os.LookupEnv("PORT"); ok {
-			port = fmt.Sprintf(":%s", rawPort)
+	r.Get("/v1/transactions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		transaction, block, err := findTransaction(chain, memPool, chi.URLParam(r, "id"))
+		if err != nil {
+			respondError(w, r, err)
+			return
 		}
-		fmt.Printf("Running on %s\n", port)
-
-		http.ListenAndServe(port, r)
-	}()
-
-	// MANAGE PEERS
-	go func() {
-		defer wg.Done()
-
-		if len(*peersRaw) > 0 {
-			// If there are peers... connect to them!
-			fmt.Println("Setting up peerset...")
-			peers := strings.Split(*peersRaw, ",")
-			for _, rawPeerAddress := range peers {
-				peerAddress := strings.Trim(rawPeerAddress, " ")
-				if err := peerSet.InsertByAddress(peerAddress); err != nil {
-					panic(err)
-				}
-			}
-			peerSet.Refresh()
-			fmt.Printf("Peerset configured, %d valid peer(s) found\n", peerSet.Count())
-		} else {
-			fmt.Println("No valid peers found.")
+		view, err := ResponseViewOf(r)
+		if err != nil {
+			respondError(w, r, err)
+			return
 		}
 
-		if peerSet.Count() > 1 {
-			// TODO: Ask the one we trust the most to give us a chain!
-			// FIXME: This is a pretty import operation and could be the source of DOS attacks
-			highestTrustedPeer := peerSet.ListOthers()[0]
-			// FIXME: there must be a better way to make sure we aren't talking to ourself
-			if highestTrustedPeer.Address == peerSet.Me.Address {
-				highestTrustedPeer = peerSet.ListOthers()[1]
-			}
-			fmt.Printf("Begin syncing chain from peer %s\n", uuid.UUID(highestTrustedPeer.Id).String())
-			resp, err := http.Get(fmt.Sprintf("%s/v1/chain", highestTrustedPeer.Address))
+		if view == RESPONSE_VIEW_JSON {
+			transactionView, err := NewIncludedTransactionView(transaction, block)
 			if err != nil {
-				panic(fmt.Sprintf("Failed to get chain from peer with address %s! %s\n", highestTrustedPeer.Address, err))
-			}
-			if resp.StatusCode != 200 {
-				panic(fmt.Sprintf("Failed to get chain from peer with address %s, failed with %d!\n", highestTrustedPeer.Address, resp.StatusCode))
-			}
-			fmt.Printf("Got chain data from peer %s\n", uuid.UUID(highestTrustedPeer.Id).String())
-
-			defer resp.Body.Close()
-			body, err2 := ioutil.ReadAll(resp.Body)
-			if err2 != nil {
-				panic(fmt.Sprintf("Failed to parse body when getting chain from peer with address %s! %s\n", highestTrustedPeer.Address, err2))
-			}
-			var response struct {
-				Appendages []*struct {
-					EncodedGenesis string    `json:"genesis"`
-					EncodedHead    string    `json:"head"`
-					Length         uint      `json:"chain_length"`
-					UpdatedAt      time.Time `json:"updated_at"`
-				} `json:"appendages"`
+				respondError(w, r, err)
+				return
 			}
-			err = json.Unmarshal(body, &response)
+			render.JSON(w, r, map[string]interface{}{"transaction": transactionView})
+		} else if WireFormatOfAccept(r) == WIRE_FORMAT_BINARY {
+			byt, err := transaction.Encode()
 			if err != nil {
-				panic(fmt.Sprintf("Failed to parse json body when getting chain from peer with address %s! %s\n", highestTrustedPeer.Address, err))
-			}
-
-			fmt.Printf("Fetching data from %d appendage(s)...\n", len(response.Appendages))
-			for _, appendage := range response.Appendages {
-				headBlock, err := NewBlockFromBytes(chain, []byte(appendage.EncodedHead))
-				if err != nil {
-					panic(fmt.Sprintf("Failed to parse head block when getting chain from peer with address %s! %s\n", highestTrustedPeer.Address, err))
-				}
-
-				genesisBlock, err2 := NewBlockFromBytes(chain, []byte(appendage.EncodedGenesis))
-				if err2 != nil {
-					panic(fmt.Sprintf("Failed to parse head block when getting chain from peer with address %s! %s\n", highestTrustedPeer.Address, err2))
-				}
-
-				chainLength := uint(0)
-
-				chain.InsertBlock(headBlock)
-				currentBlock := headBlock
-				chainLength += 1
-				fmt.Printf("Added head block %x in appendage\n", *headBlock.Hash)
-
-				// fmt.Printf("GENESIS=%+v HEAD=%+v\n", genesisBlock, headBlock)
-
-				// Starting at the head, trace the chain all the way back to the genesis
-				for fmt.Sprintf("%x", *currentBlock.Hash) != fmt.Sprintf("%x", *genesisBlock.Hash) {
-					chainLength += 1
-					previousHash := currentBlock.Previous.Hash
-					fmt.Printf("Fetching block %x...\n", *previousHash)
-
-					// fetch previous block
-					resp, err := http.Get(fmt.Sprintf("%s/v1/blocks/%x", highestTrustedPeer.Address, *previousHash))
-					if err != nil {
-						panic(fmt.Sprintf("Failed to get block %x from peer with address %s! %s\n", previousHash, highestTrustedPeer.Address, err))
-					}
-					if resp.StatusCode != 200 {
-						panic(fmt.Sprintf("Failed to get block %x from peer with address %s, failed with %d!\n", previousHash, highestTrustedPeer.Address, resp.StatusCode))
-					}
-
-					defer resp.Body.Close()
-					body, err2 := ioutil.ReadAll(resp.Body)
-					if err2 != nil {
-						panic(fmt.Sprintf("Failed to parse body when getting block %x from peer with address %s! %s\n", previousHash, highestTrustedPeer.Address, err2))
-					}
-					var response struct {
-						Block string `json:"block"`
-					}
-					err = json.Unmarshal(body, &response)
-					if err != nil {
-						panic(fmt.Sprintf("Failed to parse json body when getting chain from peer with address %s! %s\n", highestTrustedPeer.Address, err))
-					}
-
-					previousBlock, err := NewBlockFromBytes(chain, []byte(response.Block))
-					if err != nil {
-						panic(fmt.Sprintf("Failed to parse block when getting block %x from peer with address %s! %s\n", previousBlock, highestTrustedPeer.Address, err))
-					}
-
-					chain.InsertBlock(previousBlock)
-					currentBlock = previousBlock
-				}
-
-				chain.Appendages = append(chain.Appendages, &BlockchainAppendage{
-					Genesis:   genesisBlock,
-					Head:      headBlock,
-					Length:    chainLength,
-					UpdatedAt: appendage.UpdatedAt,
-				})
-
-				fmt.Printf("Fetched %d block(s) in appendage\n", chainLength)
+				respondError(w, r, NewAPIError(ERROR_CODE_INTERNAL, "Failed to encode transaction!"))
+				return
 			}
+			writeBinary(w, byt)
 		} else {
-			// We're on our own... so start our own chain!
-			newBlock := NewBlock(nil, []*Transaction{})
-			newBlock.Mine()
-			chain.InsertBlockAndPlaceIntoAppendage(newBlock)
-			fmt.Printf("Created genesis block: %x\n", *newBlock.Hash)
-		}
-
-		for {
-			time.Sleep(5 * time.Second)
-			peerSet.Refresh()
-		}
-	}()
-
-	// MINING
-	go func() {
-		defer wg.Done()
-
-		// Later on, a miner does this:
-		for {
-			time.Sleep(5 * time.Second)
-
-			if len(memPool.Transactions) == 0 {
-				continue
-			}
-
-			primaryAppendage := chain.PrimaryAppendage()
-			if primaryAppendage == nil {
-				fmt.Println("There is not a primary appendage, so cannot process new transactions from the mempool!")
-				continue
-			}
-
-			newBlock := NewBlock(
-				NewLazyBlock(chain, primaryAppendage.Head),
-				memPool.Transactions,
-			)
-			newBlock.Mine()
-			fmt.Printf("Mined new block: %x\n", newBlock.Hash)
-
-			byt, err := newBlock.Serialize()
+			byt, err := transaction.Serialize()
 			if err != nil {
-				fmt.Printf("Cannot serialize block: %s\n", err)
-				continue
+				respondError(w, r, NewAPIError(ERROR_CODE_INTERNAL, "Failed to serialize transaction!"))
+				return
 			}
+			render.JSON(w, r, map[string]interface{}{"transaction": string(byt)})
+		}
+	})
 
-			// Add block to chain
-			chain.InsertBlockAndPlaceIntoAppendage(newBlock)
-
-			// Clear mempool - these transactions are now in the new block!
-			memPool.Clear()
+	// Peers announce new blocks and transactions here, and this node fetches the ones it hasn't seen
+	r.Post("/v1/inventory", func(w http.ResponseWriter, r *http.Request) {
+		byt, ok := readBody(w, r, API_MAX_INVENTORY_BODY_SIZE)
+		if !ok {
+			return
+		}
+		var announcement struct {
+			Items []InventoryItem `json:"items"`
+		}
+		if err := json.Unmarshal(byt, &announcement); err != nil {
+			penalizePeerInRequest(peerSet, r, PEER_OFFENSE_MALFORMED_RESPONSE)
+			respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing announcement!"))
+			return
+		}
 
-			// Prepegate it to others!
-			sendBlockBytesToPeers(peerSet, byt)
-			// fmt.Sprintf(string(byt))
+		// Only announcements from known peers are acted on, since the items get fetched from the peer
+		// that announced them. A peer this node hasn't heard of yet gets a chance to introduce itself.
+		addPeerInRequest(node, r)
+		from, ok := peerInRequest(peerSet, r)
+		if !ok {
+			respondError(w, r, NewAPIError(ERROR_CODE_FORBIDDEN, "Announcements are only accepted from known peers!"))
+			return
 		}
-	}()
 
-	wg.Wait()
+		node.ReceiveAnnouncement(from, announcement.Items)
+		render.JSON(w, r, map[string]interface{}{"status": "ok"})
+	})
+
+	return r
 }
 
 func submit(args []string) {
@@ -404,6 +478,9 @@ func submit(args []string) {
 	addressRaw := submitCmd.String("address", "", "Network address to submit transaction to")
 	keyRaw := submitCmd.String("key", "", "File path to rsa private key")
 	data := submitCmd.String("data", "", "Data to include in the transaction")
+	validAfter := submitCmd.Uint64("valid-after", 0, "Block height or unix timestamp the transaction is not valid before")
+	validUntil := submitCmd.Uint64("valid-until", 0, "Block height or unix timestamp the transaction is not valid after")
+	tlsOptions := addTLSFlags(submitCmd)
 
 	if err := submitCmd.Parse(args); err != nil {
 		panic(err)
@@ -421,28 +498,30 @@ func submit(args []string) {
 		panic("--key is required!")
 	}
 
-	privateFile, err1 := ioutil.ReadFile(*keyRaw)
-	if err1 != nil {
-		panic(err1)
+	privateKey, err := ReadPrivateKeyFile(*keyRaw)
+	if err != nil {
+		panic(err)
 	}
 
-	block, _ := pem.Decode(privateFile)
-	if block == nil || block.Type != "RSA PRIVATE KEY" {
-		panic("Corrupted key!")
-	}
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	client, err := tlsOptions.HTTPClient()
 	if err != nil {
 		panic(err)
 	}
 
 	dataBytes := []byte(*data)
-	transaction := NewTransaction(privateKey, 0, dataBytes)
+	transaction := NewTransaction(privateKey, 0, dataBytes, SystemEntropy)
+	params, err := fetchTransactionParams(client, *addressRaw, transaction.SenderPublicKey.Address())
+	if err != nil {
+		panic(err)
+	}
+	transaction.Nonce = params.Nonce
+	transaction.ValidAfter = *validAfter
+	transaction.ValidUntil = *validUntil
 	byt, err := transaction.Serialize()
 	if err != nil {
 		panic(err)
 	}
-
-	resp, err := http.Post(
+	resp, err := client.Post(
 		fmt.Sprintf("%s/v1/transactions", *addressRaw),
 		"text/plain",
 		bytes.NewBuffer(byt),
@@ -450,8 +529,10 @@ func submit(args []string) {
 	if err != nil {
 		panic(err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		fmt.Println(resp.StatusCode)
+		fmt.Fprintf(os.Stderr, "Node rejected transaction %s! %s\n", transaction.Id, statusErrorOfResponse(resp))
+		os.Exit(1)
 	}
 }
 
@@ -459,6 +540,7 @@ func generate(args []string) {
 	generateCmd := flag.NewFlagSet("generate", flag.ExitOnError)
 
 	filename := generateCmd.String("filename", "", "Filename prefix to write key into")
+	publicFilename := generateCmd.String("public-filename", "", "Optional filename to write the public key into, for use with 'tx build'")
 
 	if err := generateCmd.Parse(args); err != nil {
 		panic(err)
@@ -473,20 +555,15 @@ func generate(args []string) {
 		panic(err)
 	}
 
-	privateFile, err1 := os.OpenFile(*filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err1 != nil {
-		panic(err1)
+	if err := WritePrivateKeyFile(*filename, privateKey); err != nil {
+		panic(err)
 	}
 
-	err = pem.Encode(
-		privateFile,
-		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-		},
-	)
-	if err != nil {
-		panic(err)
+	if len(*publicFilename) > 0 {
+		publicKey := PublicKey(privateKey.PublicKey)
+		if err := WritePublicKeyFile(*publicFilename, &publicKey); err != nil {
+			panic(err)
+		}
 	}
 }
 
@@ -503,6 +580,12 @@ func main() {
 		submit(os.Args[2:])
 	case "generate":
 		generate(os.Args[2:])
+	case "tx":
+		transactionCommand(os.Args[2:])
+	case "simulate":
+		simulate(os.Args[2:])
+	case "webhook-listen":
+		webhookListen(os.Args[2:])
 	case "help":
 		fmt.Println("This application implements a toy blockchain so that I can learn more about how they work.")
 		fmt.Println("For more info on the whole system and how it works, see https://github.com/rgaus/blockchain")
@@ -511,6 +594,11 @@ func main() {
 		fmt.Println("- node")
 		fmt.Println("- submit")
 		fmt.Println("- generate")
+		fmt.Println("- tx build")
+		fmt.Println("- tx sign")
+		fmt.Println("- tx broadcast")
+		fmt.Println("- simulate")
+		fmt.Println("- webhook-listen")
 		fmt.Println()
 		fmt.Printf("For help on any of the subcommands, run '%s <subcommand> --help'\n", os.Args[0])
 	default:
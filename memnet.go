@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// A MemoryNetwork connects nodes running in the same process, so that many nodes can be run together
+// without opening any ports. Everything sent between nodes is still encoded and decoded with the
+// wire format, so nodes never share blocks or transactions with each other.
+//
+// To see how nodes cope with a less than perfect network, requests can be delayed, dropped at random,
+// or blocked entirely between nodes on either side of a partition.
+type MemoryNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+
+	entropy *Entropy
+	latency time.Duration
+	jitter  time.Duration
+	loss    float64
+	// The partition each address is in. Nodes in different partitions can't reach each other, and
+	// nodes that aren't in any partition can reach everyone.
+	partitions map[string]int
+}
+
+func NewMemoryNetwork(entropy *Entropy) *MemoryNetwork {
+	return &MemoryNetwork{nodes: map[string]*Node{}, entropy: entropy}
+}
+
+// Make a node reachable at its configured address
+func (net *MemoryNetwork) Join(node *Node) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.nodes[node.config.Address] = node
+}
+
+// Make a node unreachable, as if it had gone offline
+func (net *MemoryNetwork) Leave(address string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	delete(net.nodes, address)
+}
+
+// Returns a transport for the given node to talk to the others with, suitable for passing to NewNode
+func (net *MemoryNetwork) Transport(me Peer) Transport {
+	return &memoryTransport{network: net, me: me}
+}
+
+// Delay every request by latency, plus up to jitter more at random
+func (net *MemoryNetwork) SetLatency(latency time.Duration, jitter time.Duration) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.latency = latency
+	net.jitter = jitter
+}
+
+// Drop this fraction of requests (0 to 1), as if the peer couldn't be reached
+func (net *MemoryNetwork) SetLoss(loss float64) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.loss = loss
+}
+
+// Split the network so that nodes can only reach others in the same group
+func (net *MemoryNetwork) Partition(groups [][]string) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.partitions = map[string]int{}
+	for index, group := range groups {
+		for _, address := range group {
+			net.partitions[address] = index
+		}
+	}
+}
+
+// Undo a partition, so every node can reach every other again
+func (net *MemoryNetwork) Heal() {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	net.partitions = nil
+}
+
+// Find the node at an address, as reached from another. Requests that the network conditions don't
+// let through fail the same way as a request to a node that's offline.
+func (net *MemoryNetwork) lookup(from string, address string) (*Node, error) {
+	net.mu.Lock()
+	node, ok := net.nodes[address]
+	fromPartition, fromPartitioned := net.partitions[from]
+	toPartition, toPartitioned := net.partitions[address]
+	lost := net.loss > 0 && net.entropy.Float64() < net.loss
+	delay := net.latency
+	if net.jitter > 0 {
+		delay += time.Duration(net.entropy.Int63n(int64(net.jitter)))
+	}
+	net.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if !ok {
+		return nil, PeerUnreachableError{errors.New(fmt.Sprintf("No node at address %s", address))}
+	}
+	if fromPartitioned && toPartitioned && fromPartition != toPartition {
+		return nil, PeerUnreachableError{errors.New(fmt.Sprintf("Node at address %s is on the other side of a partition", address))}
+	}
+	if lost {
+		return nil, PeerUnreachableError{errors.New(fmt.Sprintf("Request to %s was lost", address))}
+	}
+	return node, nil
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	me      Peer
+}
+
+// An error from the node on the other end, as the http transport would have returned it
+func peerStatusErrorOf(err error) error {
+	var apiError APIError
+	if !errors.As(err, &apiError) {
+		apiError = NewAPIError(ERROR_CODE_INTERNAL, err.Error())
+	}
+	return PeerStatusError{StatusCode: apiError.Code.StatusCode(), Code: apiError.Code, Message: apiError.Message}
+}
+
+// The sender, as the node on the other end would see it. Over http, only known peers are believed
+// about who they are, so the same goes here.
+func (t *memoryTransport) sender(node *Node) *PeerId {
+	if !node.peerSet.Has(t.me.Id) {
+		return nil
+	}
+	id := t.me.Id
+	return &id
+}
+
+func (t *memoryTransport) GetMe(address string, challenge string) (PeerInfo, error) {
+	node, err := t.network.lookup(t.me.Address, address)
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	return node.Info(challenge)
+}
+
+func (t *memoryTransport) GetPeers(address string) ([]Peer, error) {
+	node, err := t.network.lookup(t.me.Address, address)
+	if err != nil {
+		return nil, err
+	}
+	node.Introduce(t.me)
+	return node.Peers(), nil
+}
+
+func (t *memoryTransport) GetAddresses(address string) ([]PeerAddress, error) {
+	node, err := t.network.lookup(t.me.Address, address)
+	if err != nil {
+		return nil, err
+	}
+	node.Introduce(t.me)
+	return node.Addresses(), nil
+}
+
+func (t *memoryTransport) GetChain(address string, format WireFormat, chain *Blockchain) ([]*BlockchainAppendage, error) {
+	node, err := t.network.lookup(t.me.Address, address)
+	if err != nil {
+		return nil, err
+	}
+	var byt []byte
+	if format == WIRE_FORMAT_BINARY {
+		byt, err = EncodeChain(node.chain)
+	} else {
+		byt, err = json.Marshal(node.chain)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return DecodeChain(chain, format, byt)
+}
+
+func (t *memoryTransport) GetBlock(address string, format WireFormat, chain *Blockchain, hash BlockHash) (*Block, error) {
+	node, err := t.network.lookup(t.me.Address, address)
+	if err != nil {
+		return nil, err
+	}
+	block := node.Block(hash)
+	if block == nil {
+		return nil, peerStatusErrorOf(NewAPIError(ERROR_CODE_NOT_FOUND, "Block not found!"))
+	}
+	byt, err := format.EncodeBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	return format.DecodeBlock(chain, byt)
+}
+
+func (t *memoryTransport) GetTransaction(address string, format WireFormat, id uuid.UUID) (*Transaction, error) {
+	node, err := t.network.lookup(t.me.Address, address)
+	if err != nil {
+		return nil, err
+	}
+	transaction := node.Transaction(id)
+	if transaction == nil {
+		return nil, peerStatusErrorOf(NewAPIError(ERROR_CODE_NOT_FOUND, "Transaction not found!"))
+	}
+	byt, err := format.EncodeTransaction(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return format.DecodeTransaction(byt)
+}
+
+// Like the http endpoints, a node rejecting a pushed item comes back as a PeerStatusError with the
+// reason it gave
+func (t *memoryTransport) PushBlock(address string, format WireFormat, block *Block) error {
+	node, err := t.network.lookup(t.me.Address, address)
+	if err != nil {
+		return err
+	}
+	byt, err := format.EncodeBlock(block)
+	if err != nil {
+		return err
+	}
+	received, err := format.DecodeBlock(node.chain, byt)
+	if err != nil {
+		if from := t.sender(node); from != nil {
+			node.peerSet.Penalize(*from, PEER_OFFENSE_MALFORMED_RESPONSE)
+		}
+		return peerStatusErrorOf(NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing body into block!"))
+	}
+	if err := node.ReceiveBlock(received, t.sender(node)); err != nil {
+		return peerStatusErrorOf(err)
+	}
+	return nil
+}
+
+func (t *memoryTransport) PushTransaction(address string, format WireFormat, transaction *Transaction) error {
+	node, err := t.network.lookup(t.me.Address, address)
+	if err != nil {
+		return err
+	}
+	byt, err := format.EncodeTransaction(transaction)
+	if err != nil {
+		return err
+	}
+	received, err := format.DecodeTransaction(byt)
+	if err != nil {
+		if from := t.sender(node); from != nil {
+			node.peerSet.Penalize(*from, PEER_OFFENSE_MALFORMED_RESPONSE)
+		}
+		return peerStatusErrorOf(NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing transaction!"))
+	}
+	if err := node.ReceiveTransaction(received, t.sender(node)); err != nil {
+		return peerStatusErrorOf(err)
+	}
+	return nil
+}
+
+func (t *memoryTransport) Announce(address string, items []InventoryItem) error {
+	node, err := t.network.lookup(t.me.Address, address)
+	if err != nil {
+		return err
+	}
+	node.Introduce(t.me)
+	if from := t.sender(node); from != nil {
+		node.ReceiveAnnouncement(*from, items)
+	}
+	return nil
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"github.com/google/uuid"
+	"sort"
+	"sync"
+	"time"
 )
 
 type MemPool struct {
 	Transactions []*Transaction
+
+	mu sync.Mutex
 }
 
 func NewMemPool() *MemPool {
@@ -13,7 +19,10 @@ func NewMemPool() *MemPool {
 		Transactions: []*Transaction{},
 	}
 }
-func (m MemPool) MarshalJSON() ([]byte, error) {
+func (m *MemPool) MarshalJSON() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	var serializedTransactions = []string{}
 	for _, t := range m.Transactions {
 		serializedBytes, err := t.Serialize()
@@ -27,16 +36,146 @@ func (m MemPool) MarshalJSON() ([]byte, error) {
 		"transactions": serializedTransactions,
 	})
 }
+
+// Add a transaction, returning false if it or another transaction with the same sender and nonce
+// is already in the mempool
 func (m *MemPool) Submit(txn *Transaction) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	address := txn.SenderPublicKey.Address()
 	for _, t := range m.Transactions {
 		if t.Id == txn.Id {
 			return false
 		}
+		if t.Nonce == txn.Nonce && t.SenderPublicKey.Address() == address {
+			return false
+		}
 	}
 
 	m.Transactions = append(m.Transactions, txn)
 	return true
 }
+
+// Drop all transactions which can no longer be included in a block at the given height and time,
+// either because they've expired or because their sender has already used their nonce. nextNonce
+// gives the nonce each address's next transaction in the block has to have.
+func (m *MemPool) Prune(height uint64, at time.Time, nextNonce func(address Address) uint64) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nonces := map[Address]uint64{}
+	var transactions = []*Transaction{}
+	for _, t := range m.Transactions {
+		address := t.SenderPublicKey.Address()
+		nonce, ok := nonces[address]
+		if !ok {
+			nonce = nextNonce(address)
+			nonces[address] = nonce
+		}
+		if t.LockStatus(height, at) != TRANSACTION_LOCK_EXPIRED && t.Nonce >= nonce {
+			transactions = append(transactions, t)
+		}
+	}
+	removed := len(m.Transactions) - len(transactions)
+	m.Transactions = transactions
+	return removed
+}
+
+// Returns the transactions which can be included in a block at the given height and time. Future
+// locked transactions are held in the mempool until they become valid, along with any transactions
+// from the same sender with a later nonce.
+func (m *MemPool) Ready(height uint64, at time.Time, nextNonce func(address Address) uint64) []*Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var senders []Address
+	bySender := map[Address][]*Transaction{}
+	for _, t := range m.Transactions {
+		address := t.SenderPublicKey.Address()
+		if _, ok := bySender[address]; !ok {
+			senders = append(senders, address)
+		}
+		bySender[address] = append(bySender[address], t)
+	}
+
+	var transactions = []*Transaction{}
+	for _, address := range senders {
+		pending := bySender[address]
+		sort.Slice(pending, func(i, j int) bool { return pending[i].Nonce < pending[j].Nonce })
+
+		nonce := nextNonce(address)
+		for _, t := range pending {
+			if t.Nonce < nonce {
+				continue
+			}
+			if t.Nonce > nonce || t.LockStatus(height, at) != TRANSACTION_LOCK_VALID {
+				break
+			}
+			transactions = append(transactions, t)
+			nonce += 1
+		}
+	}
+	return transactions
+}
+func (m *MemPool) Remove(txns []*Transaction) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var transactions = []*Transaction{}
+	for _, t := range m.Transactions {
+		found := false
+		for _, txn := range txns {
+			if t.Id == txn.Id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			transactions = append(transactions, t)
+		}
+	}
+	m.Transactions = transactions
+}
+func (m *MemPool) Get(id uuid.UUID) *Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.Transactions {
+		if t.Id == id {
+			return t
+		}
+	}
+	return nil
+}
+func (m *MemPool) List() []*Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	transactions := make([]*Transaction, len(m.Transactions))
+	copy(transactions, m.Transactions)
+	return transactions
+}
+func (m *MemPool) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.Transactions)
+}
 func (m *MemPool) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.Transactions = []*Transaction{}
 }
+
+// The nonce an address's next transaction should have, given the nonce its next transaction in a
+// block has to have. Transactions waiting in the mempool use up the nonces after that one.
+func (m *MemPool) NextNonce(address Address, confirmed uint64) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	used := map[uint64]bool{}
+	for _, t := range m.Transactions {
+		if t.SenderPublicKey.Address() == address {
+			used[t.Nonce] = true
+		}
+	}
+	nonce := confirmed
+	for used[nonce] {
+		nonce += 1
+	}
+	return nonce
+}
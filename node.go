@@ -0,0 +1,457 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+// The interval the peer manager and miner wake up at
+const NODE_TICK_INTERVAL = 5 * time.Second
+
+type NodeConfig struct {
+	// Network address other peers can use to reach this node
+	Address string
+	// Peers to connect to when starting up. Unlike remembered peers, failing to reach these is fatal.
+	Peers        []string
+	WireFormat   WireFormat
+	DataDir      string
+	GossipFanout int
+	Websocket    bool
+	// Let clients register webhooks with `/v1/subscriptions`
+	Webhooks bool
+	// More places to find peers when starting up. Like remembered peers, these may be out of date,
+	// so failing to reach them isn't fatal.
+	BootstrapFile string
+	DNSSeeds      []string
+	Resolver      Resolver
+	// Used when dialing websocket links to peers, to check their certificates and present this node's
+	TLS *tls.Config
+	// Where the node gets the time and randomness from. Left unset, the system clock and entropy are
+	// used, and the simulator sets them to replay a scenario.
+	Clock   Clock
+	Entropy *Entropy
+}
+
+// A Node is everything that makes up one participant in the network, independent of how it talks
+// to other nodes. `setupNode` serves one over http, and the simulator runs many in one process.
+type Node struct {
+	config      NodeConfig
+	clock       Clock
+	chain       *Blockchain
+	memPool     *MemPool
+	transport   Transport
+	peerSet     *PeerSet
+	broadcaster *Broadcaster
+	gossip      *Gossip
+	links       *LinkManager
+	events      *EventLog
+	webhooks    *WebhookManager
+	// Peers that introduced themselves in http requests, waiting to be passed to Introduce
+	introductions *IntroductionQueue
+}
+
+func NewNode(config NodeConfig, nodeKey *rsa.PrivateKey, newTransport func(me Peer) Transport) *Node {
+	clock := config.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	entropy := config.Entropy
+	if entropy == nil {
+		entropy = SystemEntropy
+	}
+
+	chain := NewBlockchain(clock)
+	memPool := NewMemPool()
+	transport := newTransport(NewLocalPeer(config.Address, nodeKey))
+
+	// Copied so that adding to it doesn't change NODE_FEATURES for every other node in the process
+	features := append([]string{}, NODE_FEATURES...)
+	if config.Websocket {
+		features = append(features, FEATURE_WEBSOCKET_LINK)
+	}
+	peerSet := NewPeerSet(config.Address, nodeKey, transport, func() Handshake {
+		return NewHandshake(chain, features)
+	}, clock, entropy)
+
+	if config.Resolver != nil {
+		peerSet.resolver = config.Resolver
+	}
+
+	broadcaster := NewBroadcaster(peerSet)
+	gossip := NewGossip(peerSet, broadcaster, transport, chain, memPool, config.GossipFanout, config.WireFormat, clock, entropy)
+	events := NewEventLog(chain, clock)
+	gossip.events = events
+	peerSet.events = events
+	var links *LinkManager
+	if config.Websocket {
+		links = NewLinkManager(peerSet, gossip, chain, memPool, config.TLS)
+		gossip.links = links
+	}
+	var webhooks *WebhookManager
+	if config.Webhooks {
+		webhooks = NewWebhookManager(events, clock, entropy)
+	}
+
+	node := &Node{
+		config:      config,
+		clock:       clock,
+		chain:       chain,
+		memPool:     memPool,
+		transport:   transport,
+		peerSet:     peerSet,
+		broadcaster: broadcaster,
+		gossip:      gossip,
+		links:       links,
+		events:      events,
+		webhooks:    webhooks,
+	}
+	node.introductions = NewIntroductionQueue(peerSet, clock, node.Introduce)
+	return node
+}
+
+func (n *Node) Me() Peer {
+	return n.peerSet.Me
+}
+
+// Describe this node to a peer, signing the challenge if given (see `/v1/me`)
+func (n *Node) Info(challenge string) (PeerInfo, error) {
+	return n.peerSet.MeInfo(challenge)
+}
+
+// A peer has said who it is (ie, with X-Peer-Info), so add it if it can prove that's true. This
+// calls the peer back, so claims from http requests go through `introductions` first.
+func (n *Node) Introduce(claimed Peer) {
+	if n.peerSet.Has(claimed.Id) || n.peerSet.Untrusted(claimed.Id) {
+		return
+	}
+	// No point checking the claim if there's no room for the peer anyway
+	if !n.peerSet.HasSlot(PEER_DIRECTION_INBOUND) {
+		return
+	}
+
+	// The claim could say anything, so only add the peer once it proves it owns the id it claims
+	if err := n.peerSet.InsertClaimedPeer(claimed); err != nil {
+		fmt.Printf("Warning: failed to verify peer info: %s\n", err)
+	}
+}
+func (n *Node) Peers() []Peer {
+	return n.peerSet.List()
+}
+func (n *Node) Addresses() []PeerAddress {
+	return n.peerSet.Addresses()
+}
+func (n *Node) Block(hash BlockHash) *Block {
+	return n.chain.GetBlockWithHash(hash)
+}
+func (n *Node) Transaction(id uuid.UUID) *Transaction {
+	return n.memPool.Get(id)
+}
+
+// Handle a block or transaction sent by a client or peer. from is the peer that sent it, if known,
+// and is penalized if the item is invalid. An item that was already received gets a duplicate error.
+func (n *Node) ReceiveBlock(block *Block, from *PeerId) error {
+	accepted, err := n.gossip.AcceptBlock(block, from)
+	if err == nil && from != nil && !block.ParentKnown() {
+		err = n.gossip.FetchMissingAncestors(*from, block)
+	}
+	if err != nil {
+		if from != nil {
+			n.peerSet.Penalize(*from, PEER_OFFENSE_INVALID_BLOCK)
+		}
+		return err
+	}
+	if !accepted {
+		return NewAPIError(ERROR_CODE_DUPLICATE, fmt.Sprintf("Already have block %x!", *block.Hash))
+	}
+	return nil
+}
+func (n *Node) ReceiveTransaction(transaction *Transaction, from *PeerId) error {
+	accepted, err := n.gossip.AcceptTransaction(transaction, from)
+	if err != nil {
+		if from != nil && peerAtFault(err) {
+			n.peerSet.Penalize(*from, PEER_OFFENSE_INVALID_TRANSACTION)
+		}
+		return err
+	}
+	if !accepted {
+		return NewAPIError(ERROR_CODE_DUPLICATE, fmt.Sprintf("Already have transaction %s!", transaction.Id))
+	}
+	return nil
+}
+
+// The nonce an address's next transaction should have
+func (n *Node) NextNonce(address Address) uint64 {
+	return n.gossip.NextNonce(address)
+}
+
+// Only announcements from known peers are acted on, since the items get fetched from the peer that
+// announced them. Fetching could take a while, so it happens in the background, and announcements
+// are dropped if too many are already waiting.
+func (n *Node) ReceiveAnnouncement(from PeerId, items []InventoryItem) {
+	if !n.gossip.Enqueue(func() { n.gossip.HandleAnnouncement(from, items) }) {
+		fmt.Printf("Too many announcements waiting, dropping one from peer %s\n", uuid.UUID(from).String())
+	}
+}
+
+// Connect to the configured peers, along with any remembered from a previous run or found through
+// the bootstrap file and DNS seeds
+func (n *Node) Connect() error {
+	// Peers remembered from a previous run might have gone offline since, and the bootstrap file and
+	// DNS seeds might be out of date, so unlike peers passed with --peers, failing to reach them isn't
+	// fatal
+	var knownPeerAddresses []string
+	if len(n.config.DataDir) > 0 {
+		if err := n.peerSet.Load(n.config.DataDir); err != nil {
+			fmt.Printf("Warning: failed to load peer database: %s\n", err)
+		}
+		knownPeerAddresses = n.peerSet.KnownAddresses()
+	}
+	knownPeerAddresses = append(knownPeerAddresses, n.discoverAddresses()...)
+
+	if len(n.config.Peers) == 0 && len(knownPeerAddresses) == 0 {
+		fmt.Println("No valid peers found.")
+		return nil
+	}
+
+	// If there are peers... connect to them!
+	fmt.Println("Setting up peerset...")
+	for _, peerAddress := range n.config.Peers {
+		if err := n.peerSet.InsertByAddress(peerAddress); err != nil {
+			return err
+		}
+	}
+	for _, peerAddress := range knownPeerAddresses {
+		if !n.peerSet.HasSlot(PEER_DIRECTION_OUTBOUND) {
+			break
+		}
+		if err := n.peerSet.InsertByAddress(peerAddress); err != nil {
+			fmt.Printf("Known peer at %s is unreachable: %s\n", peerAddress, err)
+		}
+	}
+	n.peerSet.Refresh()
+	fmt.Printf("Peerset configured, %d valid peer(s) found\n", n.peerSet.Count())
+	return nil
+}
+
+// Collect addresses from the bootstrap file and DNS seeds
+func (n *Node) discoverAddresses() []string {
+	var addresses []string
+	if len(n.config.BootstrapFile) > 0 {
+		bootstrapAddresses, err := ReadBootstrapFile(n.config.BootstrapFile)
+		if err != nil {
+			fmt.Printf("Warning: failed to read bootstrap file: %s\n", err)
+		}
+		addresses = append(addresses, bootstrapAddresses...)
+	}
+
+	resolver := n.config.Resolver
+	if resolver == nil {
+		resolver = SystemResolver
+	}
+	for _, seed := range n.config.DNSSeeds {
+		seedAddresses, err := ResolveSeed(resolver, seed)
+		if err != nil {
+			fmt.Printf("Warning: failed to resolve DNS seed %s: %s\n", seed, err)
+			continue
+		}
+		fmt.Printf("DNS seed %s resolved to %d address(es)\n", seed, len(seedAddresses))
+		addresses = append(addresses, seedAddresses...)
+	}
+
+	// A node's own address could be listed too
+	var others []string
+	for _, address := range addresses {
+		if address != n.config.Address {
+			others = append(others, address)
+		}
+	}
+	return others
+}
+
+// Download the chain from the most trusted peer, or start a new chain if there are no peers. A peer
+// that sends an invalid chain is penalized, and the next most trusted peer is tried instead.
+func (n *Node) Sync() error {
+	if n.peerSet.Count() <= 1 {
+		// We're on our own... so start our own chain!
+		newBlock := NewBlock(nil, []*Transaction{}, n.clock.Now())
+		newBlock.Mine()
+		n.chain.InsertBlockAndPlaceIntoAppendage(newBlock)
+		n.events.ChainChanged()
+		fmt.Printf("Created genesis block: %x\n", *newBlock.Hash)
+		return nil
+	}
+
+	// FIXME: This is a pretty import operation and could be the source of DOS attacks
+	syncPeers := n.peerSet.SyncPeers()
+	if len(syncPeers) == 0 {
+		return errors.New("No peers completed a handshake, so there is no peer to sync the chain from!")
+	}
+	var err error
+	for _, peer := range syncPeers {
+		if err = n.syncFrom(peer); err == nil {
+			break
+		}
+		fmt.Printf("Failed to sync chain from peer %s! %s\n", uuid.UUID(peer.Id).String(), err)
+	}
+	n.events.ChainChanged()
+	return err
+}
+
+func (n *Node) syncFrom(peer Peer) error {
+	syncFormat := n.peerSet.WireFormatFor(peer.Id, n.config.WireFormat)
+	fmt.Printf("Begin syncing chain from peer %s\n", uuid.UUID(peer.Id).String())
+	appendages, err := n.transport.GetChain(peer.Address, syncFormat, n.chain)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to get chain from peer with address %s! %s", peer.Address, err))
+	}
+	fmt.Printf("Got chain data from peer %s\n", uuid.UUID(peer.Id).String())
+
+	fmt.Printf("Fetching data from %d appendage(s)...\n", len(appendages))
+	for _, appendage := range appendages {
+		headBlock := appendage.Head
+		if headBlock == nil || headBlock.Hash == nil {
+			continue
+		}
+
+		// Starting at the head, trace the chain back until reaching a block that's already known (ie,
+		// from another appendage) or the genesis
+		missing := []*Block{}
+		currentBlock := headBlock
+		for currentBlock != nil && n.chain.GetBlockWithHash(*currentBlock.Hash) == nil {
+			missing = append(missing, currentBlock)
+			if currentBlock.Previous == nil || currentBlock.Previous.Hash == nil {
+				break
+			}
+			previousHash := *currentBlock.Previous.Hash
+			if n.chain.GetBlockWithHash(previousHash) != nil {
+				break
+			}
+			fmt.Printf("Fetching block %x...\n", previousHash)
+
+			previousBlock, err := n.transport.GetBlock(peer.Address, syncFormat, n.chain, previousHash)
+			if err != nil {
+				return errors.New(fmt.Sprintf("Failed to get block %x from peer with address %s! %s", previousHash, peer.Address, err))
+			}
+			if previousBlock.Hash == nil || *previousBlock.Hash != previousHash {
+				n.peerSet.Penalize(peer.Id, PEER_OFFENSE_MALFORMED_RESPONSE)
+				return errors.New(fmt.Sprintf("Peer with address %s sent a different block than %x!", peer.Address, previousHash))
+			}
+			currentBlock = previousBlock
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		// Blocks can only be checked and added once their previous block is, so go oldest first
+		for index := len(missing) - 1; index >= 0; index -= 1 {
+			block := missing[index]
+			err := block.Validate()
+			if err == nil {
+				err = n.chain.ValidatePlacement(block)
+			}
+			if err != nil {
+				n.peerSet.Penalize(peer.Id, PEER_OFFENSE_INVALID_BLOCK)
+				return errors.New(fmt.Sprintf("Block %x from peer with address %s is invalid! %s", *block.Hash, peer.Address, err))
+			}
+			n.chain.InsertBlock(block)
+		}
+
+		genesisBlock := headBlock
+		for genesisBlock.Previous != nil && genesisBlock.Previous.Hash != nil {
+			previousBlock := genesisBlock.Previous.Unwrap()
+			if previousBlock == nil {
+				break
+			}
+			genesisBlock = previousBlock
+		}
+		n.chain.AddAppendage(&BlockchainAppendage{
+			Genesis:   genesisBlock,
+			Head:      headBlock,
+			Length:    uint(headBlock.Height()) + 1,
+			UpdatedAt: appendage.UpdatedAt,
+		})
+
+		fmt.Printf("Fetched %d block(s) in appendage\n", len(missing))
+	}
+	return nil
+}
+
+// Keep the peer set healthy, forever
+func (n *Node) ManagePeers() {
+	for {
+		n.clock.Sleep(NODE_TICK_INTERVAL)
+		n.peerSet.Refresh()
+		n.peerSet.ExchangeAddresses()
+		n.peerSet.RotateOutbound()
+		if n.links != nil {
+			n.links.Connect()
+		}
+
+		if len(n.config.DataDir) > 0 {
+			if err := n.peerSet.Save(n.config.DataDir); err != nil {
+				fmt.Printf("Warning: failed to save peer database: %s\n", err)
+			}
+		}
+	}
+}
+
+// Mine blocks out of the mempool, forever
+func (n *Node) Mine() {
+	for {
+		n.clock.Sleep(NODE_TICK_INTERVAL)
+		n.MineBlock()
+	}
+}
+
+// Mine a block containing every transaction in the mempool that's ready to be included, and
+// announce it to peers. Returns nil if there was nothing to mine.
+func (n *Node) MineBlock() *Block {
+	if n.memPool.Count() == 0 {
+		return nil
+	}
+
+	primaryAppendage := n.chain.PrimaryAppendage()
+	if primaryAppendage == nil {
+		fmt.Println("There is not a primary appendage, so cannot process new transactions from the mempool!")
+		return nil
+	}
+
+	// A node whose clock is behind the blocks before it still has to create its block after them
+	createdAt := n.clock.Now()
+	if median := n.chain.MedianTimeAfter(primaryAppendage.Head); !createdAt.After(median) {
+		createdAt = median.Add(time.Nanosecond)
+	}
+	newBlock := NewBlock(NewLazyBlock(n.chain, primaryAppendage.Head), []*Transaction{}, createdAt)
+	height := newBlock.Height()
+	nextNonce := func(address Address) uint64 {
+		return n.chain.NonceAfter(primaryAppendage.Head, address)
+	}
+
+	// Expired transactions and ones whose nonce is used up can never be mined, and time-locked ones
+	// (or ones after them) have to wait
+	if removed := n.memPool.Prune(height, newBlock.CreatedAt, nextNonce); removed > 0 {
+		fmt.Printf("Dropped %d expired or already used transaction(s) from the mempool\n", removed)
+	}
+	newBlock.Data = n.memPool.Ready(height, newBlock.CreatedAt, nextNonce)
+	if len(newBlock.Data) == 0 {
+		return nil
+	}
+
+	newBlock.Mine()
+	fmt.Printf("Mined new block: %x\n", *newBlock.Hash)
+
+	// Add block to chain
+	n.chain.InsertBlockAndPlaceIntoAppendage(newBlock)
+	n.events.ChainChanged()
+
+	// Remove from the mempool - these transactions are now in the new block!
+	n.memPool.Remove(newBlock.Data)
+
+	// Prepegate it to others!
+	n.gossip.AnnounceBlock(newBlock, nil)
+	return newBlock
+}
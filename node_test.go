@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const TEST_NETWORK_NODES = 20
+
+// Start nodes on a MemoryNetwork, each connected to the one before it in a binary tree, so blocks
+// have to be relayed through other nodes to reach most of the network
+func startTestNetwork(t *testing.T, count int) (*MemoryNetwork, []*Node) {
+	network := NewMemoryNetwork(NewSeededEntropy(1))
+	var nodes []*Node
+	for index := 0; index < count; index += 1 {
+		nodeKey, err := LoadOrCreateNodeKey("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := NodeConfig{
+			Address: fmt.Sprintf("mem://test-node-%d", index),
+			Clock:   SystemClock,
+			Entropy: NewSeededEntropy(int64(index)),
+		}
+		if index > 0 {
+			config.Peers = []string{nodes[(index-1)/2].config.Address}
+		}
+		node := NewNode(config, nodeKey, network.Transport)
+		network.Join(node)
+		nodes = append(nodes, node)
+
+		// Parents connect before their children, so every node syncs the genesis block from the first
+		if err := node.Connect(); err != nil {
+			t.Fatalf("Node %d failed to connect! %s", index, err)
+		}
+		if err := node.Sync(); err != nil {
+			t.Fatalf("Node %d failed to sync! %s", index, err)
+		}
+	}
+	return network, nodes
+}
+
+// The head of a node's primary appendage, or nil if it has no chain
+func nodeTip(node *Node) *Block {
+	primaryAppendage := node.chain.PrimaryAppendage()
+	if primaryAppendage == nil {
+		return nil
+	}
+	return primaryAppendage.Head
+}
+
+// Wait for every node to have the same tip, at least as high as height, and return it
+func waitForSharedTip(t *testing.T, nodes []*Node, height uint64) *Block {
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		tip := nodeTip(nodes[0])
+		shared := tip != nil && tip.Height() >= height
+		for _, node := range nodes[1:] {
+			if !shared {
+				break
+			}
+			other := nodeTip(node)
+			shared = other != nil && *other.Hash == *tip.Hash
+		}
+		if shared {
+			return tip
+		}
+
+		if time.Now().After(deadline) {
+			for index, node := range nodes {
+				if tip := nodeTip(node); tip != nil {
+					t.Logf("Node %d is at %x, height %d", index, *tip.Hash, tip.Height())
+				} else {
+					t.Logf("Node %d has no chain", index)
+				}
+			}
+			t.Fatalf("Nodes didn't agree on a tip at height %d!", height)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func submitTestTransaction(t *testing.T, node *Node, privateKey *rsa.PrivateKey, data string) {
+	transaction := NewTransaction(privateKey, 0, []byte(data), SystemEntropy)
+	transaction.Nonce = node.NextNonce(transaction.SenderPublicKey.Address())
+	if err := transaction.Sign(); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.ReceiveTransaction(transaction, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodesConverge(t *testing.T) {
+	network, nodes := startTestNetwork(t, TEST_NETWORK_NODES)
+	genesis := waitForSharedTip(t, nodes, 0)
+
+	privateKey, err := NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks mined one at a time, by nodes all over the tree, reach every other node
+	const rounds = 5
+	for round := 0; round < rounds; round += 1 {
+		miner := nodes[(round*7+3)%len(nodes)]
+		submitTestTransaction(t, miner, privateKey, fmt.Sprintf("round %d", round))
+		block := miner.MineBlock()
+		if block == nil {
+			t.Fatalf("Expected node %s to mine a block!", miner.config.Address)
+		}
+		if tip := waitForSharedTip(t, nodes, uint64(round+1)); *tip.Hash != *block.Hash {
+			t.Fatalf("Expected every node to end on %x, got %x!", *block.Hash, *tip.Hash)
+		}
+	}
+
+	// Two leaves on opposite sides of the tree mine at the same height, one of them while it's cut off
+	// so neither hears of the other's block first, forking the network until the next block settles
+	// which side wins
+	isolated := nodes[len(nodes)-1]
+	var others []string
+	for _, node := range nodes[:len(nodes)-1] {
+		others = append(others, node.config.Address)
+	}
+	network.Partition([][]string{{isolated.config.Address}, others})
+	var forked []*Block
+	for _, miner := range []*Node{isolated, nodes[len(nodes)/2-1]} {
+		submitTestTransaction(t, miner, privateKey, fmt.Sprintf("fork from %s", miner.config.Address))
+		block := miner.MineBlock()
+		if block == nil {
+			t.Fatalf("Expected node %s to mine a block!", miner.config.Address)
+		}
+		forked = append(forked, block)
+	}
+	network.Heal()
+	if forked[0].Height() != forked[1].Height() {
+		t.Fatalf("Expected both forked blocks to be at the same height!")
+	}
+
+	// Once the first node has heard of one of the forks, it mines on top of it
+	miner := nodes[0]
+	deadline := time.Now().Add(10 * time.Second)
+	for tip := nodeTip(miner); tip.Height() < forked[0].Height(); tip = nodeTip(miner) {
+		if time.Now().After(deadline) {
+			t.Fatal("The first node never heard of either fork!")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	submitTestTransaction(t, miner, privateKey, "settles the fork")
+	block := miner.MineBlock()
+	if block == nil {
+		t.Fatal("Expected the first node to mine a block!")
+	}
+	tip := waitForSharedTip(t, nodes, block.Height())
+	if *tip.Hash != *block.Hash {
+		t.Fatalf("Expected every node to end on %x, got %x!", *block.Hash, *tip.Hash)
+	}
+	if tip.Height() != rounds+2 {
+		t.Errorf("Expected the shared tip at height %d, got %d!", rounds+2, tip.Height())
+	}
+
+	// Every node has the same chain all the way back to the same genesis block
+	for index, node := range nodes {
+		primaryAppendage := node.chain.PrimaryAppendage()
+		if primaryAppendage.Genesis == nil || *primaryAppendage.Genesis.Hash != *genesis.Hash {
+			t.Errorf("Node %d has a different genesis block!", index)
+		}
+		if primaryAppendage.Length != uint(tip.Height()+1) {
+			t.Errorf("Node %d has a primary appendage of length %d, expected %d!", index, primaryAppendage.Length, tip.Height()+1)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Every node has a long lived rsa key. A node's peer id is derived from the public half, and the
+// private half is used to prove to other nodes that it really owns that peer id.
+const NODE_KEY_FILENAME = "node.pem"
+const PEER_CHALLENGE_BYTE_LENGTH = 32
+const PEER_CHALLENGE_DOMAIN = "blockchain peer challenge v1"
+
+// Load the node key from the data directory, generating one the first time the node starts. If
+// dataDir is empty, a new key is generated each time and nothing is written to disk.
+func LoadOrCreateNodeKey(dataDir string) (*rsa.PrivateKey, error) {
+	if len(dataDir) == 0 {
+		return NewKeyPair()
+	}
+
+	path := filepath.Join(dataDir, NODE_KEY_FILENAME)
+	if _, err := os.Stat(path); err == nil {
+		return ReadPrivateKeyFile(path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+	nodeKey, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if err := WritePrivateKeyFile(path, nodeKey); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Generated new node key in %s\n", path)
+	return nodeKey, nil
+}
+
+// The peer that represents this node, reachable at the given address
+func NewLocalPeer(address string, nodeKey *rsa.PrivateKey) Peer {
+	publicKey := PublicKey(nodeKey.PublicKey)
+	return Peer{
+		Id:      PeerIdFromPublicKey(&publicKey),
+		Address: address,
+	}
+}
+
+func PeerIdFromPublicKey(publicKey *PublicKey) PeerId {
+	hash := sha256.Sum256(x509.MarshalPKCS1PublicKey((*rsa.PublicKey)(publicKey)))
+	var id PeerId
+	copy(id[:], hash[:len(id)])
+	return id
+}
+
+func NewPeerChallenge(entropy io.Reader) (string, error) {
+	challenge := make([]byte, PEER_CHALLENGE_BYTE_LENGTH)
+	if _, err := io.ReadFull(entropy, challenge); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(challenge), nil
+}
+
+// The signature covers the challenge as well as the peer's id and address, so that a response can't
+// be replayed for another challenge or used to vouch for a different address
+func peerChallengeDigest(challenge string, peer Peer) [32]byte {
+	return sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%s", PEER_CHALLENGE_DOMAIN, challenge, peer.Header())))
+}
+func SignPeerChallenge(nodeKey *rsa.PrivateKey, challenge string, peer Peer) ([]byte, error) {
+	digest := peerChallengeDigest(challenge, peer)
+	return rsa.SignPKCS1v15(rand.Reader, nodeKey, crypto.SHA256, digest[:])
+}
+
+// Make sure that a `/v1/me` response was signed by the key that its peer id was derived from
+func VerifyPeerChallenge(info PeerInfo, challenge string) error {
+	if info.PublicKey == nil || info.PublicKey.N == nil {
+		return errors.New("Peer did not send a public key!")
+	}
+	if PeerIdFromPublicKey(info.PublicKey) != info.Peer.Id {
+		return errors.New("Peer id was not derived from the peer's public key!")
+	}
+	if len(info.Signature) == 0 {
+		return errors.New("Peer did not sign the challenge!")
+	}
+
+	digest := peerChallengeDigest(challenge, info.Peer)
+	if err := rsa.VerifyPKCS1v15((*rsa.PublicKey)(info.PublicKey), crypto.SHA256, digest[:], info.Signature); err != nil {
+		return errors.New(fmt.Sprintf("Peer challenge signature is invalid! %s", err))
+	}
+	return nil
+}
@@ -1,16 +1,32 @@
 package main
 
 import (
+	"crypto/rsa"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"io/ioutil"
-	"net/http"
 	"sort"
+	"sync"
+	"time"
 )
 
 type PeerId uuid.UUID
+
+// So that peer ids can be used as json object keys
+func (id PeerId) MarshalText() ([]byte, error) {
+	return []byte(uuid.UUID(id).String()), nil
+}
+func (id *PeerId) UnmarshalText(byt []byte) error {
+	rawPeerId, err := uuid.ParseBytes(byt)
+	if err != nil {
+		return err
+	}
+	*id = PeerId(rawPeerId)
+	return nil
+}
+
 type Peer struct {
 	Id      PeerId
 	Address string
@@ -40,6 +56,55 @@ func (p *Peer) UnmarshalJSON(byt []byte) error {
 	p.Address = temp.Address
 	return nil
 }
+
+// The response from `/v1/me`: who a peer is, along with its handshake and proof that it owns its
+// peer id
+type PeerInfo struct {
+	Peer      Peer
+	Handshake Handshake
+	PublicKey *PublicKey
+	Signature []byte
+}
+
+func (p PeerInfo) MarshalJSON() ([]byte, error) {
+	result := map[string]interface{}{
+		"id":         uuid.UUID(p.Peer.Id).String(),
+		"address":    p.Peer.Address,
+		"handshake":  p.Handshake,
+		"public_key": p.PublicKey,
+	}
+	if p.Signature != nil {
+		result["signature"] = hex.EncodeToString(p.Signature)
+	}
+	return json.Marshal(result)
+}
+func (p *PeerInfo) UnmarshalJSON(byt []byte) error {
+	if err := json.Unmarshal(byt, &p.Peer); err != nil {
+		return err
+	}
+
+	// Nodes from before the handshake was introduced won't send one, which leaves the protocol version
+	// as zero so they are treated as incompatible
+	var temp struct {
+		Handshake Handshake  `json:"handshake"`
+		PublicKey *PublicKey `json:"public_key"`
+		Signature string     `json:"signature"`
+	}
+	if err := json.Unmarshal(byt, &temp); err != nil {
+		return err
+	}
+	signature, err := hex.DecodeString(temp.Signature)
+	if err != nil {
+		return err
+	}
+	p.Handshake = temp.Handshake
+	p.PublicKey = temp.PublicKey
+	if len(signature) > 0 {
+		p.Signature = signature
+	}
+	return nil
+}
+
 func (p *Peer) Header() string {
 	return fmt.Sprintf("%s %s", uuid.UUID(p.Id).String(), p.Address)
 }
@@ -50,256 +115,439 @@ func (p *Peer) Equal(to Peer) bool {
 type PeerRanking uint
 
 const NODE_DEFAULT_PEER_RANKING = PeerRanking(10)
-const NODE_PEER_OFFLINE_DECREMENT = PeerRanking(1)
-const NODE_PEER_INVALID_REQUEST_DECREMENT = PeerRanking(1)
 const NODE_PEER_NEW_VALID_PEER_INCREMENT = PeerRanking(2)
+
+// Crawl for more peers once there are fewer than this many outbound peers
 const NODE_MINIMUM_PEER_COUNT = 3
-const NODE_IDEAL_PEER_COUNT = 10
 
+// PeerSet is shared between the http handlers, the peer manager and the workers sending messages to
+// peers, so every exported method takes the lock. Methods ending in Locked expect the caller to
+// already hold it.
 type PeerSet struct {
-	Me        Peer
-	peers     map[PeerId]Peer
-	rankings  map[PeerId]PeerRanking
-	untrusted []PeerId
+	mu         sync.Mutex
+	Me         Peer
+	nodeKey    *rsa.PrivateKey
+	peers      map[PeerId]Peer
+	rankings   map[PeerId]PeerRanking
+	handshakes map[PeerId]Handshake
+	heartbeats map[PeerId]time.Time
+	directions map[PeerId]PeerDirection
+	untrusted  map[PeerId]PeerBan
+	records    map[PeerId]*PeerRecord
+	// The ips each peer's address resolved to when it was added
+	peerIps        map[PeerId][]string
+	resolver       Resolver
+	transport      Transport
+	localHandshake func() Handshake
+	lastDecay      time.Time
+	lastExchange   time.Time
+	lastRotation   time.Time
+	clock          Clock
+	entropy        *Entropy
+	// Set to record peers being added and removed as events
+	events *EventLog
 }
 
-func NewPeerSet(address string) *PeerSet {
-	me := Peer{
-		Id:      PeerId(uuid.New()),
-		Address: address,
-	}
+func NewPeerSet(address string, nodeKey *rsa.PrivateKey, transport Transport, localHandshake func() Handshake, clock Clock, entropy *Entropy) *PeerSet {
+	me := NewLocalPeer(address, nodeKey)
 	return &PeerSet{
-		Me:    me,
-		peers: map[PeerId]Peer{me.Id: me},
+		Me:      me,
+		nodeKey: nodeKey,
+		peers:   map[PeerId]Peer{me.Id: me},
 		rankings: map[PeerId]PeerRanking{
 			me.Id: NODE_DEFAULT_PEER_RANKING,
 		},
-		untrusted: []PeerId{},
+		handshakes:     map[PeerId]Handshake{},
+		heartbeats:     map[PeerId]time.Time{},
+		directions:     map[PeerId]PeerDirection{},
+		untrusted:      map[PeerId]PeerBan{},
+		records:        map[PeerId]*PeerRecord{},
+		peerIps:        map[PeerId][]string{},
+		resolver:       SystemResolver,
+		transport:      transport,
+		localHandshake: localHandshake,
+		clock:          clock,
+		entropy:        entropy,
+	}
+}
+
+// Describe this node, signing the challenge (if given) to prove ownership of the peer id
+func (ps *PeerSet) MeInfo(challenge string) (PeerInfo, error) {
+	publicKey := PublicKey(ps.nodeKey.PublicKey)
+	info := PeerInfo{
+		Peer:      ps.Me,
+		Handshake: ps.localHandshake(),
+		PublicKey: &publicKey,
+		Signature: nil,
+	}
+	if len(challenge) > 4*PEER_CHALLENGE_BYTE_LENGTH {
+		return info, errors.New("Challenge is too long!")
 	}
+	if len(challenge) > 0 {
+		signature, err := SignPeerChallenge(ps.nodeKey, challenge, ps.Me)
+		if err != nil {
+			return info, err
+		}
+		info.Signature = signature
+	}
+	return info, nil
+}
+func (ps *PeerSet) Handshake(id PeerId) (Handshake, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	handshake, ok := ps.handshakes[id]
+	return handshake, ok
+}
+
+// The ips a peer's address resolved to when it was added
+func (ps *PeerSet) Ips(id PeerId) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.peerIps[id]
+}
+
+// Pick the format to send data to a peer in, falling back to text if the peer hasn't said it
+// supports the binary format
+func (ps *PeerSet) WireFormatFor(id PeerId, preferred WireFormat) WireFormat {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if preferred == WIRE_FORMAT_BINARY {
+		if handshake, ok := ps.handshakes[id]; ok && handshake.Supports(FEATURE_BINARY_WIRE) {
+			return WIRE_FORMAT_BINARY
+		}
+	}
+	return WIRE_FORMAT_TEXT
+}
+
+// Returns the peers that completed a handshake to sync the chain from, most trusted first. The work a
+// peer claims to have done in its handshake can't be checked until its chain is downloaded, so it
+// isn't used to pick between them.
+func (ps *PeerSet) SyncPeers() []Peer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var syncPeers []Peer
+	// Peers are listed in ascending rank order
+	others := ps.listOthersLocked()
+	for index := len(others) - 1; index >= 0; index -= 1 {
+		if _, ok := ps.handshakes[others[index].Id]; ok {
+			syncPeers = append(syncPeers, others[index])
+		}
+	}
+	return syncPeers
 }
 func (ps *PeerSet) Has(id PeerId) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.hasLocked(id)
+}
+func (ps *PeerSet) hasLocked(id PeerId) bool {
 	if _, ok := ps.peers[id]; ok {
 		return true
 	} else {
 		return false
 	}
 }
+func (ps *PeerSet) Get(id PeerId) (Peer, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	peer, ok := ps.peers[id]
+	return peer, ok
+}
 func (ps *PeerSet) Untrusted(id PeerId) bool {
-	for _, pId := range ps.untrusted {
-		if pId == id {
-			return true
-		}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.untrustedLocked(id)
+}
+func (ps *PeerSet) untrustedLocked(id PeerId) bool {
+	ban, ok := ps.untrusted[id]
+	if !ok {
+		return false
+	}
+	if ban.Expired(ps.clock.Now()) {
+		delete(ps.untrusted, id)
+		return false
 	}
-	return false
+	return true
+}
+func (ps *PeerSet) MarkUntrusted(id PeerId, reason string) {
+	ps.Ban(id, 0, reason)
 }
-func (ps *PeerSet) MarkUntrusted(id PeerId) {
-	ps.untrusted = append(ps.untrusted, id)
+
+// Ban a peer for the given duration, or forever if the duration is zero
+func (ps *PeerSet) Ban(id PeerId, duration time.Duration, reason string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.banLocked(id, duration, reason)
+}
+func (ps *PeerSet) banLocked(id PeerId, duration time.Duration, reason string) {
+	now := ps.clock.Now()
+	ban := PeerBan{BannedAt: now, Reason: reason}
+	if duration > 0 {
+		ban.BannedUntil = now.Add(duration)
+	}
+	ps.untrusted[id] = ban
+	if record, ok := ps.records[id]; ok {
+		record.BanCount += 1
+	}
+	ps.removeLocked(id)
+
+	if duration > 0 {
+		fmt.Printf("Banned peer %s for %s: %s\n", uuid.UUID(id).String(), duration, reason)
+	} else {
+		fmt.Printf("Banned peer %s: %s\n", uuid.UUID(id).String(), reason)
+	}
 }
 func (ps *PeerSet) Count() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
 	return len(ps.rankings)
 }
-func (ps *PeerSet) Insert(peer Peer) bool {
+func (ps *PeerSet) Insert(peer Peer, handshake Handshake, direction PeerDirection) bool {
+	// Looking up the peer's hostname could take a while, so it happens before taking the lock
+	ips, err := resolvePeerIps(ps.resolver, peer.Address)
+	if err != nil {
+		fmt.Printf("Failed to resolve address of peer %s (address %s), rejecting: %s\n", uuid.UUID(peer.Id).String(), peer.Address, err)
+		return false
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
 	// Add peers into the peerset, if they aren't already in the peerset, or already been marked as
 	// untrusted
-	if ps.Has(peer.Id) {
+	if ps.hasLocked(peer.Id) {
 		return false
 	}
-	if ps.Untrusted(peer.Id) {
+	if ps.untrustedLocked(peer.Id) {
 		return false
 	}
 	if peer.Id == ps.Me.Id {
 		return false
 	}
+	if err := ps.localHandshake().CompatibleWith(handshake); err != nil {
+		fmt.Printf("Peer %s (address %s) is incompatible, rejecting: %s\n", uuid.UUID(peer.Id).String(), peer.Address, err)
+		return false
+	}
+	if err := ps.checkSlotLocked(ips, direction); err != nil {
+		fmt.Printf("No room for peer %s (address %s), rejecting: %s\n", uuid.UUID(peer.Id).String(), peer.Address, err)
+		return false
+	}
 	ps.peers[peer.Id] = peer
 	ps.rankings[peer.Id] = NODE_DEFAULT_PEER_RANKING
-	fmt.Printf("New peer %s (address %s) found!\n", uuid.UUID(peer.Id).String(), peer.Address)
+	ps.handshakes[peer.Id] = handshake
+	ps.directions[peer.Id] = direction
+	ps.peerIps[peer.Id] = ips
+	ps.touchLocked(peer)
+	fmt.Printf("New %s peer %s (address %s) found!\n", direction, uuid.UUID(peer.Id).String(), peer.Address)
+	if ps.events != nil {
+		ps.events.PeerAdded(peer, direction)
+	}
 	return true
 }
-func (ps *PeerSet) InsertByAddress(peerAddress string) error {
-	resp, err := http.Get(fmt.Sprintf("%s/v1/me", peerAddress))
+
+// Fetch a peer's identity and handshake from its `/v1/me` endpoint, and make sure the peer can prove
+// that it owns the peer id it claims. offline is true if the peer couldn't be reached at all, rather
+// than responding with something invalid.
+func (ps *PeerSet) fetchPeerInfo(peerAddress string) (info PeerInfo, offline bool, err error) {
+	challenge, err := NewPeerChallenge(ps.entropy)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Failed to get info from peer with address %s! %s\n", peerAddress, err))
+		return info, false, err
 	}
-	if resp.StatusCode != 200 {
-		return errors.New(fmt.Sprintf("Failed to get info from peer with address %s, failed with %d!\n", peerAddress, resp.StatusCode))
+	info, err = ps.transport.GetMe(peerAddress, challenge)
+	if err != nil {
+		return info, IsPeerUnreachable(err), errors.New(fmt.Sprintf("Failed to get info from peer with address %s! %s", peerAddress, err))
 	}
-
-	defer resp.Body.Close()
-	body, err2 := ioutil.ReadAll(resp.Body)
-	if err2 != nil {
-		return errors.New(fmt.Sprintf("Failed to parse body when getting info from peer with address %s! %s\n", peerAddress, err2))
+	if err := VerifyPeerChallenge(info, challenge); err != nil {
+		return info, false, errors.New(fmt.Sprintf("Failed to verify identity of peer with address %s! %s", peerAddress, err))
+	}
+	return info, false, nil
+}
+func (ps *PeerSet) InsertByAddress(peerAddress string) error {
+	info, _, err := ps.fetchPeerInfo(peerAddress)
+	if err != nil {
+		return err
 	}
-	var response Peer
-	err = json.Unmarshal(body, &response)
+
+	ps.Insert(info.Peer, info.Handshake, PEER_DIRECTION_OUTBOUND)
+	return nil
+}
+
+// Insert a peer that has claimed an identity (ie, via X-Peer-Info), after making sure the node at
+// that address can prove it owns the claimed id
+func (ps *PeerSet) InsertClaimedPeer(claimed Peer) error {
+	info, _, err := ps.fetchPeerInfo(claimed.Address)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Failed to parse json body when getting info from peer with address %s! %s\n", peerAddress, err))
+		return err
+	}
+	if info.Peer.Id != claimed.Id {
+		return errors.New(fmt.Sprintf("Peer at address %s claimed id %s, but actually has id %s!", claimed.Address, uuid.UUID(claimed.Id).String(), uuid.UUID(info.Peer.Id).String()))
 	}
 
-	ps.Insert(response)
+	ps.Insert(info.Peer, info.Handshake, PEER_DIRECTION_INBOUND)
 	return nil
 }
 func (ps *PeerSet) Increment(id PeerId, change PeerRanking) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
 	ps.rankings[id] += change
-	ps.Rank()
+	ps.rankLocked()
 }
 func (ps *PeerSet) Decrement(id PeerId, change PeerRanking) {
-	if ps.rankings[id] > 0 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.decrementLocked(id, change)
+}
+func (ps *PeerSet) decrementLocked(id PeerId, change PeerRanking) {
+	if ps.rankings[id] > change {
 		ps.rankings[id] -= change
+	} else {
+		ps.rankings[id] = 0
 	}
-	ps.Rank()
+	ps.rankLocked()
 }
 func (ps *PeerSet) Remove(id PeerId) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.removeLocked(id)
+}
+func (ps *PeerSet) removeLocked(id PeerId) {
+	if peer, ok := ps.peers[id]; ok && ps.events != nil {
+		ps.events.PeerRemoved(peer)
+	}
 	delete(ps.peers, id)
 	delete(ps.rankings, id)
+	delete(ps.handshakes, id)
+	delete(ps.heartbeats, id)
+	delete(ps.directions, id)
+	delete(ps.peerIps, id)
 	// But keep it in untrusted! That seems like a good idea
 }
 func (ps *PeerSet) Rank() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.rankLocked()
+}
+func (ps *PeerSet) rankLocked() {
 	// Recompute which peers are trustworthy and untrustworthy
 	for k, v := range ps.rankings {
-		if v == 0 {
-			ps.untrusted = append(ps.untrusted, k)
-			delete(ps.rankings, k)
+		if v == 0 && k != ps.Me.Id {
+			ps.banLocked(k, ps.banDurationForLocked(k), "Ranking dropped to zero")
 		}
 	}
 }
+
+// Record a peer's latest handshake after a successful health check
+func (ps *PeerSet) updateHandshake(peer Peer, handshake Handshake) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if !ps.hasLocked(peer.Id) {
+		return
+	}
+	ps.handshakes[peer.Id] = handshake
+	ps.touchLocked(peer)
+}
+
+// Refresh talks to other peers over the network, so it doesn't hold the lock itself
 func (ps *PeerSet) Refresh() error {
-	client := &http.Client{}
+	ps.Decay()
 
-	if len(ps.rankings) == 1 {
+	if ps.Count() == 1 {
 		return errors.New("This node has no other peers to query for more peers!")
 	}
 
 	fmt.Println("Checking to make sure all peers are healthy...")
 	for _, peer := range ps.ListOthers() {
-		req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/me", peer.Address), nil)
-		if err != nil {
-			fmt.Printf("Failed to assemble request for peer %s! %s\n", uuid.UUID(peer.Id).String(), err)
-			// Don't decrement the ranking in this case, this is probably not the peer's fault
-			continue
-		}
-		req.Header.Add("X-Peer-Info", ps.Me.Header())
-		resp, err1 := client.Do(req)
-		if err1 != nil {
-			fmt.Printf("Failed to check peer %s health! %s\n", uuid.UUID(peer.Id).String(), err1)
-			ps.Decrement(peer.Id, NODE_PEER_OFFLINE_DECREMENT)
-			continue
-		}
-		if resp.StatusCode != 200 {
-			fmt.Printf("Failed to check peer %s health, failed with %d!\n", uuid.UUID(peer.Id).String(), resp.StatusCode)
-			ps.Decrement(peer.Id, NODE_PEER_INVALID_REQUEST_DECREMENT)
+		// Peers with a websocket link prove they're alive with heartbeats, so don't need polling
+		if ps.heartbeatIsFresh(peer.Id) {
 			continue
 		}
 
-		defer resp.Body.Close()
-		body, err2 := ioutil.ReadAll(resp.Body)
-		if err2 != nil {
-			fmt.Printf("Failed to parse body when checking peer %s health! %s\n", uuid.UUID(peer.Id).String(), err2)
-			ps.Decrement(peer.Id, NODE_PEER_INVALID_REQUEST_DECREMENT)
-			continue
-		}
-		var response Peer
-		err = json.Unmarshal(body, &response)
+		info, offline, err := ps.fetchPeerInfo(peer.Address)
 		if err != nil {
-			fmt.Printf("Failed to parse json body when checking peer %s health! %s\n", uuid.UUID(peer.Id).String(), err)
-			ps.Decrement(peer.Id, NODE_PEER_INVALID_REQUEST_DECREMENT)
+			fmt.Printf("Failed to check peer %s health! %s\n", uuid.UUID(peer.Id).String(), err)
+			if offline {
+				ps.Penalize(peer.Id, PEER_OFFENSE_TIMEOUT)
+			} else {
+				ps.Penalize(peer.Id, PEER_OFFENSE_MALFORMED_RESPONSE)
+			}
 			continue
 		}
 
 		// Make sure we aren't talking to ourselves!
 		if peer.Id == ps.Me.Id {
 			ps.Remove(peer.Id)
+			continue
 		}
 
-		if peer.Id != response.Id {
+		if peer.Id != info.Peer.Id {
 			fmt.Printf("Peer %s now has a different id, removing...\n", uuid.UUID(peer.Id).String())
 			ps.Remove(peer.Id)
-			ps.MarkUntrusted(peer.Id)
+			ps.MarkUntrusted(peer.Id, "Peer id changed")
+			continue
 		}
+
+		// The peer may have upgraded, or we may have only just learned which chain we're on
+		if err := ps.localHandshake().CompatibleWith(info.Handshake); err != nil {
+			fmt.Printf("Peer %s is no longer compatible, removing: %s\n", uuid.UUID(peer.Id).String(), err)
+			ps.Remove(peer.Id)
+			continue
+		}
+		ps.updateHandshake(peer, info.Handshake)
 	}
 	fmt.Println("Checking to make sure all peers are healthy...done")
 	fmt.Printf("Number of healthy peers: %d\n", ps.Count())
 
-	if len(ps.rankings) > NODE_MINIMUM_PEER_COUNT {
+	if ps.CountDirection(PEER_DIRECTION_OUTBOUND) >= NODE_MINIMUM_PEER_COUNT {
 		return nil
 	}
 
 	// Talk to peers to try to get more peers if we don't have enough
-	fmt.Printf("Trying to aquire more peers to get to %d\n", NODE_IDEAL_PEER_COUNT)
+	fmt.Printf("Trying to aquire more outbound peers to get to %d\n", NODE_OUTBOUND_PEER_SLOTS)
 	for _, peer := range ps.ListOthers() {
-		req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/peers", peer.Address), nil)
-		if err != nil {
-			fmt.Printf("Failed to assemble request for peer %s! %s\n", uuid.UUID(peer.Id).String(), err)
-			// Don't decrement the ranking in this case, this is probably not the peer's fault
-			continue
-		}
-		req.Header.Add("X-Peer-Info", ps.Me.Header())
-		resp, err1 := client.Do(req)
-		if err1 != nil {
-			fmt.Printf("Failed to get peers from peer %s! %s\n", uuid.UUID(peer.Id).String(), err1)
-			ps.Decrement(peer.Id, NODE_PEER_OFFLINE_DECREMENT)
-			continue
-		}
-		if resp.StatusCode != 200 {
-			fmt.Printf("Failed to get peers from peer %s, failed with %d!\n", uuid.UUID(peer.Id).String(), resp.StatusCode)
-			ps.Decrement(peer.Id, NODE_PEER_INVALID_REQUEST_DECREMENT)
+		// Peers that support it share the peers they've recently seen, which go into the address
+		// book to be tried below, rather than their whole peer list
+		if handshake, ok := ps.Handshake(peer.Id); ok && handshake.Supports(FEATURE_ADDRESS_EXCHANGE) {
+			addresses, err := ps.transport.GetAddresses(peer.Address)
+			if err != nil {
+				fmt.Printf("Failed to get addresses from peer %s! %s\n", uuid.UUID(peer.Id).String(), err)
+				if offense, ok := OffenseOfPeerError(err); ok {
+					ps.Penalize(peer.Id, offense)
+				}
+				continue
+			}
+			ps.LearnAddresses(peer.Id, addresses)
 			continue
 		}
 
-		defer resp.Body.Close()
-		body, err2 := ioutil.ReadAll(resp.Body)
-		if err2 != nil {
-			fmt.Printf("Failed to parse body when getting peers from peer %s! %s\n", uuid.UUID(peer.Id).String(), err2)
-			ps.Decrement(peer.Id, NODE_PEER_INVALID_REQUEST_DECREMENT)
-			continue
-		}
-		var peerResponse struct {
-			Peers []Peer `json:"peers"`
-		}
-		err = json.Unmarshal(body, &peerResponse)
+		peers, err := ps.transport.GetPeers(peer.Address)
 		if err != nil {
-			fmt.Printf("Failed to parse json body when getting peers from peer %s! %s\n", uuid.UUID(peer.Id).String(), err)
-			ps.Decrement(peer.Id, NODE_PEER_INVALID_REQUEST_DECREMENT)
+			fmt.Printf("Failed to get peers from peer %s! %s\n", uuid.UUID(peer.Id).String(), err)
+			if offense, ok := OffenseOfPeerError(err); ok {
+				ps.Penalize(peer.Id, offense)
+			}
 			continue
 		}
 
 		// For each new peer, try to merge it into the existing peer list
-		for _, newPeer := range peerResponse.Peers {
-			req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/me", peer.Address), nil)
-			if err != nil {
-				fmt.Printf("Failed to assemble request for peer %s! %s\n", uuid.UUID(peer.Id).String(), err)
-				continue
-			}
-			req.Header.Add("X-Peer-Info", ps.Me.Header())
-			resp, err1 := client.Do(req)
-			if err1 != nil {
-				fmt.Printf("Failed to check peer %s id! %s\n", uuid.UUID(peer.Id).String(), err1)
-				continue
-			}
-			if resp.StatusCode != 200 {
-				fmt.Printf("Failed to check peer %s id, failed with %d!\n", uuid.UUID(peer.Id).String(), resp.StatusCode)
+		for _, newPeer := range peers {
+			if ps.Has(newPeer.Id) || ps.Untrusted(newPeer.Id) || newPeer.Id == ps.Me.Id {
 				continue
 			}
 
-			defer resp.Body.Close()
-			body, err2 := ioutil.ReadAll(resp.Body)
-			if err2 != nil {
-				fmt.Printf("Failed to parse body when checking peer %s id! %s\n", uuid.UUID(peer.Id).String(), err2)
-				ps.Decrement(peer.Id, NODE_PEER_INVALID_REQUEST_DECREMENT)
-				continue
-			}
-			var response Peer
-			err = json.Unmarshal(body, &response)
+			// Ask the new peer directly who it is, rather than trusting what we were told
+			info, _, err := ps.fetchPeerInfo(newPeer.Address)
 			if err != nil {
-				fmt.Printf("Failed to parse json body when checking peer %s id! %s\n", uuid.UUID(peer.Id).String(), err)
+				fmt.Printf("Failed to check peer %s id! %s\n", uuid.UUID(newPeer.Id).String(), err)
 				continue
 			}
 
-			if uuid.UUID(peer.Id).String() != uuid.UUID(response.Id).String() {
-				fmt.Printf("Upon verification, peer %s actually has id %s, rejecting...\n", uuid.UUID(peer.Id).String(), uuid.UUID(response.Id).String())
+			if newPeer.Id != info.Peer.Id {
+				fmt.Printf("Upon verification, peer %s actually has id %s, rejecting...\n", uuid.UUID(newPeer.Id).String(), uuid.UUID(info.Peer.Id).String())
 				continue
 			}
 
-			if ok := ps.Insert(newPeer); !ok {
+			if ok := ps.Insert(newPeer, info.Handshake, PEER_DIRECTION_OUTBOUND); !ok {
 				continue
 			}
 
@@ -307,13 +555,14 @@ func (ps *PeerSet) Refresh() error {
 			fmt.Printf("Successfully added peer %s (from %s)\n", uuid.UUID(newPeer.Id).String(), uuid.UUID(peer.Id).String())
 
 			// Once we have enough peers, then we're done!
-			if ps.Count() >= NODE_IDEAL_PEER_COUNT {
+			if !ps.HasSlot(PEER_DIRECTION_OUTBOUND) {
 				fmt.Println("Reached ideal peer count!")
 				ps.Rank()
 				return nil
 			}
 		}
 	}
+	ps.connectFromAddressBook(nil)
 	fmt.Printf("Number of peers: %d\n", ps.Count())
 
 	ps.Rank()
@@ -331,6 +580,11 @@ func (p PairList) Len() int           { return len(p) }
 func (p PairList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 func (p PairList) Less(i, j int) bool { return p[i].Value < p[j].Value }
 func (ps *PeerSet) List() []Peer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.listLocked()
+}
+func (ps *PeerSet) listLocked() []Peer {
 	// Return all peers, sorted in rank order
 
 	p := make(PairList, len(ps.rankings))
@@ -352,8 +606,13 @@ func (ps *PeerSet) List() []Peer {
 	return peerList
 }
 func (ps *PeerSet) ListOthers() []Peer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.listOthersLocked()
+}
+func (ps *PeerSet) listOthersLocked() []Peer {
 	var peerList []Peer
-	for _, peer := range ps.List() {
+	for _, peer := range ps.listLocked() {
 		if peer != ps.Me {
 			peerList = append(peerList, peer)
 		}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The peer database remembers every peer this node has talked to, along with its bans, so that a
+// restarted node can rejoin the network without needing `--peers` again.
+const PEER_DB_FILENAME = "peers.json"
+const PEER_RANK_HISTORY_LENGTH = 32
+
+// Peers that haven't been seen in this long are forgotten
+const PEER_RECORD_MAX_AGE = 14 * 24 * time.Hour
+
+type PeerRankSample struct {
+	At   time.Time   `json:"at"`
+	Rank PeerRanking `json:"rank"`
+}
+type PeerRecord struct {
+	Peer        Peer             `json:"peer"`
+	FirstSeen   time.Time        `json:"first_seen"`
+	LastSeen    time.Time        `json:"last_seen"`
+	RankHistory []PeerRankSample `json:"rank_history"`
+	BanCount    int              `json:"ban_count"`
+	// Set for addresses that were only heard about from another peer (see LearnAddresses), until
+	// this node talks to the peer itself
+	Learned bool `json:"learned,omitempty"`
+	// The peer a learned address was heard about from
+	LearnedFrom *PeerId `json:"learned_from,omitempty"`
+}
+
+type PeerBan struct {
+	BannedAt time.Time `json:"banned_at"`
+	// A zero BannedUntil means the ban never expires
+	BannedUntil time.Time `json:"banned_until"`
+	Reason      string    `json:"reason"`
+}
+
+func (b PeerBan) Expired(now time.Time) bool {
+	return !b.BannedUntil.IsZero() && now.After(b.BannedUntil)
+}
+
+type peerDatabase struct {
+	Peers []*PeerRecord      `json:"peers"`
+	Bans  map[PeerId]PeerBan `json:"bans"`
+}
+
+func (ps *PeerSet) touchLocked(peer Peer) {
+	now := ps.clock.Now()
+	record, ok := ps.records[peer.Id]
+	if !ok {
+		record = &PeerRecord{Peer: peer, FirstSeen: now, RankHistory: []PeerRankSample{}}
+		ps.records[peer.Id] = record
+	}
+	record.Peer = peer
+	record.LastSeen = now
+	record.Learned = false
+}
+
+// Record the rank of each active peer whenever it changes, so that the history can be looked at later
+func (ps *PeerSet) sampleRankingsLocked() {
+	now := ps.clock.Now()
+	for id, rank := range ps.rankings {
+		record, ok := ps.records[id]
+		if !ok {
+			continue
+		}
+		if len(record.RankHistory) > 0 && record.RankHistory[len(record.RankHistory)-1].Rank == rank {
+			continue
+		}
+		record.RankHistory = append(record.RankHistory, PeerRankSample{At: now, Rank: rank})
+		if len(record.RankHistory) > PEER_RANK_HISTORY_LENGTH {
+			record.RankHistory = record.RankHistory[len(record.RankHistory)-PEER_RANK_HISTORY_LENGTH:]
+		}
+	}
+}
+
+// Returns the addresses of all remembered peers which aren't banned, most recently seen first
+func (ps *PeerSet) KnownAddresses() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var records []*PeerRecord
+	for id, record := range ps.records {
+		if id == ps.Me.Id || ps.untrustedLocked(id) {
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].LastSeen.After(records[j].LastSeen)
+	})
+
+	var addresses []string
+	for _, record := range records {
+		addresses = append(addresses, record.Peer.Address)
+	}
+	return addresses
+}
+
+func (ps *PeerSet) Load(dataDir string) error {
+	byt, err := ioutil.ReadFile(filepath.Join(dataDir, PEER_DB_FILENAME))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var db peerDatabase
+	if err := json.Unmarshal(byt, &db); err != nil {
+		return err
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := ps.clock.Now()
+	for _, record := range db.Peers {
+		if record.Peer.Id == ps.Me.Id || now.Sub(record.LastSeen) > PEER_RECORD_MAX_AGE {
+			continue
+		}
+		ps.records[record.Peer.Id] = record
+	}
+	for id, ban := range db.Bans {
+		if ban.Expired(now) {
+			continue
+		}
+		ps.untrusted[id] = ban
+	}
+	fmt.Printf("Loaded %d peer(s) and %d ban(s) from the peer database\n", len(ps.records), len(ps.untrusted))
+	return nil
+}
+
+func (ps *PeerSet) Save(dataDir string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.sampleRankingsLocked()
+
+	now := ps.clock.Now()
+	var db peerDatabase
+	db.Peers = []*PeerRecord{}
+	for id, record := range ps.records {
+		if now.Sub(record.LastSeen) > PEER_RECORD_MAX_AGE {
+			delete(ps.records, id)
+			continue
+		}
+		db.Peers = append(db.Peers, record)
+	}
+	db.Bans = map[PeerId]PeerBan{}
+	for id, ban := range ps.untrusted {
+		if ban.Expired(now) {
+			delete(ps.untrusted, id)
+			continue
+		}
+		db.Bans[id] = ban
+	}
+
+	byt, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a crash part way through doesn't lose the whole database
+	path := filepath.Join(dataDir, PEER_DB_FILENAME)
+	if err := ioutil.WriteFile(path+".tmp", byt, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
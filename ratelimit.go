@@ -0,0 +1,186 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Requests per second allowed from each ip and each known peer, see the README
+const API_RATE_LIMIT_PER_IP = 10.0
+const API_RATE_LIMIT_BURST_PER_IP = 50.0
+const API_RATE_LIMIT_PER_PEER = 50.0
+const API_RATE_LIMIT_BURST_PER_PEER = 200.0
+
+// Most buckets to keep, forgetting the least recently used ones past that
+const API_RATE_LIMIT_MAX_BUCKETS = 10000
+
+// The largest request body each endpoint accepts
+const API_MAX_BLOCK_BODY_SIZE = PEER_LINK_MAX_MESSAGE_SIZE
+const API_MAX_TRANSACTION_BODY_SIZE = 64 * 1024
+const API_MAX_INVENTORY_BODY_SIZE = 64 * 1024
+const API_MAX_ADMIN_BODY_SIZE = 4 * 1024
+
+// How many requests to expensive endpoints can be handled at once. Requests beyond that are turned
+// away rather than queued.
+const API_MAX_CONCURRENT_CHAIN_REQUESTS = 4
+const API_MAX_CONCURRENT_BLOCK_SUBMISSIONS = 8
+const API_MAX_CONCURRENT_EXPLORER_REQUESTS = 16
+const API_MAX_CONCURRENT_GRAPHQL_REQUESTS = 8
+const API_MAX_CONCURRENT_RPC_REQUESTS = 8
+
+// Clients following `/v1/events` hold their slot for as long as they stay connected
+const API_MAX_EVENT_SUBSCRIBERS = 64
+
+type tokenBucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+type RateLimiter struct {
+	mu      sync.Mutex
+	clock   Clock
+	rate    float64
+	burst   float64
+	buckets map[string]*list.Element
+	// The buckets, most recently used first
+	recent *list.List
+}
+
+// rate is the number of requests allowed per second, and burst is how many can be made at once
+func NewRateLimiter(clock Clock, rate float64, burst float64) *RateLimiter {
+	return &RateLimiter{
+		clock:   clock,
+		rate:    rate,
+		burst:   burst,
+		buckets: map[string]*list.Element{},
+		recent:  list.New(),
+	}
+}
+
+// Spend a token from the key's bucket, returning false if there were none left
+func (l *RateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	element, ok := l.buckets[key]
+	if ok {
+		l.recent.MoveToFront(element)
+	} else {
+		for len(l.buckets) >= API_RATE_LIMIT_MAX_BUCKETS {
+			l.evictLocked()
+		}
+		element = l.recent.PushFront(&tokenBucket{key: key, tokens: l.burst, updated: now})
+		l.buckets[key] = element
+	}
+	bucket := element.Value.(*tokenBucket)
+	l.refill(bucket, now)
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens -= 1
+	return true
+}
+func (l *RateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+		bucket.tokens += elapsed * l.rate
+		if bucket.tokens > l.burst {
+			bucket.tokens = l.burst
+		}
+	}
+	bucket.updated = now
+}
+
+// Forget the least recently used bucket
+func (l *RateLimiter) evictLocked() {
+	oldest := l.recent.Back()
+	if oldest == nil {
+		return
+	}
+	l.recent.Remove(oldest)
+	delete(l.buckets, oldest.Value.(*tokenBucket).key)
+}
+
+func respondTooManyRequests(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", "1")
+	respondError(w, r, NewAPIError(ERROR_CODE_RATE_LIMITED, "Too many requests, slow down!"))
+}
+
+// Middleware that rate limits every request by ip. Known peers can send more than that, so once
+// their ip's bucket runs out they spend from their own.
+func rateLimit(peerSet *PeerSet, clock Clock) func(next http.Handler) http.Handler {
+	byIp := NewRateLimiter(clock, API_RATE_LIMIT_PER_IP, API_RATE_LIMIT_BURST_PER_IP)
+	byPeer := NewRateLimiter(clock, API_RATE_LIMIT_PER_PEER, API_RATE_LIMIT_BURST_PER_PEER)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The ip is charged before anything else is done with the request, ie looking at the
+			// peer it claims to be from
+			remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				remoteHost = r.RemoteAddr
+			}
+			if byIp.Allow(remoteHost) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if peerId, ok := peerInRequest(peerSet, r); ok {
+				if byPeer.Allow(uuid.UUID(peerId).String()) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				peerSet.Penalize(peerId, PEER_OFFENSE_RATE_LIMITED)
+			}
+			respondTooManyRequests(w, r)
+		})
+	}
+}
+
+// Middleware that turns requests away once limit of them are already being handled
+func limitConcurrency(limit int) func(next http.Handler) http.Handler {
+	slots := make(chan struct{}, limit)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				next.ServeHTTP(w, r)
+			default:
+				respondTooManyRequests(w, r)
+			}
+		})
+	}
+}
+
+// Read a request body of at most limit bytes. If it can't be read, an error response has already been
+// sent and false is returned.
+func readBody(w http.ResponseWriter, r *http.Request, limit int64) ([]byte, bool) {
+	tooLarge := func() {
+		respondError(w, r, NewAPIError(ERROR_CODE_TOO_LARGE, fmt.Sprintf("Request body is larger than %d bytes!", limit)))
+	}
+	if r.ContentLength > limit {
+		tooLarge()
+		return nil, false
+	}
+
+	byt, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error readng body!"))
+		return nil, false
+	}
+	if int64(len(byt)) > limit {
+		tooLarge()
+		return nil, false
+	}
+	return byt, true
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"net/http"
+)
+
+// The JSON-RPC version `/rpc` speaks, see the README
+const RPC_VERSION = "2.0"
+
+// Calls in one batch. Batches count as a single request towards rate limits, so this keeps them from
+// getting around them.
+const RPC_MAX_BATCH_SIZE = 50
+const API_MAX_RPC_BODY_SIZE = RPC_MAX_BATCH_SIZE * API_MAX_TRANSACTION_BODY_SIZE
+
+// Error codes from the JSON-RPC 2.0 spec
+const RPC_ERROR_PARSE = -32700
+const RPC_ERROR_INVALID_REQUEST = -32600
+const RPC_ERROR_METHOD_NOT_FOUND = -32601
+const RPC_ERROR_INVALID_PARAMS = -32602
+const RPC_ERROR_INTERNAL = -32603
+
+// Any error from the rest api other than an internal one
+const RPC_ERROR_SERVER = -32000
+
+type RPCRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// Requests without an id are notifications, which don't get a response
+	Id json.RawMessage `json:"id,omitempty"`
+}
+
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e RPCError) Error() string {
+	return e.Message
+}
+
+type RPCResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+type rpcMethod struct {
+	// Names of the params, in order, so they can be passed by position as well as by name
+	params []string
+	call   func(params json.RawMessage) (interface{}, error)
+}
+
+type RPCServer struct {
+	methods map[string]rpcMethod
+}
+
+func NewRPCServer(node *Node) *RPCServer {
+	chain := node.chain
+	memPool := node.memPool
+	peerSet := node.peerSet
+
+	return &RPCServer{methods: map[string]rpcMethod{
+		// The block with a hash, or at a height in the primary appendage
+		"getBlock": {params: []string{"hash", "height"}, call: func(raw json.RawMessage) (interface{}, error) {
+			var params struct {
+				Hash   string  `json:"hash"`
+				Height *uint64 `json:"height"`
+			}
+			if err := json.Unmarshal(raw, &params); err != nil {
+				return nil, rpcInvalidParams(err)
+			}
+			if (len(params.Hash) == 0) == (params.Height == nil) {
+				return nil, RPCError{Code: RPC_ERROR_INVALID_PARAMS, Message: "Exactly one of hash or height is required!"}
+			}
+
+			var block *Block
+			var err error
+			if params.Height != nil {
+				block, err = findBlockAtHeight(chain, *params.Height)
+			} else {
+				block, err = findBlock(chain, params.Hash)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return NewBlockView(block, block.Height())
+		}},
+
+		"getTip": {call: func(raw json.RawMessage) (interface{}, error) {
+			tip, err := findTip(chain)
+			if err != nil {
+				return nil, err
+			}
+			summary, err := NewBlockSummary(tip, tip.Height())
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"block":      summary,
+				"appendages": len(chain.ListAppendages()),
+			}, nil
+		}},
+
+		"getTransaction": {params: []string{"id"}, call: func(raw json.RawMessage) (interface{}, error) {
+			var params struct {
+				Id string `json:"id"`
+			}
+			if err := json.Unmarshal(raw, &params); err != nil {
+				return nil, rpcInvalidParams(err)
+			}
+			transaction, block, err := findTransaction(chain, memPool, params.Id)
+			if err != nil {
+				return nil, err
+			}
+			return NewIncludedTransactionView(transaction, block)
+		}},
+
+		// Submit a transaction in the text wire format, as written by `tx sign`
+		"sendRawTransaction": {params: []string{"transaction"}, call: func(raw json.RawMessage) (interface{}, error) {
+			var params struct {
+				Transaction string `json:"transaction"`
+			}
+			if err := json.Unmarshal(raw, &params); err != nil {
+				return nil, rpcInvalidParams(err)
+			}
+			transaction, err := WIRE_FORMAT_TEXT.DecodeTransaction([]byte(params.Transaction))
+			if err != nil {
+				return nil, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing transaction!")
+			}
+			if err := node.ReceiveTransaction(transaction, nil); err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"status": "ok", "id": transaction.Id.String()}, nil
+		}},
+
+		"getMempool": {call: func(raw json.RawMessage) (interface{}, error) {
+			transactions, err := NewTransactionViews(memPool.List())
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"transactions": transactions}, nil
+		}},
+
+		"getPeers": {call: func(raw json.RawMessage) (interface{}, error) {
+			return map[string]interface{}{"peers": peerSet.List()}, nil
+		}},
+	}}
+}
+
+func rpcInvalidParams(err error) RPCError {
+	return RPCError{Code: RPC_ERROR_INVALID_PARAMS, Message: fmt.Sprintf("Error parsing params: %s", err)}
+}
+
+// Convert an error from a method into the error to send
+func rpcErrorOf(err error) *RPCError {
+	var rpcError RPCError
+	if errors.As(err, &rpcError) {
+		return &rpcError
+	}
+	var apiError APIError
+	if errors.As(err, &apiError) && apiError.Code != ERROR_CODE_INTERNAL {
+		return &RPCError{Code: RPC_ERROR_SERVER, Message: apiError.Message, Data: map[string]interface{}{"code": apiError.Code}}
+	}
+	return &RPCError{Code: RPC_ERROR_INTERNAL, Message: err.Error()}
+}
+
+// Params can be an object, or an array given in the order of the method's params, which is turned
+// into an object here so each method only has to parse one form
+func (m rpcMethod) paramsObject(raw json.RawMessage) (json.RawMessage, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return json.RawMessage("{}"), nil
+	}
+	switch raw[0] {
+	case '{':
+		return raw, nil
+	case '[':
+		var positional []json.RawMessage
+		if err := json.Unmarshal(raw, &positional); err != nil {
+			return nil, rpcInvalidParams(err)
+		}
+		if len(positional) > len(m.params) {
+			return nil, RPCError{Code: RPC_ERROR_INVALID_PARAMS, Message: fmt.Sprintf("Expected at most %d params!", len(m.params))}
+		}
+		named := map[string]json.RawMessage{}
+		for index, param := range positional {
+			named[m.params[index]] = param
+		}
+		return json.Marshal(named)
+	default:
+		return nil, RPCError{Code: RPC_ERROR_INVALID_PARAMS, Message: "params must be an object or an array!"}
+	}
+}
+
+// Run one call, returning nil if it was a notification
+func (s *RPCServer) Call(raw json.RawMessage) *RPCResponse {
+	var request RPCRequest
+	if err := json.Unmarshal(raw, &request); err != nil || request.Version != RPC_VERSION || len(request.Method) == 0 {
+		return &RPCResponse{
+			Version: RPC_VERSION,
+			Error:   &RPCError{Code: RPC_ERROR_INVALID_REQUEST, Message: "Not a JSON-RPC 2.0 request!"},
+			Id:      json.RawMessage("null"),
+		}
+	}
+
+	response := &RPCResponse{Version: RPC_VERSION, Id: request.Id}
+	method, ok := s.methods[request.Method]
+	if !ok {
+		response.Error = &RPCError{Code: RPC_ERROR_METHOD_NOT_FOUND, Message: fmt.Sprintf("Unknown method %s!", request.Method)}
+	} else if params, err := method.paramsObject(request.Params); err != nil {
+		response.Error = rpcErrorOf(err)
+	} else if result, err := method.call(params); err != nil {
+		response.Error = rpcErrorOf(err)
+	} else {
+		response.Result = result
+	}
+
+	if len(request.Id) == 0 {
+		return nil
+	}
+	return response
+}
+
+func (s *RPCServer) Serve(w http.ResponseWriter, r *http.Request) {
+	byt, ok := readBody(w, r, API_MAX_RPC_BODY_SIZE)
+	if !ok {
+		return
+	}
+	byt = bytes.TrimSpace(byt)
+
+	// A single call
+	if len(byt) == 0 || byt[0] != '[' {
+		if !json.Valid(byt) {
+			render.JSON(w, r, RPCResponse{
+				Version: RPC_VERSION,
+				Error:   &RPCError{Code: RPC_ERROR_PARSE, Message: "Error parsing body!"},
+				Id:      json.RawMessage("null"),
+			})
+			return
+		}
+		response := s.Call(byt)
+		if response == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		render.JSON(w, r, response)
+		return
+	}
+
+	// A batch, which gets back an array of the responses to every call that wasn't a notification
+	var batch []json.RawMessage
+	if err := json.Unmarshal(byt, &batch); err != nil {
+		render.JSON(w, r, RPCResponse{
+			Version: RPC_VERSION,
+			Error:   &RPCError{Code: RPC_ERROR_PARSE, Message: "Error parsing body!"},
+			Id:      json.RawMessage("null"),
+		})
+		return
+	}
+	if len(batch) == 0 || len(batch) > RPC_MAX_BATCH_SIZE {
+		render.JSON(w, r, RPCResponse{
+			Version: RPC_VERSION,
+			Error:   &RPCError{Code: RPC_ERROR_INVALID_REQUEST, Message: fmt.Sprintf("A batch must have between 1 and %d calls!", RPC_MAX_BATCH_SIZE)},
+			Id:      json.RawMessage("null"),
+		})
+		return
+	}
+
+	responses := []*RPCResponse{}
+	for _, call := range batch {
+		if response := s.Call(call); response != nil {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	render.JSON(w, r, responses)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Different kinds of misbehavior cost a peer different amounts of ranking. Being offline might not be
+// the peer's fault, but sending an invalid block almost certainly is.
+type PeerOffense int
+
+const (
+	PEER_OFFENSE_TIMEOUT PeerOffense = iota
+	PEER_OFFENSE_MALFORMED_RESPONSE
+	PEER_OFFENSE_INVALID_TRANSACTION
+	PEER_OFFENSE_INVALID_BLOCK
+	PEER_OFFENSE_RATE_LIMITED
+)
+
+var PEER_OFFENSE_PENALTIES = map[PeerOffense]PeerRanking{
+	PEER_OFFENSE_TIMEOUT:             PeerRanking(1),
+	PEER_OFFENSE_MALFORMED_RESPONSE:  PeerRanking(2),
+	PEER_OFFENSE_INVALID_TRANSACTION: PeerRanking(3),
+	PEER_OFFENSE_INVALID_BLOCK:       PeerRanking(5),
+	PEER_OFFENSE_RATE_LIMITED:        PeerRanking(1),
+}
+
+func (o PeerOffense) String() string {
+	switch o {
+	case PEER_OFFENSE_TIMEOUT:
+		return "timeout"
+	case PEER_OFFENSE_MALFORMED_RESPONSE:
+		return "malformed response"
+	case PEER_OFFENSE_INVALID_TRANSACTION:
+		return "invalid transaction"
+	case PEER_OFFENSE_INVALID_BLOCK:
+		return "invalid block"
+	case PEER_OFFENSE_RATE_LIMITED:
+		return "too many requests"
+	default:
+		return fmt.Sprintf("offense %d", int(o))
+	}
+}
+
+// Every interval, each peer's ranking moves one point back towards the default, so old offenses (and
+// old good behavior) are slowly forgotten
+const PEER_RANKING_DECAY_INTERVAL = time.Minute
+
+// The first ban lasts PEER_BASE_BAN_DURATION, and each ban after that lasts twice as long as the one
+// before, up to PEER_MAXIMUM_BAN_DURATION
+const PEER_BASE_BAN_DURATION = 10 * time.Minute
+const PEER_MAXIMUM_BAN_DURATION = 7 * 24 * time.Hour
+
+func (ps *PeerSet) Penalize(id PeerId, offense PeerOffense) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.rankings[id]; !ok {
+		return
+	}
+	fmt.Printf("Penalizing peer %s for %s\n", uuid.UUID(id).String(), offense)
+	ps.decrementLocked(id, PEER_OFFENSE_PENALTIES[offense])
+}
+
+func (ps *PeerSet) Decay() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := ps.clock.Now()
+	if ps.lastDecay.IsZero() {
+		ps.lastDecay = now
+		return
+	}
+
+	steps := PeerRanking(now.Sub(ps.lastDecay) / PEER_RANKING_DECAY_INTERVAL)
+	if steps == 0 {
+		return
+	}
+	ps.lastDecay = ps.lastDecay.Add(time.Duration(steps) * PEER_RANKING_DECAY_INTERVAL)
+
+	for id, rank := range ps.rankings {
+		if id == ps.Me.Id {
+			continue
+		}
+		if rank < NODE_DEFAULT_PEER_RANKING {
+			if NODE_DEFAULT_PEER_RANKING-rank < steps {
+				ps.rankings[id] = NODE_DEFAULT_PEER_RANKING
+			} else {
+				ps.rankings[id] = rank + steps
+			}
+		} else if rank > NODE_DEFAULT_PEER_RANKING {
+			if rank-NODE_DEFAULT_PEER_RANKING < steps {
+				ps.rankings[id] = NODE_DEFAULT_PEER_RANKING
+			} else {
+				ps.rankings[id] = rank - steps
+			}
+		}
+	}
+}
+
+func (ps *PeerSet) banDurationForLocked(id PeerId) time.Duration {
+	duration := PEER_BASE_BAN_DURATION
+	if record, ok := ps.records[id]; ok {
+		for i := 0; i < record.BanCount && duration < PEER_MAXIMUM_BAN_DURATION; i += 1 {
+			duration *= 2
+		}
+	}
+	if duration > PEER_MAXIMUM_BAN_DURATION {
+		duration = PEER_MAXIMUM_BAN_DURATION
+	}
+	return duration
+}
+
+func (ps *PeerSet) Unban(id PeerId) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.untrusted[id]; !ok {
+		return false
+	}
+	delete(ps.untrusted, id)
+	fmt.Printf("Unbanned peer %s\n", uuid.UUID(id).String())
+	return true
+}
+
+// Returns all bans which haven't expired yet
+func (ps *PeerSet) Bans() map[PeerId]PeerBan {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	bans := map[PeerId]PeerBan{}
+	for id := range ps.untrusted {
+		if ps.untrustedLocked(id) {
+			bans[id] = ps.untrusted[id]
+		}
+	}
+	return bans
+}
+
+func (ps *PeerSet) Ranking(id PeerId) (PeerRanking, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	rank, ok := ps.rankings[id]
+	return rank, ok
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the simulator checks whether the nodes agree on a tip
+const SIMULATION_POLL_INTERVAL = 50 * time.Millisecond
+
+// The simulator runs a whole network of nodes inside one process, connected with a MemoryNetwork,
+// to find consensus problems that only show up once there are several nodes mining at once. Nodes
+// are driven the same way as a real node, except that the simulator decides when each one finds a
+// block: each node mines a share of the blocks in proportion to its mining power.
+type SimulationConfig struct {
+	Nodes         int
+	Duration      time.Duration
+	Latency       time.Duration
+	Jitter        time.Duration
+	Loss          float64
+	MiningPower   []float64
+	BlockInterval time.Duration
+	TxInterval    time.Duration
+	GossipFanout  int
+	WireFormat    WireFormat
+	// Runs with the same seed make the same random choices, though since nodes run concurrently the
+	// order things happen in can still differ
+	Seed int64
+
+	// Split the nodes into this many groups between PartitionStart and PartitionEnd (measured from
+	// when mining starts). Zero or one groups means no partition.
+	PartitionGroups int
+	PartitionStart  time.Duration
+	PartitionEnd    time.Duration
+
+	// How long to wait for the nodes to agree on a tip once Duration is up. Nodes keep mining until
+	// they agree, since nodes split between two tips of the same height only settle on one of them
+	// once a block is mined on top of it.
+	Settle time.Duration
+}
+
+type SimulationReport struct {
+	Nodes       int
+	BlocksMined int
+	// Blocks that another block was also mined on top of
+	Forks int
+	// Mined blocks that didn't end up on the chain most nodes agree on
+	Orphans    int
+	OrphanRate float64
+	// How long after the last block was mined it took all nodes to agree on a tip
+	Converged         bool
+	TimeToConvergence time.Duration
+	SharedTip         bool
+	DistinctTips      int
+	Height            uint64
+}
+
+func (r SimulationReport) Print(out io.Writer) {
+	fmt.Fprintf(out, "Nodes:               %d\n", r.Nodes)
+	fmt.Fprintf(out, "Blocks mined:        %d\n", r.BlocksMined)
+	fmt.Fprintf(out, "Forks:               %d\n", r.Forks)
+	fmt.Fprintf(out, "Orphaned blocks:     %d (%.1f%%)\n", r.Orphans, r.OrphanRate*100)
+	if r.Converged {
+		fmt.Fprintf(out, "Time to convergence: %s\n", r.TimeToConvergence)
+	} else {
+		fmt.Fprintf(out, "Time to convergence: did not converge\n")
+	}
+	fmt.Fprintf(out, "Height of best tip:  %d\n", r.Height)
+	if r.SharedTip {
+		fmt.Fprintf(out, "Shared tip:          yes\n")
+	} else {
+		fmt.Fprintf(out, "Shared tip:          no (%d distinct tips)\n", r.DistinctTips)
+	}
+}
+
+type minedBlock struct {
+	hash     BlockHash
+	previous *BlockHash
+	miner    int
+}
+
+type Simulation struct {
+	config  SimulationConfig
+	network *MemoryNetwork
+	nodes   []*Node
+	entropy *Entropy
+	// Each node gets its own entropy, so the choices one node makes don't depend on how often the
+	// others have drawn from a shared source
+	nodeEntropy []*Entropy
+
+	mu          sync.Mutex
+	mined       []minedBlock
+	lastMinedAt time.Time
+	// When the nodes were first seen to agree on a tip since the last block was mined, or zero if
+	// they don't agree yet
+	convergedAt  time.Time
+	transactions int
+}
+
+func NewSimulation(config SimulationConfig) *Simulation {
+	entropy := NewSeededEntropy(config.Seed)
+	return &Simulation{
+		config:  config,
+		network: NewMemoryNetwork(NewSeededEntropy(entropy.Int63n(1 << 62))),
+		entropy: entropy,
+	}
+}
+
+func simulationAddress(index int) string {
+	return fmt.Sprintf("mem://node-%d", index)
+}
+
+// Start every node and connect it to the first one, which creates the genesis block
+func (s *Simulation) setup() error {
+	for index := 0; index < s.config.Nodes; index += 1 {
+		nodeKey, err := LoadOrCreateNodeKey("")
+		if err != nil {
+			return err
+		}
+		nodeEntropy := NewSeededEntropy(s.entropy.Int63n(1 << 62))
+		s.nodeEntropy = append(s.nodeEntropy, nodeEntropy)
+		config := NodeConfig{
+			Address:      simulationAddress(index),
+			WireFormat:   s.config.WireFormat,
+			GossipFanout: s.config.GossipFanout,
+			Clock:        SystemClock,
+			Entropy:      nodeEntropy,
+		}
+		if index > 0 {
+			config.Peers = []string{simulationAddress(0)}
+		}
+		node := NewNode(config, nodeKey, s.network.Transport)
+		s.network.Join(node)
+		s.nodes = append(s.nodes, node)
+	}
+
+	if err := s.nodes[0].Connect(); err != nil {
+		return err
+	}
+	if err := s.nodes[0].Sync(); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(s.nodes))
+	for _, node := range s.nodes[1:] {
+		wg.Add(1)
+		go func(node *Node) {
+			defer wg.Done()
+			if err := node.Connect(); err != nil {
+				errs <- err
+				return
+			}
+			if err := node.Sync(); err != nil {
+				errs <- err
+			}
+		}(node)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		return err
+	}
+
+	for _, node := range s.nodes {
+		go node.ManagePeers()
+	}
+	return nil
+}
+
+func (s *Simulation) miningPower(index int) float64 {
+	if index < len(s.config.MiningPower) {
+		return s.config.MiningPower[index]
+	}
+	return 1
+}
+
+// Each node finds blocks at random, at a rate that adds up to one block per BlockInterval across the
+// whole network, until the given time or until stop is closed
+func (s *Simulation) mine(index int, until time.Time, stop chan struct{}) {
+	totalPower := float64(0)
+	for i := range s.nodes {
+		totalPower += s.miningPower(i)
+	}
+	power := s.miningPower(index)
+	if power <= 0 || totalPower <= 0 {
+		return
+	}
+	meanInterval := float64(s.config.BlockInterval) * totalPower / power
+
+	for {
+		wait := time.Duration(s.nodeEntropy[index].ExpFloat64() * meanInterval)
+		if time.Now().Add(wait).After(until) {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+
+		block := s.nodes[index].MineBlock()
+		if block == nil {
+			continue
+		}
+		var previous *BlockHash
+		if block.Previous != nil {
+			previous = block.Previous.Hash
+		}
+		s.mu.Lock()
+		s.mined = append(s.mined, minedBlock{hash: *block.Hash, previous: previous, miner: index})
+		s.lastMinedAt = time.Now()
+		s.convergedAt = time.Time{}
+		s.mu.Unlock()
+	}
+}
+
+// Submit transactions to random nodes, so that there is always something to mine, until the given
+// time or until stop is closed
+func (s *Simulation) submitTransactions(privateKey *rsa.PrivateKey, until time.Time, stop chan struct{}) error {
+	for time.Now().Before(until) {
+		node := s.nodes[s.entropy.Intn(len(s.nodes))]
+		transaction := NewTransaction(privateKey, 0, []byte(fmt.Sprintf("simulated transaction %d", s.transactions)), s.entropy)
+		transaction.Nonce = node.NextNonce(transaction.SenderPublicKey.Address())
+		if err := transaction.Sign(); err != nil {
+			return err
+		}
+		s.transactions += 1
+
+		if err := node.ReceiveTransaction(transaction, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: simulated transaction was rejected: %s\n", err)
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(s.config.TxInterval):
+		}
+	}
+	return nil
+}
+
+// Mine blocks and submit transactions on every node until the given time or until stop is closed
+func (s *Simulation) run(privateKey *rsa.PrivateKey, until time.Time, stop chan struct{}) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.submitTransactions(privateKey, until, stop)
+	}()
+
+	var wg sync.WaitGroup
+	for index := range s.nodes {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			s.mine(index, until, stop)
+		}(index)
+	}
+	wg.Wait()
+	return <-errs
+}
+
+func (s *Simulation) partition() {
+	groups := make([][]string, s.config.PartitionGroups)
+	for index := range s.nodes {
+		group := index * s.config.PartitionGroups / len(s.nodes)
+		groups[group] = append(groups[group], simulationAddress(index))
+	}
+	s.network.Partition(groups)
+}
+
+// The head of each node's primary appendage
+func (s *Simulation) tips() []*Block {
+	tips := make([]*Block, len(s.nodes))
+	for index, node := range s.nodes {
+		if appendage := node.chain.PrimaryAppendage(); appendage != nil {
+			tips[index] = appendage.Head
+		}
+	}
+	return tips
+}
+
+func countDistinctTips(tips []*Block) (map[BlockHash]int, int) {
+	counts := map[BlockHash]int{}
+	missing := 0
+	for _, tip := range tips {
+		if tip == nil || tip.Hash == nil {
+			missing += 1
+			continue
+		}
+		counts[*tip.Hash] += 1
+	}
+	return counts, missing
+}
+
+// Check whether the nodes agree on a tip every so often, until told to stop
+func (s *Simulation) watchConvergence(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(SIMULATION_POLL_INTERVAL):
+		}
+
+		counts, missing := countDistinctTips(s.tips())
+		converged := missing == 0 && len(counts) == 1
+		s.mu.Lock()
+		if !converged {
+			s.convergedAt = time.Time{}
+		} else if s.convergedAt.IsZero() {
+			s.convergedAt = time.Now()
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Simulation) converged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.convergedAt.IsZero()
+}
+
+func (s *Simulation) Run() (SimulationReport, error) {
+	if err := s.setup(); err != nil {
+		return SimulationReport{}, err
+	}
+
+	// Network conditions only apply once every node has joined, so that setting up can't fail
+	s.network.SetLatency(s.config.Latency, s.config.Jitter)
+	s.network.SetLoss(s.config.Loss)
+
+	start := time.Now()
+	until := start.Add(s.config.Duration)
+	s.lastMinedAt = start
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.watchConvergence(stop)
+
+	if s.config.PartitionGroups > 1 {
+		go func() {
+			time.Sleep(s.config.PartitionStart)
+			fmt.Fprintf(os.Stderr, "Partitioning network into %d groups\n", s.config.PartitionGroups)
+			s.partition()
+			time.Sleep(s.config.PartitionEnd - s.config.PartitionStart)
+			fmt.Fprintln(os.Stderr, "Healing network partition")
+			s.network.Heal()
+		}()
+	}
+
+	// Every transaction comes from the same sender, so nodes have to agree on its nonces
+	privateKey, err := NewKeyPair()
+	if err != nil {
+		return SimulationReport{}, err
+	}
+	if err := s.run(privateKey, until, nil); err != nil {
+		return SimulationReport{}, err
+	}
+
+	// A partition that outlasts mining still has to heal before the nodes have any chance to agree
+	if s.config.PartitionGroups > 1 && s.config.PartitionEnd > s.config.Duration {
+		s.network.Heal()
+	}
+
+	// Give blocks that are still in flight a chance to arrive, and keep mining in case the nodes are
+	// split between tips of the same height
+	settleUntil := time.Now().Add(s.config.Settle)
+	settled := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.run(privateKey, settleUntil, settled)
+	}()
+	waitToSettle := func() {
+		for !s.converged() && time.Now().Before(settleUntil) {
+			time.Sleep(SIMULATION_POLL_INTERVAL)
+		}
+	}
+	waitToSettle()
+	close(settled)
+	if err := <-errs; err != nil {
+		return SimulationReport{}, err
+	}
+	// A node may have been part way through mining a block when the others agreed
+	waitToSettle()
+
+	return s.report(), nil
+}
+
+func (s *Simulation) report() SimulationReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := SimulationReport{Nodes: len(s.nodes), BlocksMined: len(s.mined)}
+
+	children := map[BlockHash]int{}
+	for _, block := range s.mined {
+		if block.previous != nil {
+			children[*block.previous] += 1
+		}
+	}
+	for _, count := range children {
+		if count > 1 {
+			report.Forks += 1
+		}
+	}
+
+	tips := s.tips()
+	counts, missing := countDistinctTips(tips)
+	report.DistinctTips = len(counts)
+	report.SharedTip = missing == 0 && len(counts) == 1
+	if report.SharedTip && !s.convergedAt.IsZero() {
+		report.Converged = true
+		report.TimeToConvergence = s.convergedAt.Sub(s.lastMinedAt)
+	}
+
+	// Blocks are orphaned if they aren't on the tip most nodes agree on
+	var bestTip *Block
+	for _, tip := range tips {
+		if tip != nil && (bestTip == nil || counts[*tip.Hash] > counts[*bestTip.Hash]) {
+			bestTip = tip
+		}
+	}
+	onChain := map[BlockHash]bool{}
+	if bestTip != nil {
+		report.Height = bestTip.Height()
+		current := bestTip
+		for current != nil {
+			onChain[*current.Hash] = true
+			if current.Previous == nil {
+				break
+			}
+			current = current.Previous.Unwrap()
+		}
+	}
+	for _, block := range s.mined {
+		if !onChain[block.hash] {
+			report.Orphans += 1
+		}
+	}
+	if report.BlocksMined > 0 {
+		report.OrphanRate = float64(report.Orphans) / float64(report.BlocksMined)
+	}
+	return report
+}
+
+func parseMiningPower(raw string) ([]float64, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var power []float64
+	for _, part := range strings.Split(raw, ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid mining power %q! %s", part, err))
+		}
+		if value < 0 {
+			return nil, errors.New(fmt.Sprintf("Mining power can't be negative, got %q!", part))
+		}
+		power = append(power, value)
+	}
+	return power, nil
+}
+
+func simulate(args []string) {
+	simulateCmd := flag.NewFlagSet("simulate", flag.ExitOnError)
+
+	nodes := simulateCmd.Int("nodes", 5, "Number of nodes to run")
+	duration := simulateCmd.Duration("duration", 30*time.Second, "How long to mine blocks for")
+	latency := simulateCmd.Duration("latency", 50*time.Millisecond, "Delay added to every request between nodes")
+	jitter := simulateCmd.Duration("jitter", 20*time.Millisecond, "Up to this much more delay is added to each request at random")
+	loss := simulateCmd.Float64("loss", 0, "Fraction of requests between nodes to drop (0 to 1)")
+	miningPowerRaw := simulateCmd.String("mining-power", "", "Comma separated relative mining power of each node, ie 4,1,1 (nodes not listed get 1, 0 means the node doesn't mine)")
+	blockInterval := simulateCmd.Duration("block-interval", 2*time.Second, "Average time between blocks across the whole network, not counting the time it takes to mine them")
+	txInterval := simulateCmd.Duration("tx-interval", 500*time.Millisecond, "Time between transactions submitted to random nodes")
+	gossipFanout := simulateCmd.Int("gossip-fanout", NODE_DEFAULT_GOSSIP_FANOUT, "Number of peers each node announces new blocks and transactions to")
+	wire := simulateCmd.String("wire", "text", "Format nodes send blocks and transactions to each other in, either text or binary")
+	partitionGroups := simulateCmd.Int("partition-groups", 0, "Split the nodes into this many groups that can't reach each other")
+	partitionStart := simulateCmd.Duration("partition-start", 10*time.Second, "When to partition the network, after mining starts")
+	partitionEnd := simulateCmd.Duration("partition-end", 20*time.Second, "When to heal the partition, after mining starts")
+	seed := simulateCmd.Int64("seed", 0, "Seed for the random choices made by the simulator and nodes, picked at random if not given")
+	settle := simulateCmd.Duration("settle", 15*time.Second, "How long to wait for nodes to agree on a tip once the duration is up, mining until they do")
+	verbose := simulateCmd.Bool("verbose", false, "Show the output of every node")
+
+	if err := simulateCmd.Parse(args); err != nil {
+		panic(err)
+	}
+
+	if *nodes < 1 {
+		panic("--nodes must be at least 1!")
+	}
+	if *loss < 0 || *loss >= 1 {
+		panic("--loss must be at least 0 and less than 1!")
+	}
+	if *partitionGroups > *nodes {
+		panic("--partition-groups can't be more than --nodes!")
+	}
+	if *partitionEnd < *partitionStart {
+		panic("--partition-end can't be before --partition-start!")
+	}
+	miningPower, err := parseMiningPower(*miningPowerRaw)
+	if err != nil {
+		panic(err)
+	}
+	wireFormat, err := ParseWireFormat(*wire)
+	if err != nil {
+		panic(err)
+	}
+
+	// Every node logs as if it was the only one in the process, which would drown out the report
+	stdout := os.Stdout
+	if !*verbose {
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			panic(err)
+		}
+		defer devNull.Close()
+		os.Stdout = devNull
+	}
+
+	if *seed == 0 {
+		*seed = SystemEntropy.Int63n(1 << 62)
+	}
+
+	fmt.Fprintf(os.Stderr, "Simulating %d node(s) for %s with seed %d...\n", *nodes, *duration, *seed)
+	simulation := NewSimulation(SimulationConfig{
+		Nodes:           *nodes,
+		Duration:        *duration,
+		Latency:         *latency,
+		Jitter:          *jitter,
+		Loss:            *loss,
+		MiningPower:     miningPower,
+		BlockInterval:   *blockInterval,
+		TxInterval:      *txInterval,
+		GossipFanout:    *gossipFanout,
+		WireFormat:      wireFormat,
+		Seed:            *seed,
+		PartitionGroups: *partitionGroups,
+		PartitionStart:  *partitionStart,
+		PartitionEnd:    *partitionEnd,
+		Settle:          *settle,
+	})
+	// Nodes keep running in the background while the report is printed, so their output stays hidden
+	report, err := simulation.Run()
+	if err != nil {
+		panic(err)
+	}
+
+	// Order doesn't matter to anything else, but a stable order makes runs easy to compare
+	tips := map[string][]int{}
+	for index, tip := range simulation.tips() {
+		key := "(none)"
+		if tip != nil && tip.Hash != nil {
+			key = fmt.Sprintf("%x", *tip.Hash)
+		}
+		tips[key] = append(tips[key], index)
+	}
+	var keys []string
+	for key := range tips {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	report.Print(stdout)
+	if !report.SharedTip {
+		for _, key := range keys {
+			fmt.Fprintf(stdout, "  %s: node(s) %v\n", key, tips[key])
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// How long mining a block with a transaction in it takes on average on this machine. It's several
+// times slower under -race, and slower again while every node in a simulation shares the cpu, and
+// nodes keep mining on a tip that's been replaced until they find a block, so blocks that take a
+// good part of the time between them to mine fork all the time.
+func measureMiningTime(t *testing.T) time.Duration {
+	privateKey, err := NewKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const samples = 10
+	start := time.Now()
+	for index := 0; index < samples; index += 1 {
+		transaction := NewTransaction(privateKey, 0, []byte("measuring"), SystemEntropy)
+		if err := transaction.Sign(); err != nil {
+			t.Fatal(err)
+		}
+		NewBlock(nil, []*Transaction{transaction}, time.Now()).Mine()
+	}
+	return time.Since(start) / samples
+}
+
+// A small network mining blocks far enough apart that most reach every node before the next one is
+// found, which tests below add network trouble to
+func testSimulationConfig(t *testing.T, seed int64) SimulationConfig {
+	if testing.Short() {
+		t.Skip("Simulations take several seconds")
+	}
+	blockInterval := 20 * measureMiningTime(t)
+	if blockInterval < 2*time.Second {
+		blockInterval = 2 * time.Second
+	}
+	settle := 3 * blockInterval
+	if settle < 15*time.Second {
+		settle = 15 * time.Second
+	}
+	return SimulationConfig{
+		Nodes:         6,
+		Duration:      8 * blockInterval,
+		Latency:       20 * time.Millisecond,
+		Jitter:        10 * time.Millisecond,
+		BlockInterval: blockInterval,
+		TxInterval:    blockInterval / 5,
+		GossipFanout:  NODE_DEFAULT_GOSSIP_FANOUT,
+		WireFormat:    WIRE_FORMAT_TEXT,
+		Seed:          seed,
+		Settle:        settle,
+	}
+}
+
+// Split the network in two for a few blocks in the middle of the run
+func partitionTestSimulation(config *SimulationConfig) {
+	config.PartitionGroups = 2
+	config.PartitionStart = 2 * config.BlockInterval
+	config.PartitionEnd = 5 * config.BlockInterval
+}
+
+func runTestSimulation(t *testing.T, config SimulationConfig) SimulationReport {
+	report, err := NewSimulation(config).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	report.Print(&out)
+	t.Log(out.String())
+	return report
+}
+
+// Every node ends on the same tip, having agreed on it while settling, and most blocks made it into
+// the chain
+func checkSimulationReport(t *testing.T, report SimulationReport, maxOrphanRate float64) {
+	if !report.SharedTip {
+		t.Errorf("Expected every node to share a tip, got %d distinct tips!", report.DistinctTips)
+	}
+	if !report.Converged {
+		t.Errorf("Expected the nodes to converge!")
+	}
+	if report.BlocksMined == 0 || report.Height == 0 {
+		t.Fatalf("Expected blocks to be mined, got %d mined and a height of %d!", report.BlocksMined, report.Height)
+	}
+	if report.Height > uint64(report.BlocksMined) {
+		t.Errorf("Expected a height of at most %d, the number of blocks mined, got %d!", report.BlocksMined, report.Height)
+	}
+	// Every orphan was mined on a fork, though a fork can orphan more than one block
+	if report.Forks > report.Orphans {
+		t.Errorf("Expected at most as many forks as orphans, got %d forks and %d orphans!", report.Forks, report.Orphans)
+	}
+	if report.Orphans+int(report.Height) != report.BlocksMined {
+		t.Errorf("Expected every mined block to be on the chain or orphaned, got %d mined, %d orphaned and a height of %d!", report.BlocksMined, report.Orphans, report.Height)
+	}
+	if report.OrphanRate > maxOrphanRate {
+		t.Errorf("Expected an orphan rate of at most %.0f%%, got %.0f%%!", maxOrphanRate*100, report.OrphanRate*100)
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	report := runTestSimulation(t, testSimulationConfig(t, 7))
+	checkSimulationReport(t, report, 0.4)
+}
+
+func TestSimulationWithLoss(t *testing.T) {
+	config := testSimulationConfig(t, 13)
+	config.Loss = 0.1
+	report := runTestSimulation(t, config)
+	checkSimulationReport(t, report, 0.5)
+}
+
+// Each side of a partition builds its own chain, and once it heals the shorter one is orphaned
+func TestSimulationWithPartition(t *testing.T) {
+	config := testSimulationConfig(t, 17)
+	partitionTestSimulation(&config)
+	report := runTestSimulation(t, config)
+	checkSimulationReport(t, report, 0.6)
+}
+
+func TestSimulationWithPartitionAndLoss(t *testing.T) {
+	config := testSimulationConfig(t, 19)
+	config.Loss = 0.1
+	partitionTestSimulation(&config)
+	report := runTestSimulation(t, config)
+	checkSimulationReport(t, report, 0.6)
+}
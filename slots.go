@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Whether this node picked a peer itself (outbound) or the peer introduced itself (inbound)
+type PeerDirection string
+
+const PEER_DIRECTION_OUTBOUND = PeerDirection("outbound")
+const PEER_DIRECTION_INBOUND = PeerDirection("inbound")
+
+const NODE_OUTBOUND_PEER_SLOTS = 8
+const NODE_INBOUND_PEER_SLOTS = 16
+
+// At most this many peers can come from the same subnet (see peerSubnet)
+const NODE_MAX_PEERS_PER_SUBNET = 2
+
+// Every so often, some outbound peers are swapped for others from the address book, so that an
+// attacker who does get into the outbound slots can't stay there forever
+const PEER_ROTATION_INTERVAL = 10 * time.Minute
+const PEER_ROTATION_DIVISOR = 4
+
+// The ips a peer address points at, resolving its hostname if it isn't an ip already. Addresses of
+// nodes in the same process (ie, mem:// in the simulator) have none.
+func resolvePeerIps(resolver Resolver, address string) ([]string, error) {
+	peerUrl, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if peerUrl.Scheme == "mem" {
+		return nil, nil
+	}
+	host := peerUrl.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}, nil
+	}
+	ips, err := resolver.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
+
+// The subnet of a peer's first ip: /16 for ipv4 and /32 for ipv6. Loopback addresses return false,
+// so that many nodes can still run on one machine.
+func peerSubnet(ips []string) (string, bool) {
+	if len(ips) == 0 {
+		return "", false
+	}
+	ip := net.ParseIP(ips[0])
+	if ip == nil || ip.IsLoopback() {
+		return "", false
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.Mask(net.CIDRMask(16, 32)).String() + "/16", true
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String() + "/32", true
+}
+
+func (ps *PeerSet) countDirectionLocked(direction PeerDirection) int {
+	count := 0
+	for id := range ps.peers {
+		if id != ps.Me.Id && ps.directions[id] == direction {
+			count += 1
+		}
+	}
+	return count
+}
+func (ps *PeerSet) CountDirection(direction PeerDirection) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.countDirectionLocked(direction)
+}
+func (ps *PeerSet) Direction(id PeerId) (PeerDirection, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	direction, ok := ps.directions[id]
+	return direction, ok
+}
+
+// Whether there is room for another peer in the given direction
+func (ps *PeerSet) HasSlot(direction PeerDirection) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.hasSlotLocked(direction)
+}
+func (ps *PeerSet) hasSlotLocked(direction PeerDirection) bool {
+	if direction == PEER_DIRECTION_INBOUND {
+		return ps.countDirectionLocked(direction) < NODE_INBOUND_PEER_SLOTS
+	}
+	return ps.countDirectionLocked(direction) < NODE_OUTBOUND_PEER_SLOTS
+}
+
+// Returns an error if a new peer at these ips would break the slot or subnet limits
+func (ps *PeerSet) checkSlotLocked(ips []string, direction PeerDirection) error {
+	if !ps.hasSlotLocked(direction) {
+		return errors.New(fmt.Sprintf("No %s peer slots are free", direction))
+	}
+
+	subnet, ok := peerSubnet(ips)
+	if !ok {
+		return nil
+	}
+	count := 0
+	for id := range ps.peers {
+		if id == ps.Me.Id {
+			continue
+		}
+		if existingSubnet, ok := peerSubnet(ps.peerIps[id]); ok && existingSubnet == subnet {
+			count += 1
+		}
+	}
+	if count >= NODE_MAX_PEERS_PER_SUBNET {
+		return errors.New(fmt.Sprintf("Already have %d peer(s) in subnet %s", count, subnet))
+	}
+	return nil
+}
+
+// Drop some outbound peers and connect to others from the address book in their place, at most once
+// per PEER_ROTATION_INTERVAL. Nothing is dropped unless the address book has peers to replace them.
+func (ps *PeerSet) RotateOutbound() {
+	ps.mu.Lock()
+	now := ps.clock.Now()
+	if ps.lastRotation.IsZero() {
+		ps.lastRotation = now
+	}
+	if now.Sub(ps.lastRotation) < PEER_ROTATION_INTERVAL {
+		ps.mu.Unlock()
+		return
+	}
+	ps.lastRotation = now
+
+	var outbound []Peer
+	for _, peer := range ps.listOthersLocked() {
+		if ps.directions[peer.Id] == PEER_DIRECTION_OUTBOUND {
+			outbound = append(outbound, peer)
+		}
+	}
+	ps.mu.Unlock()
+
+	count := len(outbound) / PEER_ROTATION_DIVISOR
+	if count == 0 || len(ps.candidatePeers(count, nil)) == 0 {
+		return
+	}
+
+	ps.entropy.Shuffle(len(outbound), func(i, j int) {
+		outbound[i], outbound[j] = outbound[j], outbound[i]
+	})
+	rotated := map[PeerId]bool{}
+	for _, peer := range outbound[:count] {
+		fmt.Printf("Rotating out outbound peer %s\n", uuid.UUID(peer.Id).String())
+		ps.Remove(peer.Id)
+		rotated[peer.Id] = true
+	}
+
+	// The peers that were just dropped are still in the address book, so don't pick them right back
+	ps.connectFromAddressBook(rotated)
+}
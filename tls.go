@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// Nodes serve plain http unless given a certificate and key, in which case they serve https. For a
+// private network, a node can also be given a CA and told to require client certificates (mutual
+// tls), so that only peers holding a certificate signed by that CA can talk to it at all. The same
+// certificate is presented by the node when it connects to other peers.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// Certificates of peers are checked against this CA rather than the system's, if set
+	CAFile string
+	// Whether peers (and clients) connecting to this node have to present a certificate signed by CAFile
+	RequireClientCerts bool
+}
+
+// Register the flags for certificate, key and CA files on a command
+func addTLSFlags(cmd *flag.FlagSet) *TLSOptions {
+	options := &TLSOptions{}
+	cmd.StringVar(&options.CertFile, "tls-cert", "", "Certificate file (pem) to serve https with, which is also presented to nodes that require client certificates")
+	cmd.StringVar(&options.KeyFile, "tls-key", "", "Private key file (pem) for --tls-cert")
+	cmd.StringVar(&options.CAFile, "tls-ca", "", "CA certificate file (pem) to verify other nodes against, instead of the system's CAs")
+	return options
+}
+
+func (o *TLSOptions) HasCertificate() bool {
+	return len(o.CertFile) > 0 || len(o.KeyFile) > 0
+}
+
+func (o *TLSOptions) certificates() ([]tls.Certificate, error) {
+	if !o.HasCertificate() {
+		return nil, nil
+	}
+	if len(o.CertFile) == 0 || len(o.KeyFile) == 0 {
+		return nil, errors.New("--tls-cert and --tls-key have to be given together!")
+	}
+	certificate, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to load certificate %s! %s", o.CertFile, err))
+	}
+	return []tls.Certificate{certificate}, nil
+}
+
+func (o *TLSOptions) caPool() (*x509.CertPool, error) {
+	if len(o.CAFile) == 0 {
+		return nil, nil
+	}
+	byt, err := ioutil.ReadFile(o.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(byt) {
+		return nil, errors.New(fmt.Sprintf("No certificates found in CA file %s!", o.CAFile))
+	}
+	return pool, nil
+}
+
+// The config to serve https with. Returns nil if no certificate was given.
+func (o *TLSOptions) ServerConfig() (*tls.Config, error) {
+	certificates, err := o.certificates()
+	if err != nil {
+		return nil, err
+	}
+	if certificates == nil {
+		if o.RequireClientCerts {
+			return nil, errors.New("--mtls requires --tls-cert and --tls-key!")
+		}
+		return nil, nil
+	}
+
+	pool, err := o.caPool()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: certificates,
+		ClientCAs:    pool,
+	}
+	if o.RequireClientCerts {
+		if pool == nil {
+			return nil, errors.New("--mtls requires --tls-ca!")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// The config to connect to other nodes with, which presents this node's certificate (if any) and
+// checks theirs against the CA (if given)
+func (o *TLSOptions) ClientConfig() (*tls.Config, error) {
+	certificates, err := o.certificates()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := o.caPool()
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: certificates,
+		RootCAs:      pool,
+	}, nil
+}
+
+// An http client for talking to other nodes with the given tls config
+func NewPeerClient(config *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Timeout: PEER_REQUEST_TIMEOUT, Transport: transport}
+}
+
+// An http client for commands (ie, submit) that talk to a node, which may be serving https
+func (o *TLSOptions) HTTPClient() (*http.Client, error) {
+	config, err := o.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewPeerClient(config), nil
+}
@@ -7,11 +7,26 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
+	"math/big"
 	"strings"
+	"time"
+)
+
+// Transaction lock values below this threshold are interpreted as block heights, and values at or
+// above it as unix timestamps (in seconds). Zero means no lock.
+const TRANSACTION_LOCK_TIMESTAMP_THRESHOLD = 500000000
+
+type TransactionLockStatus int
+
+const (
+	TRANSACTION_LOCK_VALID TransactionLockStatus = iota
+	// The transaction can't be included yet, but might be able to be later
+	TRANSACTION_LOCK_FUTURE
+	// The transaction can never be included again
+	TRANSACTION_LOCK_EXPIRED
 )
 
 type Transaction struct {
@@ -20,6 +35,9 @@ type Transaction struct {
 	SenderPrivateKey *rsa.PrivateKey `json:"-"`
 	SenderPublicKey  *PublicKey      `json:"public_key"`
 	Cost             Currency        `json:"cost"`
+	Nonce            uint64          `json:"nonce"`
+	ValidAfter       uint64          `json:"valid_after,omitempty"`
+	ValidUntil       uint64          `json:"valid_until,omitempty"`
 
 	Data []byte `json:"data"`
 }
@@ -28,10 +46,11 @@ func NewTransaction(
 	sender *rsa.PrivateKey,
 	cost Currency,
 	data []byte,
+	entropy *Entropy,
 ) *Transaction {
 	pubKey := PublicKey(sender.PublicKey)
 	return &Transaction{
-		Id:               uuid.New(),
+		Id:               entropy.NewUUID(),
 		SenderPrivateKey: sender,
 		SenderPublicKey:  &pubKey,
 		Cost:             cost,
@@ -39,44 +58,173 @@ func NewTransaction(
 		Signature:        nil,
 	}
 }
+func NewUnsignedTransaction(
+	sender *PublicKey,
+	cost Currency,
+	nonce uint64,
+	data []byte,
+	entropy *Entropy,
+) *Transaction {
+	return &Transaction{
+		Id:               entropy.NewUUID(),
+		SenderPrivateKey: nil,
+		SenderPublicKey:  sender,
+		Cost:             cost,
+		Nonce:            nonce,
+		Data:             data,
+		Signature:        nil,
+	}
+}
 func NewTransactionFromBytes(bytes []byte) (*Transaction, error) {
 	sections := strings.Split(string(bytes), ".")
 	if len(sections) != 2 {
 		return nil, errors.New("Malformed signature wrapper on transaction!")
 	}
-	payloadBytes, err0 := base64.StdEncoding.DecodeString(sections[0])
+	payload, err0 := base64.StdEncoding.DecodeString(sections[0])
 	if err0 != nil {
 		return nil, err0
 	}
-	payload := []byte(payloadBytes)
 	signature, err1 := hex.DecodeString(sections[1])
 	if err1 != nil {
 		return nil, err1
 	}
 
-	var transaction Transaction
-	err2 := json.Unmarshal(payload, &transaction)
+	decoder := NewDecoder(payload)
+	transaction, err2 := decodeTransactionPayload(decoder)
 	if err2 != nil {
 		return nil, err2
 	}
+	if err := decoder.Finish(); err != nil {
+		return nil, err
+	}
 
-	transaction.Signature = signature
+	// An empty signature section means the transaction was built but hasn't been signed yet
+	if len(signature) > 0 {
+		transaction.Signature = signature
+	}
+
+	return transaction, nil
+}
+
+// Decode a transaction in the canonical binary encoding, as produced by Encode
+func DecodeTransaction(data []byte) (*Transaction, error) {
+	decoder := NewDecoder(data)
+	transaction, err := decodeTransaction(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Finish(); err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+func decodeTransaction(decoder *Decoder) (*Transaction, error) {
+	transaction, err := decodeTransactionPayload(decoder)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := decoder.ReadBytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(signature) > 0 {
+		transaction.Signature = signature
+	}
+	return transaction, nil
+}
+func decodeTransactionPayload(decoder *Decoder) (*Transaction, error) {
+	if err := decoder.ReadVersion(); err != nil {
+		return nil, err
+	}
+
+	var transaction Transaction
+	rawId, err := decoder.ReadFixedBytes(len(transaction.Id))
+	if err != nil {
+		return nil, err
+	}
+	copy(transaction.Id[:], rawId)
+
+	rawN, err := decoder.ReadBytes()
+	if err != nil {
+		return nil, err
+	}
+	e, err := decoder.ReadUint64()
+	if err != nil {
+		return nil, err
+	}
+	transaction.SenderPublicKey = &PublicKey{N: new(big.Int).SetBytes(rawN), E: int(e)}
+
+	cost, err := decoder.ReadUint64()
+	if err != nil {
+		return nil, err
+	}
+	transaction.Cost = Currency(cost)
+
+	if transaction.Nonce, err = decoder.ReadUint64(); err != nil {
+		return nil, err
+	}
+	if transaction.ValidAfter, err = decoder.ReadUint64(); err != nil {
+		return nil, err
+	}
+	if transaction.ValidUntil, err = decoder.ReadUint64(); err != nil {
+		return nil, err
+	}
+	if transaction.Data, err = decoder.ReadBytes(); err != nil {
+		return nil, err
+	}
 
 	return &transaction, nil
 }
+
+// Encode everything that the signature covers in the canonical binary encoding
+func (t *Transaction) EncodePayload() ([]byte, error) {
+	if t.SenderPublicKey == nil || t.SenderPublicKey.N == nil {
+		return nil, errors.New("Cannot encode transaction without a sender public key!")
+	}
+
+	encoder := NewEncoder()
+	encoder.WriteUint8(ENCODING_VERSION)
+	encoder.WriteFixedBytes(t.Id[:])
+	encoder.WriteBytes(t.SenderPublicKey.N.Bytes())
+	encoder.WriteUint64(uint64(t.SenderPublicKey.E))
+	encoder.WriteUint64(uint64(t.Cost))
+	encoder.WriteUint64(t.Nonce)
+	encoder.WriteUint64(t.ValidAfter)
+	encoder.WriteUint64(t.ValidUntil)
+	encoder.WriteBytes(t.Data)
+	return encoder.Bytes(), nil
+}
+
+// Encode the transaction and its signature (if any) in the canonical binary encoding
+func (t *Transaction) Encode() ([]byte, error) {
+	encoder := NewEncoder()
+	if err := t.encodeInto(encoder); err != nil {
+		return nil, err
+	}
+	return encoder.Bytes(), nil
+}
+func (t *Transaction) encodeInto(encoder *Encoder) error {
+	payload, err := t.EncodePayload()
+	if err != nil {
+		return err
+	}
+	encoder.WriteFixedBytes(payload)
+	encoder.WriteBytes(t.Signature)
+	return nil
+}
 func (t *Transaction) SerializePayload() ([]byte, error) {
-	result, err := json.Marshal(t)
+	payload, err := t.EncodePayload()
 	if err != nil {
 		return nil, err
 	}
-	return []byte(base64.StdEncoding.EncodeToString(result)), nil
+	return []byte(base64.StdEncoding.EncodeToString(payload)), nil
 }
 
 func (t *Transaction) Sign() error {
 	if t.SenderPrivateKey == nil {
 		return errors.New("Cannot sign transaction without a private key!")
 	}
-	payload, err1 := t.SerializePayload()
+	payload, err1 := t.EncodePayload()
 	if err1 != nil {
 		return err1
 	}
@@ -103,8 +251,47 @@ func (t *Transaction) Serialize() ([]byte, error) {
 	return []byte(fmt.Sprintf("%s.%x", payload, t.Signature)), nil
 }
 
+// Serialize the transaction without signing it, so it can be carried to another machine which holds
+// the private key
+func (t *Transaction) SerializeUnsigned() ([]byte, error) {
+	payload, err := t.SerializePayload()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%s.", payload)), nil
+}
+
+func transactionLockReached(lock uint64, height uint64, at time.Time) bool {
+	if lock < TRANSACTION_LOCK_TIMESTAMP_THRESHOLD {
+		return height >= lock
+	} else {
+		return at.Unix() >= int64(lock)
+	}
+}
+
+// Figure out if the transaction can be included in a block at the given height, created at the given
+// time.
+func (t *Transaction) LockStatus(height uint64, at time.Time) TransactionLockStatus {
+	if t.ValidUntil != 0 {
+		if t.ValidUntil < TRANSACTION_LOCK_TIMESTAMP_THRESHOLD {
+			if height > t.ValidUntil {
+				return TRANSACTION_LOCK_EXPIRED
+			}
+		} else if at.Unix() > int64(t.ValidUntil) {
+			return TRANSACTION_LOCK_EXPIRED
+		}
+	}
+	if t.ValidAfter != 0 && !transactionLockReached(t.ValidAfter, height, at) {
+		return TRANSACTION_LOCK_FUTURE
+	}
+	return TRANSACTION_LOCK_VALID
+}
+
 func (t *Transaction) Verify() (bool, error) {
-	payload, err1 := t.SerializePayload()
+	if t.Signature == nil {
+		return false, nil
+	}
+	payload, err1 := t.EncodePayload()
 	if err1 != nil {
 		return false, err1
 	}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Everything one node asks of another goes through a Transport. Nodes normally talk over http, but
+// the in-memory transport (see memnet.go) lets many nodes run inside one process. A transport is bound
+// to the node using it, so the peer on the other end knows who it's talking to.
+type Transport interface {
+	GetMe(address string, challenge string) (PeerInfo, error)
+	GetPeers(address string) ([]Peer, error)
+	GetAddresses(address string) ([]PeerAddress, error)
+	// Blocks that are fetched are decoded against the given chain, so their previous blocks resolve
+	GetChain(address string, format WireFormat, chain *Blockchain) ([]*BlockchainAppendage, error)
+	GetBlock(address string, format WireFormat, chain *Blockchain, hash BlockHash) (*Block, error)
+	GetTransaction(address string, format WireFormat, id uuid.UUID) (*Transaction, error)
+	PushBlock(address string, format WireFormat, block *Block) error
+	PushTransaction(address string, format WireFormat, transaction *Transaction) error
+	Announce(address string, items []InventoryItem) error
+}
+
+// The peer couldn't be reached at all, as opposed to responding with something invalid
+type PeerUnreachableError struct {
+	Err error
+}
+
+func (e PeerUnreachableError) Error() string {
+	return e.Err.Error()
+}
+
+// The peer responded, but with an error status. Code and Message are set if the peer said why (see
+// APIError).
+type PeerStatusError struct {
+	StatusCode int
+	Code       ErrorCode
+	Message    string
+}
+
+func (e PeerStatusError) Error() string {
+	if len(e.Code) > 0 {
+		return fmt.Sprintf("Failed with %d (%s)! %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("Failed with %d!", e.StatusCode)
+}
+
+// Read the reason a node gave for an error response, if any
+func statusErrorOfResponse(resp *http.Response) PeerStatusError {
+	statusError := PeerStatusError{StatusCode: resp.StatusCode}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, PEER_ERROR_MAX_BODY_SIZE))
+	if apiError, ok := parseAPIError(body); ok {
+		statusError.Code = apiError.Code
+		statusError.Message = apiError.Message
+	}
+	return statusError
+}
+
+// The code of the error a peer responded with, if it gave one
+func PeerErrorCode(err error) (ErrorCode, bool) {
+	var status PeerStatusError
+	if !errors.As(err, &status) || len(status.Code) == 0 {
+		return "", false
+	}
+	return status.Code, true
+}
+
+// Whether the peer turned down a request for a reason it gave, like an invalid or already received
+// block. That's the peer doing its job, so it isn't held against it.
+func IsPeerRejection(err error) bool {
+	code, ok := PeerErrorCode(err)
+	return ok && code.StatusCode() < 500 && code != ERROR_CODE_RATE_LIMITED
+}
+
+// How to penalize a peer for a failed request, if at all. Being rate limited is this node's own
+// fault, and is just tried again later.
+func OffenseOfPeerError(err error) (PeerOffense, bool) {
+	if IsPeerUnreachable(err) {
+		return PEER_OFFENSE_TIMEOUT, true
+	}
+	if code, ok := PeerErrorCode(err); ok && code == ERROR_CODE_RATE_LIMITED {
+		return PEER_OFFENSE_TIMEOUT, false
+	}
+	return PEER_OFFENSE_MALFORMED_RESPONSE, true
+}
+
+func IsPeerUnreachable(err error) bool {
+	var unreachable PeerUnreachableError
+	return errors.As(err, &unreachable)
+}
+
+// Whether a failed request is worth trying again: the peer may have been briefly offline, overloaded
+// or rate limiting us, but sending the same thing to a peer that rejected it won't help
+func IsRetryablePeerError(err error) bool {
+	if IsPeerUnreachable(err) {
+		return true
+	}
+	var status PeerStatusError
+	return errors.As(err, &status) && (status.StatusCode >= 500 || status.StatusCode == http.StatusTooManyRequests)
+}
+
+const PEER_REQUEST_TIMEOUT = 5 * time.Second
+
+// Error responses are small, so only this much of one is read
+const PEER_ERROR_MAX_BODY_SIZE = 4 * 1024
+
+// Successful responses are read up to the largest a legal one can be. The chain holds the genesis and
+// head block of each appendage, and anything that isn't a block or transaction is small.
+const PEER_MAX_RESPONSE_SIZE = 1024 * 1024
+const PEER_MAX_CHAIN_RESPONSE_SIZE = 4 * API_MAX_BLOCK_BODY_SIZE
+
+// Every http request to another peer goes through this client, so a peer that never responds can't
+// tie up a goroutine forever
+var peerClient = &http.Client{Timeout: PEER_REQUEST_TIMEOUT}
+
+type HTTPTransport struct {
+	me     Peer
+	client *http.Client
+}
+
+func NewHTTPTransport(me Peer) Transport {
+	return &HTTPTransport{me: me, client: peerClient}
+}
+
+// Like NewHTTPTransport, but connecting to peers with the given client (ie, one from NewPeerClient)
+func NewHTTPTransportWithClient(client *http.Client) func(me Peer) Transport {
+	return func(me Peer) Transport {
+		return &HTTPTransport{me: me, client: client}
+	}
+}
+
+// Make a request to a peer, identifying this node so the peer knows who sent it. A response bigger
+// than maxSize fails like an error response would, since no legal response is that big.
+func (t *HTTPTransport) do(method string, url string, contentType string, accept string, byt []byte, maxSize int64) (WireFormat, []byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(byt))
+	if err != nil {
+		return WIRE_FORMAT_TEXT, nil, errors.New(fmt.Sprintf("Failed to assemble request to %s! %s", url, err))
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", accept)
+	}
+	req.Header.Add("X-Peer-Info", t.me.Header())
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return WIRE_FORMAT_TEXT, nil, PeerUnreachableError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return WIRE_FORMAT_TEXT, nil, statusErrorOfResponse(resp)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return WIRE_FORMAT_TEXT, nil, errors.New(fmt.Sprintf("Failed to read body from %s! %s", url, err))
+	}
+	if int64(len(body)) > maxSize {
+		return WIRE_FORMAT_TEXT, nil, PeerStatusError{StatusCode: resp.StatusCode, Code: ERROR_CODE_TOO_LARGE, Message: fmt.Sprintf("Response from %s is larger than %d bytes!", url, maxSize)}
+	}
+	// The peer might not support the format that was asked for, so go by what it sent back
+	return WireFormatOfContentType(resp.Header.Get("Content-Type")), body, nil
+}
+
+func (t *HTTPTransport) GetMe(address string, challenge string) (PeerInfo, error) {
+	var info PeerInfo
+	_, body, err := t.do("GET", fmt.Sprintf("%s/v1/me?challenge=%s", address, challenge), "", "", nil, PEER_MAX_RESPONSE_SIZE)
+	if err != nil {
+		return info, err
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return info, err
+	}
+	return info, nil
+}
+
+func (t *HTTPTransport) GetPeers(address string) ([]Peer, error) {
+	_, body, err := t.do("GET", fmt.Sprintf("%s/v1/peers", address), "", "", nil, PEER_MAX_RESPONSE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	var peerResponse struct {
+		Peers []Peer `json:"peers"`
+	}
+	if err := json.Unmarshal(body, &peerResponse); err != nil {
+		return nil, err
+	}
+	return peerResponse.Peers, nil
+}
+
+func (t *HTTPTransport) GetAddresses(address string) ([]PeerAddress, error) {
+	_, body, err := t.do("GET", fmt.Sprintf("%s/v1/addresses", address), "", "", nil, PEER_MAX_RESPONSE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	var addressResponse struct {
+		Addresses []PeerAddress `json:"addresses"`
+	}
+	if err := json.Unmarshal(body, &addressResponse); err != nil {
+		return nil, err
+	}
+	return addressResponse.Addresses, nil
+}
+
+func (t *HTTPTransport) GetChain(address string, format WireFormat, chain *Blockchain) ([]*BlockchainAppendage, error) {
+	responseFormat, body, err := t.do("GET", fmt.Sprintf("%s/v1/chain", address), "", format.ContentType(), nil, PEER_MAX_CHAIN_RESPONSE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeChain(chain, responseFormat, body)
+}
+
+func (t *HTTPTransport) GetBlock(address string, format WireFormat, chain *Blockchain, hash BlockHash) (*Block, error) {
+	responseFormat, body, err := t.do("GET", fmt.Sprintf("%s/v1/blocks/%x?format=raw", address, hash), "", format.ContentType(), nil, API_MAX_BLOCK_BODY_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeBlockResponse(chain, responseFormat, body)
+}
+
+func (t *HTTPTransport) GetTransaction(address string, format WireFormat, id uuid.UUID) (*Transaction, error) {
+	responseFormat, body, err := t.do("GET", fmt.Sprintf("%s/v1/transactions/%s?format=raw", address, id), "", format.ContentType(), nil, API_MAX_TRANSACTION_BODY_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeTransactionResponse(responseFormat, body)
+}
+
+func (t *HTTPTransport) PushBlock(address string, format WireFormat, block *Block) error {
+	byt, err := format.EncodeBlock(block)
+	if err != nil {
+		return err
+	}
+	_, _, err = t.do("POST", fmt.Sprintf("%s/v1/blocks", address), format.ContentType(), "", byt, PEER_MAX_RESPONSE_SIZE)
+	return err
+}
+
+func (t *HTTPTransport) PushTransaction(address string, format WireFormat, transaction *Transaction) error {
+	byt, err := format.EncodeTransaction(transaction)
+	if err != nil {
+		return err
+	}
+	_, _, err = t.do("POST", fmt.Sprintf("%s/v1/transactions", address), format.ContentType(), "", byt, PEER_MAX_RESPONSE_SIZE)
+	return err
+}
+
+func (t *HTTPTransport) Announce(address string, items []InventoryItem) error {
+	byt, err := json.Marshal(map[string]interface{}{"items": items})
+	if err != nil {
+		return err
+	}
+	_, _, err = t.do("POST", fmt.Sprintf("%s/v1/inventory", address), "application/json", "", byt, PEER_MAX_RESPONSE_SIZE)
+	return err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A peer streaming a response bigger than any legal one is cut off, and it counts against the peer
+func TestHTTPTransportResponseTooLarge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		size := PEER_MAX_RESPONSE_SIZE
+		if strings.HasPrefix(r.URL.Path, "/v1/blocks/") {
+			size = API_MAX_BLOCK_BODY_SIZE
+		}
+		w.Write([]byte(`{"block": "`))
+		w.Write([]byte(strings.Repeat("0", size)))
+		w.Write([]byte(`"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	_, nodes := startTestNetwork(t, 1)
+	transport := NewHTTPTransport(nodes[0].Me())
+	checkTooLarge := func(what string, err error) {
+		if code, ok := PeerErrorCode(err); !ok || code != ERROR_CODE_TOO_LARGE {
+			t.Errorf("Expected %s to fail for being too large, got %v!", what, err)
+		}
+		if offense, ok := OffenseOfPeerError(err); !ok || offense != PEER_OFFENSE_MALFORMED_RESPONSE {
+			t.Errorf("Expected %s being too large to count as a malformed response!", what)
+		}
+		if IsRetryablePeerError(err) {
+			t.Errorf("Expected %s being too large not to be retried!", what)
+		}
+	}
+
+	_, err := transport.GetPeers(server.URL)
+	checkTooLarge("GetPeers", err)
+	_, err = transport.GetBlock(server.URL, WIRE_FORMAT_TEXT, nodes[0].chain, BlockHash{})
+	checkTooLarge("GetBlock", err)
+}
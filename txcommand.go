@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// The offline signing workflow is split into three steps so that the private key never has to be on
+// a machine that is connected to the network:
+//
+// 1. `tx build` runs on a networked machine, and writes an unsigned transaction to a file
+// 2. `tx sign` runs on an offline machine with the private key, and writes a signed transaction
+// 3. `tx broadcast` runs on a networked machine, and submits the signed transaction to a node
+//
+// All files use the same encoding as `Transaction.Serialize`, with an empty signature section when
+// unsigned.
+func transactionCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Missing tx subcommand! Expected one of build, sign, or broadcast.")
+		return
+	}
+
+	switch args[0] {
+	case "build":
+		transactionBuild(args[1:])
+	case "sign":
+		transactionSign(args[1:])
+	case "broadcast":
+		transactionBroadcast(args[1:])
+	default:
+		fmt.Printf("[ERROR] unknown tx subcommand '%s', expected one of build, sign, or broadcast.\n", args[0])
+	}
+}
+
+type TransactionParams struct {
+	Address Address  `json:"address"`
+	Nonce   uint64   `json:"nonce"`
+	Fee     Currency `json:"fee"`
+}
+
+func fetchTransactionParams(client *http.Client, nodeAddress string, address Address) (*TransactionParams, error) {
+	resp, err := client.Get(fmt.Sprintf(
+		"%s/v1/transactions/params?address=%s",
+		nodeAddress,
+		url.QueryEscape(string(address)),
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, errors.New(fmt.Sprintf("Failed to get transaction params from %s! %s", nodeAddress, statusErrorOfResponse(resp)))
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var params TransactionParams
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+func transactionBuild(args []string) {
+	buildCmd := flag.NewFlagSet("tx build", flag.ExitOnError)
+
+	addressRaw := buildCmd.String("address", "", "Network address of a node to fetch the nonce and fee from")
+	publicKeyRaw := buildCmd.String("public-key", "", "File path to the sender's rsa public key")
+	data := buildCmd.String("data", "", "Data to include in the transaction")
+	nonceRaw := buildCmd.Int64("nonce", -1, "Nonce to use, instead of fetching it from the node")
+	feeRaw := buildCmd.Int64("fee", -1, "Fee to use, instead of fetching it from the node")
+	validAfter := buildCmd.Uint64("valid-after", 0, "Block height or unix timestamp the transaction is not valid before")
+	validUntil := buildCmd.Uint64("valid-until", 0, "Block height or unix timestamp the transaction is not valid after")
+	out := buildCmd.String("out", "", "File path to write the unsigned transaction into")
+	tlsOptions := addTLSFlags(buildCmd)
+
+	if err := buildCmd.Parse(args); err != nil {
+		panic(err)
+	}
+
+	if len(*data) == 0 {
+		panic("--data is required!")
+	}
+
+	if len(*publicKeyRaw) == 0 {
+		panic("--public-key is required!")
+	}
+
+	if len(*out) == 0 {
+		panic("--out is required!")
+	}
+
+	if len(*addressRaw) == 0 && (*nonceRaw < 0 || *feeRaw < 0) {
+		panic("--address is required unless both --nonce and --fee are given!")
+	}
+
+	publicKey, err := ReadPublicKeyFile(*publicKeyRaw)
+	if err != nil {
+		panic(err)
+	}
+
+	nonce := uint64(*nonceRaw)
+	fee := Currency(*feeRaw)
+	if *nonceRaw < 0 || *feeRaw < 0 {
+		client, err := tlsOptions.HTTPClient()
+		if err != nil {
+			panic(err)
+		}
+		params, err := fetchTransactionParams(client, *addressRaw, publicKey.Address())
+		if err != nil {
+			panic(err)
+		}
+		if *nonceRaw < 0 {
+			nonce = params.Nonce
+		}
+		if *feeRaw < 0 {
+			fee = params.Fee
+		}
+	}
+
+	transaction := NewUnsignedTransaction(publicKey, fee, nonce, []byte(*data), SystemEntropy)
+	transaction.ValidAfter = *validAfter
+	transaction.ValidUntil = *validUntil
+	byt, err := transaction.SerializeUnsigned()
+	if err != nil {
+		panic(err)
+	}
+
+	if err := ioutil.WriteFile(*out, byt, 0644); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Wrote unsigned transaction %s (nonce %d, fee %d) to %s\n", transaction.Id, nonce, fee, *out)
+}
+
+func transactionSign(args []string) {
+	signCmd := flag.NewFlagSet("tx sign", flag.ExitOnError)
+
+	keyRaw := signCmd.String("key", "", "File path to rsa private key")
+	in := signCmd.String("in", "", "File path to read the unsigned transaction from")
+	out := signCmd.String("out", "", "File path to write the signed transaction into")
+
+	if err := signCmd.Parse(args); err != nil {
+		panic(err)
+	}
+
+	if len(*keyRaw) == 0 {
+		panic("--key is required!")
+	}
+
+	if len(*in) == 0 {
+		panic("--in is required!")
+	}
+
+	if len(*out) == 0 {
+		panic("--out is required!")
+	}
+
+	privateKey, err := ReadPrivateKeyFile(*keyRaw)
+	if err != nil {
+		panic(err)
+	}
+
+	unsignedBytes, err := ioutil.ReadFile(*in)
+	if err != nil {
+		panic(err)
+	}
+	transaction, err := NewTransactionFromBytes(bytes.TrimSpace(unsignedBytes))
+	if err != nil {
+		panic(err)
+	}
+
+	if transaction.Signature != nil {
+		panic("Transaction is already signed!")
+	}
+
+	publicKey := PublicKey(privateKey.PublicKey)
+	if !transaction.SenderPublicKey.Equal(&publicKey) {
+		panic("Private key does not match the transaction's sender public key!")
+	}
+
+	transaction.SenderPrivateKey = privateKey
+	if err := transaction.Sign(); err != nil {
+		panic(err)
+	}
+
+	byt, err := transaction.Serialize()
+	if err != nil {
+		panic(err)
+	}
+
+	if err := ioutil.WriteFile(*out, byt, 0644); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Wrote signed transaction %s to %s\n", transaction.Id, *out)
+}
+
+func transactionBroadcast(args []string) {
+	broadcastCmd := flag.NewFlagSet("tx broadcast", flag.ExitOnError)
+
+	addressRaw := broadcastCmd.String("address", "", "Network address to submit transaction to")
+	in := broadcastCmd.String("in", "", "File path to read the signed transaction from")
+	tlsOptions := addTLSFlags(broadcastCmd)
+
+	if err := broadcastCmd.Parse(args); err != nil {
+		panic(err)
+	}
+
+	if len(*addressRaw) == 0 {
+		panic("--address is required!")
+	}
+
+	if len(*in) == 0 {
+		panic("--in is required!")
+	}
+
+	signedBytes, err := ioutil.ReadFile(*in)
+	if err != nil {
+		panic(err)
+	}
+	signedBytes = bytes.TrimSpace(signedBytes)
+
+	// Make sure the transaction is well formed before handing it to the node
+	transaction, err := NewTransactionFromBytes(signedBytes)
+	if err != nil {
+		panic(err)
+	}
+	if ok, err := transaction.Verify(); err != nil || !ok {
+		fmt.Fprintf(os.Stderr, "Transaction %s does not have a valid signature! %v\n", transaction.Id, err)
+		os.Exit(1)
+	}
+
+	client, err := tlsOptions.HTTPClient()
+	if err != nil {
+		panic(err)
+	}
+	resp, err := client.Post(
+		fmt.Sprintf("%s/v1/transactions", *addressRaw),
+		"text/plain",
+		bytes.NewBuffer(signedBytes),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		fmt.Fprintf(os.Stderr, "Node rejected transaction %s! %s\n", transaction.Id, statusErrorOfResponse(resp))
+		os.Exit(1)
+	}
+	fmt.Printf("Broadcast transaction %s to %s\n", transaction.Id, *addressRaw)
+}
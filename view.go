@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"unicode/utf8"
+)
+
+// Blocks and transactions can be returned either raw, in the same format peers send each other, or
+// decoded into plain json fields for people and clients that don't want to reimplement the wire
+// format. `?format=raw` or `?format=json` picks one; without it, peers (which always send
+// X-Peer-Info) get the raw form and everyone else gets the decoded one.
+type ResponseView string
+
+const RESPONSE_VIEW_RAW = ResponseView("raw")
+const RESPONSE_VIEW_JSON = ResponseView("json")
+
+func ResponseViewOf(r *http.Request) (ResponseView, error) {
+	switch ResponseView(r.URL.Query().Get("format")) {
+	case RESPONSE_VIEW_RAW:
+		return RESPONSE_VIEW_RAW, nil
+	case RESPONSE_VIEW_JSON:
+		return RESPONSE_VIEW_JSON, nil
+	case "":
+		if len(r.Header.Values("X-Peer-Info")) > 0 || WireFormatOfAccept(r) == WIRE_FORMAT_BINARY {
+			return RESPONSE_VIEW_RAW, nil
+		}
+		return RESPONSE_VIEW_JSON, nil
+	default:
+		return RESPONSE_VIEW_RAW, NewAPIError(ERROR_CODE_BAD_REQUEST, "Unknown format, expected raw or json!")
+	}
+}
+
+type TransactionView struct {
+	Id         string   `json:"id"`
+	Sender     Address  `json:"sender,omitempty"`
+	Cost       Currency `json:"cost"`
+	Nonce      uint64   `json:"nonce"`
+	ValidAfter uint64   `json:"valid_after,omitempty"`
+	ValidUntil uint64   `json:"valid_until,omitempty"`
+	// Data is given as text if it's valid utf-8, and as base64 otherwise
+	Data           string `json:"data"`
+	DataEncoding   string `json:"data_encoding"`
+	Signature      string `json:"signature"`
+	SignatureValid bool   `json:"signature_valid"`
+	// Size of the transaction in its binary wire encoding, in bytes
+	Size int `json:"size"`
+}
+
+// A transaction along with the block it's in, if it has been included in one
+type IncludedTransactionView struct {
+	TransactionView
+	Block *BlockSummary `json:"block,omitempty"`
+}
+
+type BlockView struct {
+	BlockSummary
+	Transactions []TransactionView `json:"transactions"`
+}
+
+func NewTransactionView(transaction *Transaction) (TransactionView, error) {
+	byt, err := transaction.Encode()
+	if err != nil {
+		return TransactionView{}, err
+	}
+	valid, err := transaction.Verify()
+	view := TransactionView{
+		Id:             transaction.Id.String(),
+		Cost:           transaction.Cost,
+		Nonce:          transaction.Nonce,
+		ValidAfter:     transaction.ValidAfter,
+		ValidUntil:     transaction.ValidUntil,
+		Signature:      hex.EncodeToString(transaction.Signature),
+		SignatureValid: err == nil && valid,
+		Size:           len(byt),
+	}
+	if transaction.SenderPublicKey != nil {
+		view.Sender = transaction.SenderPublicKey.Address()
+	}
+	if utf8.Valid(transaction.Data) {
+		view.Data = string(transaction.Data)
+		view.DataEncoding = "text"
+	} else {
+		view.Data = base64.StdEncoding.EncodeToString(transaction.Data)
+		view.DataEncoding = "base64"
+	}
+	return view, nil
+}
+
+func NewIncludedTransactionView(transaction *Transaction, block *Block) (IncludedTransactionView, error) {
+	view, err := NewTransactionView(transaction)
+	if err != nil {
+		return IncludedTransactionView{}, err
+	}
+	included := IncludedTransactionView{TransactionView: view}
+	if block != nil {
+		summary, err := NewBlockSummary(block, block.Height())
+		if err != nil {
+			return IncludedTransactionView{}, err
+		}
+		included.Block = &summary
+	}
+	return included, nil
+}
+
+// height is passed in since working it out means walking back through the chain, which callers
+// paging through blocks in order already know
+func NewBlockView(block *Block, height uint64) (BlockView, error) {
+	summary, err := NewBlockSummary(block, height)
+	if err != nil {
+		return BlockView{}, err
+	}
+	transactions, err := NewTransactionViews(block.Data)
+	if err != nil {
+		return BlockView{}, err
+	}
+	return BlockView{BlockSummary: summary, Transactions: transactions}, nil
+}
+
+func NewTransactionViews(transactions []*Transaction) ([]TransactionView, error) {
+	views := []TransactionView{}
+	for _, transaction := range transactions {
+		view, err := NewTransactionView(transaction)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Deliveries are signed with the subscription's secret, see the README
+const WEBHOOK_SIGNATURE_HEADER = "X-Webhook-Signature"
+
+const WEBHOOK_DEFAULT_CONFIRMATIONS = 6
+const WEBHOOK_MAX_SUBSCRIPTIONS = 1000
+const WEBHOOK_REQUEST_TIMEOUT = 10 * time.Second
+
+// A failed delivery is retried with exponential backoff, starting at WEBHOOK_RETRY_BACKOFF
+const WEBHOOK_MAX_ATTEMPTS = 6
+const WEBHOOK_RETRY_BACKOFF = time.Second
+const WEBHOOK_QUEUE_DEPTH = 1024
+const WEBHOOK_WORKERS = 4
+
+type WebhookStatus string
+
+// The transaction is in a block on the primary appendage
+const WEBHOOK_STATUS_INCLUDED = WebhookStatus("included")
+
+// The block with the transaction has the subscription's number of confirmations
+const WEBHOOK_STATUS_CONFIRMED = WebhookStatus("confirmed")
+
+// The block with the transaction left the primary appendage in a reorg before it was confirmed
+const WEBHOOK_STATUS_ORPHANED = WebhookStatus("orphaned")
+
+type WebhookSubscription struct {
+	Id            string    `json:"id"`
+	URL           string    `json:"url"`
+	TransactionId string    `json:"transaction_id,omitempty"`
+	Address       Address   `json:"address,omitempty"`
+	Confirmations uint64    `json:"confirmations"`
+	CreatedAt     time.Time `json:"created_at"`
+	secret        string
+}
+
+func (s *WebhookSubscription) matches(transaction *TransactionView) bool {
+	if len(s.TransactionId) > 0 {
+		return s.TransactionId == transaction.Id
+	}
+	return s.Address == transaction.Sender
+}
+
+type WebhookDelivery struct {
+	Id             string           `json:"id"`
+	SubscriptionId string           `json:"subscription_id"`
+	Status         WebhookStatus    `json:"status"`
+	Confirmations  uint64           `json:"confirmations"`
+	Transaction    *TransactionView `json:"transaction"`
+	Block          *BlockSummary    `json:"block"`
+	Time           time.Time        `json:"time"`
+}
+
+// A transaction that has been included, and is waiting for confirmations
+type webhookWatch struct {
+	subscription *WebhookSubscription
+	transaction  *TransactionView
+	block        *BlockSummary
+}
+
+type webhookMessage struct {
+	url      string
+	secret   string
+	delivery WebhookDelivery
+	// Attempts made so far
+	attempts int
+}
+
+type WebhookManager struct {
+	events  *EventLog
+	clock   Clock
+	entropy *Entropy
+	client  *http.Client
+
+	mu            sync.Mutex
+	subscriptions map[string]*WebhookSubscription
+	watches       []*webhookWatch
+	queue         chan webhookMessage
+}
+
+func NewWebhookManager(events *EventLog, clock Clock, entropy *Entropy) *WebhookManager {
+	return &WebhookManager{
+		events:        events,
+		clock:         clock,
+		entropy:       entropy,
+		client:        &http.Client{Timeout: WEBHOOK_REQUEST_TIMEOUT},
+		subscriptions: map[string]*WebhookSubscription{},
+		queue:         make(chan webhookMessage, WEBHOOK_QUEUE_DEPTH),
+	}
+}
+
+// Follow the event log and deliver webhooks, forever
+func (m *WebhookManager) Run() {
+	for i := 0; i < WEBHOOK_WORKERS; i += 1 {
+		go m.deliverQueued()
+	}
+
+	var after *uint64
+	for {
+		past, subscription, err := m.events.Subscribe(after)
+		if err != nil {
+			// Events were missed, but there's nothing to be done about that other than carrying on
+			fmt.Printf("Webhooks fell behind the event log! %s\n", err)
+			after = nil
+			continue
+		}
+		for _, event := range past {
+			m.handle(event)
+			after = &event.Id
+		}
+
+	follow:
+		for {
+			select {
+			case event := <-subscription.events:
+				m.handle(event)
+				id := event.Id
+				after = &id
+			case <-subscription.dropped:
+				break follow
+			}
+		}
+		m.events.Unsubscribe(subscription)
+	}
+}
+
+func (m *WebhookManager) handle(event Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch event.Type {
+	case EVENT_TRANSACTION_CONFIRMED:
+		for _, subscription := range m.subscriptions {
+			if !subscription.matches(event.Transaction) {
+				continue
+			}
+			watch := &webhookWatch{subscription: subscription, transaction: event.Transaction, block: event.Block}
+			m.sendLocked(watch, WEBHOOK_STATUS_INCLUDED, 1)
+			m.watches = append(m.watches, watch)
+		}
+		// A subscription that only needs one confirmation is confirmed by its own block
+		m.confirmLocked(event.Block.Height)
+
+	case EVENT_BLOCK_CONNECTED:
+		m.confirmLocked(event.Block.Height)
+
+	case EVENT_REORG:
+		disconnected := map[string]bool{}
+		for _, hash := range event.Reorg.Disconnected {
+			disconnected[hash] = true
+		}
+		var watches []*webhookWatch
+		for _, watch := range m.watches {
+			if disconnected[watch.block.Hash] {
+				m.sendLocked(watch, WEBHOOK_STATUS_ORPHANED, 0)
+				continue
+			}
+			watches = append(watches, watch)
+		}
+		m.watches = watches
+	}
+}
+
+// Send a confirmation for every watched transaction that has enough confirmations with the head of
+// the primary appendage at the given height
+func (m *WebhookManager) confirmLocked(headHeight uint64) {
+	var watches []*webhookWatch
+	for _, watch := range m.watches {
+		if headHeight < watch.block.Height {
+			watches = append(watches, watch)
+			continue
+		}
+		confirmations := headHeight - watch.block.Height + 1
+		if confirmations < watch.subscription.Confirmations {
+			watches = append(watches, watch)
+			continue
+		}
+		m.sendLocked(watch, WEBHOOK_STATUS_CONFIRMED, confirmations)
+	}
+	m.watches = watches
+}
+
+func (m *WebhookManager) sendLocked(watch *webhookWatch, status WebhookStatus, confirmations uint64) {
+	// The subscription may have been deleted while waiting for confirmations
+	if _, ok := m.subscriptions[watch.subscription.Id]; !ok {
+		return
+	}
+	message := webhookMessage{
+		url:    watch.subscription.URL,
+		secret: watch.subscription.secret,
+		delivery: WebhookDelivery{
+			Id:             m.entropy.NewUUID().String(),
+			SubscriptionId: watch.subscription.Id,
+			Status:         status,
+			Confirmations:  confirmations,
+			Transaction:    watch.transaction,
+			Block:          watch.block,
+			Time:           m.clock.Now(),
+		},
+	}
+	m.enqueue(message)
+}
+
+func (m *WebhookManager) enqueue(message webhookMessage) {
+	select {
+	case m.queue <- message:
+	default:
+		fmt.Printf("Webhook queue is full, dropping %s delivery for subscription %s\n", message.delivery.Status, message.delivery.SubscriptionId)
+	}
+}
+
+// Deliver queued webhooks. A failed delivery goes back on the queue after a backoff instead of
+// holding up the worker, so one broken url doesn't delay every other subscription's deliveries.
+func (m *WebhookManager) deliverQueued() {
+	for message := range m.queue {
+		message.attempts += 1
+		err := m.deliver(message)
+		if err == nil {
+			continue
+		}
+		fmt.Printf("Failed to deliver webhook %s to %s (attempt %d of %d)! %s\n", message.delivery.Id, message.url, message.attempts, WEBHOOK_MAX_ATTEMPTS, err)
+		if message.attempts < WEBHOOK_MAX_ATTEMPTS {
+			go m.retry(message)
+		}
+	}
+}
+
+func (m *WebhookManager) retry(message webhookMessage) {
+	m.clock.Sleep(WEBHOOK_RETRY_BACKOFF << (message.attempts - 1))
+	m.enqueue(message)
+}
+
+func signWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *WebhookManager) deliver(message webhookMessage) error {
+	body, err := json.Marshal(message.delivery)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", message.url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, signWebhookBody(message.secret, body))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return PeerStatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// Register a subscription, returning it along with the secret its deliveries will be signed with
+func (m *WebhookManager) Subscribe(subscription WebhookSubscription) (*WebhookSubscription, string, error) {
+	callbackUrl, err := url.Parse(subscription.URL)
+	if err != nil || (callbackUrl.Scheme != "http" && callbackUrl.Scheme != "https") || len(callbackUrl.Host) == 0 {
+		return nil, "", NewAPIError(ERROR_CODE_BAD_REQUEST, "url must be an http or https url!")
+	}
+	if (len(subscription.TransactionId) == 0) == (len(subscription.Address) == 0) {
+		return nil, "", NewAPIError(ERROR_CODE_BAD_REQUEST, "Exactly one of transaction_id or address is required!")
+	}
+	if subscription.Confirmations == 0 {
+		subscription.Confirmations = WEBHOOK_DEFAULT_CONFIRMATIONS
+	}
+
+	secretBytes := make([]byte, 32)
+	if _, err := m.entropy.Read(secretBytes); err != nil {
+		return nil, "", err
+	}
+	subscription.Id = m.entropy.NewUUID().String()
+	subscription.CreatedAt = m.clock.Now()
+	subscription.secret = hex.EncodeToString(secretBytes)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.subscriptions) >= WEBHOOK_MAX_SUBSCRIPTIONS {
+		return nil, "", NewAPIError(ERROR_CODE_RATE_LIMITED, "Too many subscriptions!")
+	}
+	m.subscriptions[subscription.Id] = &subscription
+	return &subscription, subscription.secret, nil
+}
+
+// Remove a subscription, which takes the secret it was created with unless it's done by an admin
+func (m *WebhookManager) Unsubscribe(id string, secret string, admin bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subscription, ok := m.subscriptions[id]
+	if !ok {
+		return NewAPIError(ERROR_CODE_NOT_FOUND, "Subscription not found!")
+	}
+	if !admin && subtle.ConstantTimeCompare([]byte(secret), []byte(subscription.secret)) != 1 {
+		return NewAPIError(ERROR_CODE_UNAUTHORIZED, "Invalid subscription secret!")
+	}
+	delete(m.subscriptions, id)
+	return nil
+}
+
+func (m *WebhookManager) List() []WebhookSubscription {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subscriptions := []WebhookSubscription{}
+	for _, subscription := range m.subscriptions {
+		subscriptions = append(subscriptions, *subscription)
+	}
+	return subscriptions
+}
+
+func mountWebhookRoutes(r chi.Router, webhooks *WebhookManager, adminToken string) {
+	r.Post("/v1/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		byt, ok := readBody(w, r, API_MAX_ADMIN_BODY_SIZE)
+		if !ok {
+			return
+		}
+		var request WebhookSubscription
+		if err := json.Unmarshal(byt, &request); err != nil {
+			respondError(w, r, NewAPIError(ERROR_CODE_BAD_REQUEST, "Error parsing body!"))
+			return
+		}
+		subscription, secret, err := webhooks.Subscribe(request)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		// This is the only time the secret is sent
+		render.JSON(w, r, map[string]interface{}{"subscription": subscription, "secret": secret})
+	})
+
+	// Listing every subscription, with their urls, is only for admins
+	if len(adminToken) > 0 {
+		r.With(requireAdminToken(adminToken)).Get("/v1/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+			render.JSON(w, r, map[string]interface{}{"subscriptions": webhooks.List()})
+		})
+	}
+
+	// Takes the subscription's secret, or the admin token, as a bearer token
+	r.Delete("/v1/subscriptions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		admin := hasBearerToken(r, adminToken)
+		if err := webhooks.Unsubscribe(chi.URLParam(r, "id"), bearerToken(r), admin); err != nil {
+			respondError(w, r, err)
+			return
+		}
+		render.JSON(w, r, map[string]interface{}{"status": "ok"})
+	})
+}
+
+// A stand-in for a service receiving webhooks, which prints each delivery and whether its signature
+// is valid
+func webhookListen(args []string) {
+	listenCmd := flag.NewFlagSet("webhook-listen", flag.ExitOnError)
+
+	port := listenCmd.Int("port", 5000, "Port to listen for webhook deliveries on")
+	secret := listenCmd.String("secret", "", "Secret returned when the subscription was created, to check signatures with")
+
+	if err := listenCmd.Parse(args); err != nil {
+		panic(err)
+	}
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		signature := "unchecked"
+		if len(*secret) > 0 {
+			expected := signWebhookBody(*secret, body)
+			if hmac.Equal([]byte(expected), []byte(r.Header.Get(WEBHOOK_SIGNATURE_HEADER))) {
+				signature = "valid"
+			} else {
+				signature = "INVALID"
+			}
+		}
+		fmt.Printf("%s %s (signature %s): %s\n", r.Method, r.URL.Path, signature, body)
+	})
+
+	fmt.Printf("Listening for webhooks on :%d\n", *port)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", *port), nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receivedWebhook struct {
+	delivery  WebhookDelivery
+	body      []byte
+	signature string
+}
+
+// A server standing in for a client, which fails the first failures requests it's sent
+func newWebhookReceiver(t *testing.T, failures int) (*httptest.Server, chan receivedWebhook) {
+	received := make(chan receivedWebhook, 16)
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Error reading delivery! %s", err)
+			return
+		}
+		mu.Lock()
+		fail := failures > 0
+		failures -= 1
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(body, &delivery); err != nil {
+			t.Errorf("Error parsing delivery! %s", err)
+		}
+		received <- receivedWebhook{delivery: delivery, body: body, signature: r.Header.Get(WEBHOOK_SIGNATURE_HEADER)}
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+// Start a manager following an event log, waiting until it's subscribed so no events are missed
+func startWebhookManager(t *testing.T, clock Clock) (*WebhookManager, *EventLog) {
+	events := NewEventLog(nil, clock)
+	webhooks := NewWebhookManager(events, clock, NewSeededEntropy(1))
+	go webhooks.Run()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events.mu.Lock()
+		subscribed := len(events.subscribers) > 0
+		events.mu.Unlock()
+		if subscribed {
+			return webhooks, events
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Webhook manager never subscribed to the event log!")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func publishEvent(events *EventLog, event Event) {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	events.publishLocked(event)
+}
+
+func expectWebhook(t *testing.T, received chan receivedWebhook) receivedWebhook {
+	select {
+	case webhook := <-received:
+		return webhook
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a webhook!")
+		return receivedWebhook{}
+	}
+}
+
+func expectNoWebhook(t *testing.T, received chan receivedWebhook) {
+	select {
+	case webhook := <-received:
+		t.Fatalf("Unexpected %s webhook for subscription %s!", webhook.delivery.Status, webhook.delivery.SubscriptionId)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func checkWebhookSignature(t *testing.T, webhook receivedWebhook, secret string) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(webhook.body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if webhook.signature != expected {
+		t.Errorf("Expected signature %s, got %s!", expected, webhook.signature)
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	server, received := newWebhookReceiver(t, 0)
+	webhooks, events := startWebhookManager(t, SystemClock)
+
+	sender := Address("sender")
+	byTransaction, transactionSecret, err := webhooks.Subscribe(WebhookSubscription{URL: server.URL, TransactionId: "a", Confirmations: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byAddress, addressSecret, err := webhooks.Subscribe(WebhookSubscription{URL: server.URL, Address: sender, Confirmations: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first transaction is included, then confirmed by the next block
+	first := &BlockSummary{Hash: "01", Height: 1}
+	publishEvent(events, Event{Type: EVENT_TRANSACTION_CONFIRMED, Transaction: &TransactionView{Id: "a"}, Block: first})
+	included := expectWebhook(t, received)
+	checkWebhookSignature(t, included, transactionSecret)
+	if included.delivery.SubscriptionId != byTransaction.Id || included.delivery.Status != WEBHOOK_STATUS_INCLUDED {
+		t.Fatalf("Expected an included delivery for %s, got %+v!", byTransaction.Id, included.delivery)
+	}
+	if included.delivery.Block == nil || included.delivery.Block.Hash != first.Hash {
+		t.Errorf("Expected the delivery to be for block %s, got %+v!", first.Hash, included.delivery.Block)
+	}
+
+	publishEvent(events, Event{Type: EVENT_BLOCK_CONNECTED, Block: &BlockSummary{Hash: "02", Height: 2}})
+	confirmed := expectWebhook(t, received)
+	checkWebhookSignature(t, confirmed, transactionSecret)
+	if confirmed.delivery.Status != WEBHOOK_STATUS_CONFIRMED || confirmed.delivery.Confirmations != 2 {
+		t.Fatalf("Expected a confirmed delivery with 2 confirmations, got %+v!", confirmed.delivery)
+	}
+
+	// A transaction from the address is included, then reorged away before it has its confirmations
+	third := &BlockSummary{Hash: "03", Height: 3}
+	publishEvent(events, Event{Type: EVENT_TRANSACTION_CONFIRMED, Transaction: &TransactionView{Id: "b", Sender: sender}, Block: third})
+	included = expectWebhook(t, received)
+	checkWebhookSignature(t, included, addressSecret)
+	if included.delivery.SubscriptionId != byAddress.Id || included.delivery.Status != WEBHOOK_STATUS_INCLUDED {
+		t.Fatalf("Expected an included delivery for %s, got %+v!", byAddress.Id, included.delivery)
+	}
+
+	publishEvent(events, Event{Type: EVENT_REORG, Reorg: &ReorgInfo{OldTip: "03", NewTip: "13", ForkHeight: 2, Disconnected: []string{"03"}}})
+	orphaned := expectWebhook(t, received)
+	checkWebhookSignature(t, orphaned, addressSecret)
+	if orphaned.delivery.SubscriptionId != byAddress.Id || orphaned.delivery.Status != WEBHOOK_STATUS_ORPHANED {
+		t.Fatalf("Expected an orphaned delivery for %s, got %+v!", byAddress.Id, orphaned.delivery)
+	}
+
+	// Nothing is watched any more, so later blocks don't send anything
+	publishEvent(events, Event{Type: EVENT_BLOCK_CONNECTED, Block: &BlockSummary{Hash: "16", Height: 6}})
+	expectNoWebhook(t, received)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	server, received := newWebhookReceiver(t, 2)
+	clock := NewManualClock(time.Unix(0, 0))
+	webhooks, events := startWebhookManager(t, clock)
+
+	subscription, secret, err := webhooks.Subscribe(WebhookSubscription{URL: server.URL, TransactionId: "a", Confirmations: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	publishEvent(events, Event{Type: EVENT_TRANSACTION_CONFIRMED, Transaction: &TransactionView{Id: "a"}, Block: &BlockSummary{Hash: "01", Height: 1}})
+
+	// The first two attempts fail, and are retried as the clock moves on
+	statuses := map[WebhookStatus]bool{}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(statuses) < 2 {
+		select {
+		case webhook := <-received:
+			checkWebhookSignature(t, webhook, secret)
+			if webhook.delivery.SubscriptionId != subscription.Id {
+				t.Fatalf("Unexpected delivery for subscription %s!", webhook.delivery.SubscriptionId)
+			}
+			statuses[webhook.delivery.Status] = true
+		case <-time.After(10 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for retries, got %v!", statuses)
+			}
+			clock.Advance(WEBHOOK_RETRY_BACKOFF)
+		}
+	}
+	if !statuses[WEBHOOK_STATUS_INCLUDED] || !statuses[WEBHOOK_STATUS_CONFIRMED] {
+		t.Fatalf("Expected included and confirmed deliveries, got %v!", statuses)
+	}
+}
+
+func TestWebhookRouteAuth(t *testing.T) {
+	webhooks := NewWebhookManager(NewEventLog(nil, SystemClock), SystemClock, NewSeededEntropy(1))
+	r := chi.NewRouter()
+	mountWebhookRoutes(r, webhooks, "admin")
+
+	request := func(method string, path string, token string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(""))
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	first, firstSecret, err := webhooks.Subscribe(WebhookSubscription{URL: "http://localhost/hook", TransactionId: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := webhooks.Subscribe(WebhookSubscription{URL: "http://localhost/hook", TransactionId: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := request("GET", "/v1/subscriptions", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected listing without a token to be unauthorized, got %d!", code)
+	}
+	if code := request("GET", "/v1/subscriptions", firstSecret); code != http.StatusUnauthorized {
+		t.Errorf("Expected listing with a subscription secret to be unauthorized, got %d!", code)
+	}
+	if code := request("GET", "/v1/subscriptions", "admin"); code != http.StatusOK {
+		t.Errorf("Expected listing with the admin token to work, got %d!", code)
+	}
+
+	// A subscription's secret only deletes that subscription
+	if code := request("DELETE", "/v1/subscriptions/"+second.Id, firstSecret); code != http.StatusUnauthorized {
+		t.Errorf("Expected deleting with another subscription's secret to be unauthorized, got %d!", code)
+	}
+	if code := request("DELETE", "/v1/subscriptions/"+first.Id, ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected deleting without a token to be unauthorized, got %d!", code)
+	}
+	if code := request("DELETE", "/v1/subscriptions/"+first.Id, firstSecret); code != http.StatusOK {
+		t.Errorf("Expected deleting with the subscription's secret to work, got %d!", code)
+	}
+	if code := request("DELETE", "/v1/subscriptions/"+second.Id, "admin"); code != http.StatusOK {
+		t.Errorf("Expected deleting with the admin token to work, got %d!", code)
+	}
+	if code := request("DELETE", "/v1/subscriptions/"+second.Id, "admin"); code != http.StatusNotFound {
+		t.Errorf("Expected deleting a deleted subscription to be not found, got %d!", code)
+	}
+	if len(webhooks.List()) != 0 {
+		t.Errorf("Expected no subscriptions left, got %d!", len(webhooks.List()))
+	}
+}
+
+func TestWebhookListNeedsAdminToken(t *testing.T) {
+	// Without an admin token, nobody can list subscriptions
+	webhooks := NewWebhookManager(NewEventLog(nil, SystemClock), SystemClock, NewSeededEntropy(1))
+	r := chi.NewRouter()
+	mountWebhookRoutes(r, webhooks, "")
+
+	req := httptest.NewRequest("GET", "/v1/subscriptions", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code == http.StatusOK {
+		t.Errorf("Expected listing to be unavailable without an admin token, got %d!", w.Code)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Peers can exchange blocks, transactions and chains either as the base64 text format (ie,
+// `Block.Serialize`) or as the raw canonical binary encoding, which avoids the base64 and json
+// escaping overhead. Which one is used is negotiated with the Accept and Content-Type headers, so
+// nodes that only speak text keep working.
+const TEXT_CONTENT_TYPE = "text/plain"
+const BINARY_CONTENT_TYPE = "application/vnd.blockchain.binary"
+
+type WireFormat int
+
+const (
+	WIRE_FORMAT_TEXT WireFormat = iota
+	WIRE_FORMAT_BINARY
+)
+
+func ParseWireFormat(raw string) (WireFormat, error) {
+	switch raw {
+	case "text":
+		return WIRE_FORMAT_TEXT, nil
+	case "binary":
+		return WIRE_FORMAT_BINARY, nil
+	default:
+		return WIRE_FORMAT_TEXT, errors.New(fmt.Sprintf("Unknown wire format %s, expected text or binary!", raw))
+	}
+}
+
+// Figure out the format of a request or response body from its Content-Type header
+func WireFormatOfContentType(contentType string) WireFormat {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && mediaType == BINARY_CONTENT_TYPE {
+		return WIRE_FORMAT_BINARY
+	}
+	return WIRE_FORMAT_TEXT
+}
+
+// Figure out which format a client would like a response in from its Accept header
+func WireFormatOfAccept(r *http.Request) WireFormat {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, rawMediaType := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(rawMediaType))
+			if err == nil && mediaType == BINARY_CONTENT_TYPE {
+				return WIRE_FORMAT_BINARY
+			}
+		}
+	}
+	return WIRE_FORMAT_TEXT
+}
+
+func (f WireFormat) ContentType() string {
+	if f == WIRE_FORMAT_BINARY {
+		return BINARY_CONTENT_TYPE
+	}
+	return TEXT_CONTENT_TYPE
+}
+func (f WireFormat) EncodeBlock(block *Block) ([]byte, error) {
+	if f == WIRE_FORMAT_BINARY {
+		return block.Encode()
+	}
+	return block.Serialize()
+}
+func (f WireFormat) DecodeBlock(chain *Blockchain, byt []byte) (*Block, error) {
+	if f == WIRE_FORMAT_BINARY {
+		return DecodeBlock(chain, byt)
+	}
+	return NewBlockFromBytes(chain, byt)
+}
+func (f WireFormat) EncodeTransaction(transaction *Transaction) ([]byte, error) {
+	if f == WIRE_FORMAT_BINARY {
+		return transaction.Encode()
+	}
+	return transaction.Serialize()
+}
+func (f WireFormat) DecodeTransaction(byt []byte) (*Transaction, error) {
+	if f == WIRE_FORMAT_BINARY {
+		return DecodeTransaction(byt)
+	}
+	return NewTransactionFromBytes(byt)
+}
+
+// Encode all appendages in a chain, which is the binary equivalent of `/v1/chain`'s json
+func EncodeChain(chain *Blockchain) ([]byte, error) {
+	encoder := NewEncoder()
+	encoder.WriteUint8(ENCODING_VERSION)
+	appendages := chain.ListAppendages()
+	encoder.WriteUint32(uint32(len(appendages)))
+	for _, appendage := range appendages {
+		genesisBytes, err := appendage.Genesis.Encode()
+		if err != nil {
+			return nil, err
+		}
+		headBytes, err := appendage.Head.Encode()
+		if err != nil {
+			return nil, err
+		}
+		encoder.WriteBytes(genesisBytes)
+		encoder.WriteBytes(headBytes)
+		encoder.WriteUint64(uint64(appendage.Length))
+		encoder.WriteInt64(appendage.UpdatedAt.UnixNano())
+	}
+	return encoder.Bytes(), nil
+}
+
+// Decode the response from `/v1/chain` in either format. The returned appendages contain only the
+// genesis and head blocks, the blocks in between have to be fetched seperately.
+func DecodeChain(chain *Blockchain, format WireFormat, byt []byte) ([]*BlockchainAppendage, error) {
+	var appendages []*BlockchainAppendage
+
+	if format == WIRE_FORMAT_BINARY {
+		decoder := NewDecoder(byt)
+		if err := decoder.ReadVersion(); err != nil {
+			return nil, err
+		}
+		count, err := decoder.ReadUint32()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < count; i += 1 {
+			genesisBytes, err := decoder.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			headBytes, err := decoder.ReadBytes()
+			if err != nil {
+				return nil, err
+			}
+			length, err := decoder.ReadUint64()
+			if err != nil {
+				return nil, err
+			}
+			updatedAt, err := decoder.ReadInt64()
+			if err != nil {
+				return nil, err
+			}
+
+			genesisBlock, err := DecodeBlock(chain, genesisBytes)
+			if err != nil {
+				return nil, err
+			}
+			headBlock, err := DecodeBlock(chain, headBytes)
+			if err != nil {
+				return nil, err
+			}
+			appendages = append(appendages, &BlockchainAppendage{
+				Genesis:   genesisBlock,
+				Head:      headBlock,
+				Length:    uint(length),
+				UpdatedAt: time.Unix(0, updatedAt).UTC(),
+			})
+		}
+		if err := decoder.Finish(); err != nil {
+			return nil, err
+		}
+		return appendages, nil
+	}
+
+	var response struct {
+		Appendages []*struct {
+			EncodedGenesis string    `json:"genesis"`
+			EncodedHead    string    `json:"head"`
+			Length         uint      `json:"chain_length"`
+			UpdatedAt      time.Time `json:"updated_at"`
+		} `json:"appendages"`
+	}
+	if err := json.Unmarshal(byt, &response); err != nil {
+		return nil, err
+	}
+	for _, appendage := range response.Appendages {
+		genesisBlock, err := NewBlockFromBytes(chain, []byte(appendage.EncodedGenesis))
+		if err != nil {
+			return nil, err
+		}
+		headBlock, err := NewBlockFromBytes(chain, []byte(appendage.EncodedHead))
+		if err != nil {
+			return nil, err
+		}
+		appendages = append(appendages, &BlockchainAppendage{
+			Genesis:   genesisBlock,
+			Head:      headBlock,
+			Length:    appendage.Length,
+			UpdatedAt: appendage.UpdatedAt,
+		})
+	}
+	return appendages, nil
+}
+
+// Decode the response from `/v1/blocks/{hash}` in either format
+func DecodeBlockResponse(chain *Blockchain, format WireFormat, byt []byte) (*Block, error) {
+	if format == WIRE_FORMAT_BINARY {
+		return DecodeBlock(chain, byt)
+	}
+
+	var response struct {
+		Block string `json:"block"`
+	}
+	if err := json.Unmarshal(byt, &response); err != nil {
+		return nil, err
+	}
+	return NewBlockFromBytes(chain, []byte(response.Block))
+}
+
+// Decode the response from `/v1/transactions/{id}` in either format
+func DecodeTransactionResponse(format WireFormat, byt []byte) (*Transaction, error) {
+	if format == WIRE_FORMAT_BINARY {
+		return DecodeTransaction(byt)
+	}
+
+	var response struct {
+		Transaction string `json:"transaction"`
+	}
+	if err := json.Unmarshal(byt, &response); err != nil {
+		return nil, err
+	}
+	return NewTransactionFromBytes([]byte(response.Transaction))
+}
+
+func writeBinary(w http.ResponseWriter, byt []byte) {
+	w.Header().Set("Content-Type", BINARY_CONTENT_TYPE)
+	w.WriteHeader(200)
+	w.Write(byt)
+}